@@ -1,50 +1,168 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 	"tranvaj/ZOS2023_SP_GO/util"
 )
 
 func main() {
-	var fs *os.File
+	var fs util.BlockDevice
 
-	if len(os.Args[1:]) != 1 {
-		fmt.Println("Wrong amount of arguments. The argument should be the name of the filesystem.")
+	lang := flag.String("lang", "", "language of the messages (en, cs, strict), detected from LANG if not set")
+	strict := flag.Bool("strict", false, "print only the canonical assignment messages (same as --lang strict)")
+	cache := flag.String("cache", "writethrough", "caching of the image (off, writethrough, writeback)")
+	backend := flag.String("backend", util.BackendFile, "storage of the image (file, memory, mmap), memory never writes the image back")
+	readonly := flag.Bool("readonly", false, "open the image read-only, other read-only processes may use it at the same time")
+	force := flag.Bool("force", false, "open the image even if another process is using it")
+	trace := flag.Bool("trace", false, "log every read and write of the image's structures (see trace on)")
+	traceFile := flag.String("trace-file", "", "append the trace to this file instead of stderr")
+	metrics := flag.String("metrics", "", "serve statistics on this loopback address (127.0.0.1:port) as /debug/vars and /metrics")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: [flags] <filesystem>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       [flags] serve <unix socket | 127.0.0.1:port> <filesystem>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       [flags] connect <unix socket | 127.0.0.1:port>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       [flags] mkimage --from <hostdir> [--size auto|<size>] [--cluster-size <size>] <image>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cachePolicy, err := util.ParseCachePolicy(*cache)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	language := util.DetectLanguage()
+	if *lang != "" {
+		language = *lang
+	}
+	if *strict {
+		language = util.LangStrict
+	}
+	if err := util.SetLanguage(language); err != nil {
+		fmt.Println(err)
 		return
 	}
-	FSNAME := os.Args[1:][0]
+
+	args := flag.Args()
+	if len(args) == 2 && args[0] == "connect" {
+		if err := util.Connect(args[1], os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "mkimage" {
+		if err := mkimage(args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	serveAddress := ""
+	if len(args) == 3 && args[0] == "serve" {
+		serveAddress = args[1]
+		args = args[2:]
+	}
+	if len(args) != 1 {
+		fmt.Println(util.Msg(util.MsgUsage))
+		return
+	}
+	FSNAME := args[0]
+	stdin := bufio.NewReader(os.Stdin)
 
 	//check if filesystem exists
 	if _, err := os.Stat(FSNAME); err != nil {
-		arr, err := util.LoadCommand(os.Stdin)
-		command := strings.ToLower(arr[0])
-		if command != "format" {
-			fmt.Println("Filesystem does not exist. Please format it first.")
+		if serveAddress != "" {
+			fmt.Println(util.Msg(util.MsgFsDoesNotExist))
+			return
+		}
+		arr, err := util.LoadCommand(stdin)
+		if err != nil || strings.ToLower(arr[0]) != "format" || len(arr) < 2 || len(arr) > 4 {
+			fmt.Println(util.Msg(util.MsgFsDoesNotExist))
+			return
+		}
+		if *readonly {
+			fmt.Println(util.Msg(util.MsgFsDoesNotExist))
 			return
 		}
-		fs, err = util.ExecFormat(arr[1], FSNAME)
+		fs, err = util.OpenDevice(FSNAME, util.OpenOptions{Backend: *backend, Create: true, Force: *force})
+		if err == nil {
+			err = util.ExecFormat(arr[1:], fs)
+			if err != nil {
+				fs.Close()
+				os.Remove(FSNAME)
+			}
+		}
 		if err != nil {
-			fmt.Println(err)
+			fmt.Println(util.Msg(util.MsgCannotFormat, err))
 			return
 		} else {
-			fmt.Println("OK")
+			fmt.Println(util.Msg(util.MsgOK))
 		}
 	} else {
-		fs, _ = os.OpenFile(FSNAME, os.O_RDWR, 0666)
+		fs, err = util.OpenDevice(FSNAME, util.OpenOptions{Backend: *backend, ReadOnly: *readonly, Force: *force})
 		if err != nil {
-			log.Fatal(err)
+			fmt.Println(err)
 			return
 		}
 	}
-	defer fs.Close()
+	fs, err = util.NewCachedDevice(fs, cachePolicy, util.DefaultCachePages)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	if *readonly {
+		//a write-back cache would accept writes the image below refuses only when they are flushed
+		fs = util.NewReadOnlyDevice(fs)
+	}
 
-	commandInterpreter := util.NewInterpreter(fs)
+	if *trace {
+		w, closeTrace, err := util.OpenTraceOutput(*traceFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer closeTrace()
+		util.StartTrace(fs, w, util.LoadSuperBlock(fs))
+	}
+
+	if *metrics != "" {
+		metricsServer, err := util.StartMetricsServer(*metrics)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer metricsServer.Close()
+	}
+
+	if serveAddress != "" {
+		serve(serveAddress, fs)
+		return
+	}
+
+	commandInterpreter := util.NewSession(fs, stdin, os.Stdout, false)
+	defer commandInterpreter.Close()
 	for {
-		commandInterpreter.LoadInterpreter()
-		arr, err := util.LoadCommand(os.Stdin)
+		if err := commandInterpreter.LoadInterpreter(); err != nil {
+			fmt.Println(err)
+		}
+		arr, err := commandInterpreter.ReadCommand()
+		if err == io.EOF {
+			//end of input, cached changes are written by Close
+			return
+		}
 		if err != nil {
 			fmt.Println(err)
 			continue
@@ -55,3 +173,88 @@ func main() {
 		}
 	}
 }
+
+// mkimage builds an image from a directory of the host.
+// The timestamps in the image are set to SOURCE_DATE_EPOCH (seconds since 1970), the start of 1970 if it is not set,
+// so the same tree always gives the same image.
+func mkimage(args []string) error {
+	flags := flag.NewFlagSet("mkimage", flag.ContinueOnError)
+	from := flags.String("from", "", "directory of the host copied into the image")
+	size := flags.String("size", "auto", "size of the image (for example 600MB), auto computes the smallest size")
+	clusterSize := flags.String("cluster-size", "", "cluster size of the image (for example 4KB)")
+	secureDelete := flags.Bool("secure-delete", false, "turn on secure deletion in the new filesystem")
+	if err := flags.Parse(args); err != nil || *from == "" || flags.NArg() != 1 {
+		return errors.New(util.Msg(util.MsgArgsMkimage))
+	}
+	output := flags.Arg(0)
+
+	opts := util.ImageOptions{ModTime: time.Unix(0, 0)}
+	if *size != "auto" {
+		parsed, err := util.ParseFormatString(*size)
+		if err != nil || parsed > math.MaxInt64 {
+			return errors.New(util.Msg(util.MsgArgsMkimage))
+		}
+		opts.Size = int64(parsed)
+	}
+	if *clusterSize != "" {
+		parsed, err := util.ParseFormatString(*clusterSize)
+		if err != nil || parsed > util.MaxClusterSize {
+			return errors.New(util.Msg(util.MsgArgsMkimage))
+		}
+		opts.ClusterSize = int32(parsed)
+	}
+	if *secureDelete {
+		opts.Flags |= util.SuperblockFlagSecureDelete
+	}
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH %s", epoch)
+		}
+		opts.ModTime = time.Unix(seconds, 0)
+	}
+	if info, err := os.Stat(*from); err != nil || !info.IsDir() {
+		return errors.New(util.Msg(util.MsgSourceNotFound))
+	}
+
+	fs, err := util.OpenImageOutput(output)
+	if err != nil {
+		return err
+	}
+	superBlock, usage, err := util.BuildImage(fs, *from, opts)
+	if closeErr := fs.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+	for _, skipped := range usage.Skipped {
+		fmt.Println(util.Msg(util.MsgSkipped, skipped))
+	}
+	fmt.Println(util.Msg(util.MsgImageBuilt, output, usage.Files, usage.Bytes, usage.Dirs, superBlock.DiskSize))
+	return nil
+}
+
+// serve shares the filesystem with clients connecting to the address until the process is interrupted.
+func serve(address string, fs util.BlockDevice) {
+	defer fs.Close()
+	listener, err := util.Listen(address)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	server := util.NewServer(listener, fs)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Close()
+	}()
+
+	log.Printf("serving %s", address)
+	if err := server.Serve(); err != nil {
+		log.Println(err)
+	}
+}
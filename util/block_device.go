@@ -0,0 +1,287 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// BlockDevice is the storage the filesystem image lives on.
+// All access is positional, so implementations do not keep any file offset.
+type BlockDevice interface {
+	io.ReaderAt
+	io.WriterAt
+	// Sync makes sure all written data is stored persistently.
+	Sync() error
+	// Size returns the size of the device in bytes.
+	Size() (int64, error)
+	// Truncate changes the size of the device, new space reads as zeros.
+	Truncate(size int64) error
+	io.Closer
+}
+
+const (
+	BackendFile   = "file"
+	BackendMemory = "memory"
+	BackendMmap   = "mmap"
+)
+
+// OpenOptions says how an image is opened by OpenDevice.
+type OpenOptions struct {
+	// Backend is the storage of the image: file (default), memory or mmap.
+	Backend string
+	// Create creates a missing image with zero size (it has to be formatted before use).
+	Create bool
+	// ReadOnly opens the image only for reading, writes return ErrReadOnly.
+	ReadOnly bool
+	// Force opens the image even if another process holds its lock.
+	Force bool
+}
+
+// OpenDevice opens the image at the given path.
+// The image is locked against other processes, exclusively for writing or shared for reading (see LockImage).
+// The memory backend loads the image into memory and never writes it back, so it does not lock the image.
+func OpenDevice(path string, opts OpenOptions) (BlockDevice, error) {
+	flags := os.O_RDWR
+	if opts.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	if opts.Create && !opts.ReadOnly {
+		flags |= os.O_CREATE
+	}
+
+	var dev BlockDevice
+	switch strings.ToLower(opts.Backend) {
+	case BackendFile, "":
+		fp, err := openLockedImage(path, flags, opts)
+		if err != nil {
+			return nil, err
+		}
+		dev = NewFileDevice(fp)
+	case BackendMemory, "mem":
+		data, err := os.ReadFile(path)
+		if err != nil && !(opts.Create && os.IsNotExist(err)) {
+			return nil, err
+		}
+		dev = NewMemDevice(data)
+	case BackendMmap:
+		fp, err := openLockedImage(path, flags, opts)
+		if err != nil {
+			return nil, err
+		}
+		mmapDev, err := NewMmapDevice(fp, opts.ReadOnly)
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		dev = mmapDev
+	default:
+		return nil, fmt.Errorf("unknown device backend %q (file, memory, mmap)", opts.Backend)
+	}
+	if opts.ReadOnly {
+		dev = NewReadOnlyDevice(dev)
+	}
+	return dev, nil
+}
+
+// openLockedImage opens the image file and locks it. If the lock is held by another process,
+// the image is opened anyway only when opts.Force is set.
+func openLockedImage(path string, flags int, opts OpenOptions) (*os.File, error) {
+	fp, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = LockImage(fp, !opts.ReadOnly)
+	if err != nil && !opts.Force {
+		fp.Close()
+		return nil, err
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, Msg(MsgLockIgnored, err))
+	}
+	return fp, nil
+}
+
+// Invalidator is implemented by devices which keep a copy of the image in memory, like CachedDevice.
+type Invalidator interface {
+	// Invalidate throws away the copy, so changes made to the image by other processes become visible.
+	Invalidate() error
+}
+
+// InvalidateDevice makes changes made to the image by other processes visible through the device:
+// the copy kept by the device (if it is an Invalidator) and the cached directory items are thrown away.
+func InvalidateDevice(dev BlockDevice) error {
+	dropDentries(dev)
+	if invalidator, ok := baseDevice(dev).(Invalidator); ok {
+		return invalidator.Invalidate()
+	}
+	return nil
+}
+
+// ReadOnlyDevice refuses all writes into the underlying device.
+type ReadOnlyDevice struct {
+	BlockDevice
+}
+
+// NewReadOnlyDevice wraps the device so that it can only be read.
+func NewReadOnlyDevice(dev BlockDevice) *ReadOnlyDevice {
+	return &ReadOnlyDevice{BlockDevice: dev}
+}
+
+func (d *ReadOnlyDevice) WriteAt(p []byte, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (d *ReadOnlyDevice) Truncate(size int64) error {
+	return ErrReadOnly
+}
+
+// Invalidate invalidates the underlying device, see InvalidateDevice.
+func (d *ReadOnlyDevice) Invalidate() error {
+	if invalidator, ok := d.BlockDevice.(Invalidator); ok {
+		return invalidator.Invalidate()
+	}
+	return nil
+}
+
+// FileDevice is a BlockDevice backed by a file on the host filesystem.
+type FileDevice struct {
+	fp *os.File
+}
+
+// NewFileDevice creates a BlockDevice which reads and writes the given host file.
+func NewFileDevice(fp *os.File) *FileDevice {
+	return &FileDevice{fp: fp}
+}
+
+func (d *FileDevice) ReadAt(p []byte, off int64) (int, error) {
+	return d.fp.ReadAt(p, off)
+}
+
+func (d *FileDevice) WriteAt(p []byte, off int64) (int, error) {
+	return d.fp.WriteAt(p, off)
+}
+
+func (d *FileDevice) Sync() error {
+	return d.fp.Sync()
+}
+
+func (d *FileDevice) Size() (int64, error) {
+	info, err := d.fp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (d *FileDevice) Truncate(size int64) error {
+	return d.fp.Truncate(size)
+}
+
+func (d *FileDevice) Close() error {
+	return d.fp.Close()
+}
+
+// File returns the host file of the device.
+func (d *FileDevice) File() *os.File {
+	return d.fp
+}
+
+// MemDevice is a BlockDevice kept entirely in memory.
+type MemDevice struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// NewMemDevice creates an in-memory BlockDevice with the given initial content.
+func NewMemDevice(data []byte) *MemDevice {
+	return &MemDevice{data: data}
+}
+
+func (d *MemDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return readAtSlice(d.data, p, off)
+}
+
+func (d *MemDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	if end := off + int64(len(p)); end > int64(len(d.data)) {
+		d.data = append(d.data, make([]byte, end-int64(len(d.data)))...)
+	}
+	return copy(d.data[off:], p), nil
+}
+
+func (d *MemDevice) Sync() error {
+	return nil
+}
+
+func (d *MemDevice) Size() (int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return int64(len(d.data)), nil
+}
+
+func (d *MemDevice) Truncate(size int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if size < int64(len(d.data)) {
+		d.data = d.data[:size]
+		return nil
+	}
+	d.data = append(d.data, make([]byte, size-int64(len(d.data)))...)
+	return nil
+}
+
+func (d *MemDevice) Close() error {
+	return nil
+}
+
+// Bytes returns the current content of the device.
+func (d *MemDevice) Bytes() []byte {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.data
+}
+
+// readAtSlice implements io.ReaderAt semantics over a byte slice.
+func readAtSlice(data []byte, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readStruct decodes a little endian value (struct or slice) stored at the given offset of the device.
+func readStruct(dev BlockDevice, offset int64, value any) error {
+	buf := make([]byte, binary.Size(value))
+	if _, err := dev.ReadAt(buf, offset); err != nil {
+		return err
+	}
+	return binary.Read(bytes.NewReader(buf), binary.LittleEndian, value)
+}
+
+// writeStruct encodes a value (struct or slice) in little endian and stores it at the given offset of the device.
+func writeStruct(dev BlockDevice, offset int64, value any) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, value); err != nil {
+		return err
+	}
+	_, err := dev.WriteAt(buf.Bytes(), offset)
+	return err
+}
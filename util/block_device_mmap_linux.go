@@ -0,0 +1,122 @@
+//go:build linux
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// MmapDevice is a BlockDevice backed by a host file mapped into memory.
+type MmapDevice struct {
+	mu       sync.RWMutex
+	fp       *os.File
+	data     []byte
+	readOnly bool
+}
+
+// NewMmapDevice maps the given host file into memory. The file stays open until Close is called.
+// A read only file has to be mapped with readOnly set.
+func NewMmapDevice(fp *os.File, readOnly bool) (*MmapDevice, error) {
+	d := &MmapDevice{fp: fp, readOnly: readOnly}
+	if err := d.remap(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// remap maps the whole file again, for example after its size changed. The caller must hold d.mu for writing.
+func (d *MmapDevice) remap() error {
+	if d.data != nil {
+		if err := syscall.Munmap(d.data); err != nil {
+			return err
+		}
+		d.data = nil
+	}
+	info, err := d.fp.Stat()
+	if err != nil {
+		return err
+	}
+	//an empty file cannot be mapped, it is mapped after it is truncated to a non zero size
+	if info.Size() == 0 {
+		return nil
+	}
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	if d.readOnly {
+		prot = syscall.PROT_READ
+	}
+	data, err := syscall.Mmap(int(d.fp.Fd()), 0, int(info.Size()), prot, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("could not map image: %v", err)
+	}
+	d.data = data
+	return nil
+}
+
+func (d *MmapDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return readAtSlice(d.data, p, off)
+}
+
+func (d *MmapDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	if off < 0 || off+int64(len(p)) > int64(len(d.data)) {
+		return 0, fmt.Errorf("write outside of the mapped image")
+	}
+	return copy(d.data[off:], p), nil
+}
+
+func (d *MmapDevice) Sync() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.data != nil && !d.readOnly {
+		if err := msync(d.data); err != nil {
+			return err
+		}
+	}
+	return d.fp.Sync()
+}
+
+func (d *MmapDevice) Size() (int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return int64(len(d.data)), nil
+}
+
+func (d *MmapDevice) Truncate(size int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.fp.Truncate(size); err != nil {
+		return err
+	}
+	return d.remap()
+}
+
+func (d *MmapDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.data != nil {
+		if err := syscall.Munmap(d.data); err != nil {
+			return err
+		}
+		d.data = nil
+	}
+	return d.fp.Close()
+}
+
+// msync flushes the mapped pages into the file.
+func msync(data []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
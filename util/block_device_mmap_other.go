@@ -0,0 +1,18 @@
+//go:build !linux
+
+package util
+
+import (
+	"fmt"
+	"os"
+)
+
+// MmapDevice is only available on Linux.
+type MmapDevice struct {
+	BlockDevice
+}
+
+// NewMmapDevice returns an error, memory mapped images are only supported on Linux.
+func NewMmapDevice(fp *os.File, readOnly bool) (*MmapDevice, error) {
+	return nil, fmt.Errorf("mmap backend is only supported on linux")
+}
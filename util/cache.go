@@ -0,0 +1,262 @@
+package util
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CachePolicy says how writes into a cached filesystem image are propagated to the disk.
+type CachePolicy int
+
+const (
+	// CacheOff disables caching, every read and write goes directly to the image.
+	CacheOff CachePolicy = iota
+	// CacheWriteThrough keeps read data in memory and writes every change to the image immediately.
+	CacheWriteThrough
+	// CacheWriteBack keeps changes in memory until the device is synced or the page is evicted.
+	CacheWriteBack
+)
+
+const (
+	// cachePageSize is the granularity of the cache, one cluster of the default size.
+	cachePageSize = DefaultClusterSize
+	// DefaultCachePages is the default capacity of the cache in pages (8 MiB).
+	DefaultCachePages = 16384
+)
+
+// ParseCachePolicy converts the name of a policy (off, writethrough, writeback) into a CachePolicy.
+func ParseCachePolicy(name string) (CachePolicy, error) {
+	switch strings.ToLower(name) {
+	case "off", "none":
+		return CacheOff, nil
+	case "writethrough", "write-through", "wt":
+		return CacheWriteThrough, nil
+	case "writeback", "write-back", "wb":
+		return CacheWriteBack, nil
+	}
+	return CacheOff, fmt.Errorf("unknown cache policy %q (off, writethrough, writeback)", name)
+}
+
+func (p CachePolicy) String() string {
+	switch p {
+	case CacheWriteThrough:
+		return "writethrough"
+	case CacheWriteBack:
+		return "writeback"
+	}
+	return "off"
+}
+
+// cachePage is one cached page of the image.
+type cachePage struct {
+	index int64
+	data  []byte
+	dirty bool
+	elem  *list.Element
+}
+
+// CachedDevice is a BlockDevice with an LRU page cache in front of another BlockDevice.
+// It caches every access to the image: superblock, bitmaps, inodes, directory and data blocks.
+type CachedDevice struct {
+	mu       sync.Mutex
+	dev      BlockDevice
+	policy   CachePolicy
+	capacity int
+	size     int64 //size of the device, so it does not have to be queried on every read
+	pages    map[int64]*cachePage
+	lru      *list.List //front is the most recently used page
+}
+
+// NewCachedDevice puts a page cache with the given policy and capacity in pages in front of the given device.
+// If the policy is CacheOff, the device is returned unchanged.
+func NewCachedDevice(dev BlockDevice, policy CachePolicy, capacity int) (BlockDevice, error) {
+	if policy == CacheOff {
+		return dev, nil
+	}
+	if capacity <= 0 {
+		capacity = DefaultCachePages
+	}
+	size, err := dev.Size()
+	if err != nil {
+		return nil, err
+	}
+	return &CachedDevice{
+		dev:      dev,
+		policy:   policy,
+		capacity: capacity,
+		size:     size,
+		pages:    map[int64]*cachePage{},
+		lru:      list.New(),
+	}, nil
+}
+
+// Policy returns the policy of the cache.
+func (c *CachedDevice) Policy() CachePolicy {
+	return c.policy
+}
+
+// Sync writes all dirty pages back to the underlying device and syncs it.
+func (c *CachedDevice) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.flush(); err != nil {
+		return err
+	}
+	return c.dev.Sync()
+}
+
+func (c *CachedDevice) Size() (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size, nil
+}
+
+// Truncate throws away all cached pages (including dirty ones) and truncates the underlying device.
+func (c *CachedDevice) Truncate(size int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pages = map[int64]*cachePage{}
+	c.lru.Init()
+	c.size = size
+	return c.dev.Truncate(size)
+}
+
+// Invalidate writes all dirty pages back and throws away the cached pages, so the next reads see changes
+// made to the image by other processes.
+func (c *CachedDevice) Invalidate() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.flush(); err != nil {
+		return err
+	}
+	c.pages = map[int64]*cachePage{}
+	c.lru.Init()
+	size, err := c.dev.Size()
+	if err != nil {
+		return err
+	}
+	c.size = size
+	return nil
+}
+
+// Close writes all dirty pages back and closes the underlying device.
+func (c *CachedDevice) Close() error {
+	err := c.Sync()
+	if closeErr := c.dev.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// flush writes dirty pages in ascending order of their address. The caller must hold c.mu.
+func (c *CachedDevice) flush() error {
+	dirty := make([]*cachePage, 0)
+	for _, page := range c.pages {
+		if page.dirty {
+			dirty = append(dirty, page)
+		}
+	}
+	sort.Slice(dirty, func(a, b int) bool { return dirty[a].index < dirty[b].index })
+	for _, page := range dirty {
+		if err := c.writePage(page); err != nil {
+			return err
+		}
+		page.dirty = false
+	}
+	return nil
+}
+
+// writePage writes the page into the underlying device, a page reaching past the end of the device is shortened.
+// The caller must hold c.mu.
+func (c *CachedDevice) writePage(page *cachePage) error {
+	data := page.data
+	if end := page.index*cachePageSize + cachePageSize; end > c.size {
+		data = data[:max(0, c.size-page.index*cachePageSize)]
+	}
+	if _, err := c.dev.WriteAt(data, page.index*cachePageSize); err != nil {
+		return fmt.Errorf("could not write cached page: %v", err)
+	}
+	return nil
+}
+
+// page returns the cached page with the given index, reading it from the device if it is not cached.
+// The caller must hold c.mu.
+func (c *CachedDevice) page(index int64) (*cachePage, error) {
+	if page, ok := c.pages[index]; ok {
+		c.lru.MoveToFront(page.elem)
+		return page, nil
+	}
+	page := &cachePage{index: index, data: make([]byte, cachePageSize)}
+	//the last page of the image may be shorter, the rest stays zeroed
+	if _, err := c.dev.ReadAt(page.data, index*cachePageSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	for len(c.pages) >= c.capacity {
+		if err := c.evict(); err != nil {
+			return nil, err
+		}
+	}
+	page.elem = c.lru.PushFront(page)
+	c.pages[index] = page
+	return page, nil
+}
+
+// evict removes the least recently used page, writing it back first if it is dirty. The caller must hold c.mu.
+func (c *CachedDevice) evict() error {
+	elem := c.lru.Back()
+	page := elem.Value.(*cachePage)
+	if page.dirty {
+		if err := c.writePage(page); err != nil {
+			return err
+		}
+	}
+	c.lru.Remove(elem)
+	delete(c.pages, page.index)
+	return nil
+}
+
+func (c *CachedDevice) ReadAt(buf []byte, offset int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	done := 0
+	for done < len(buf) {
+		pos := offset + int64(done)
+		if pos >= c.size {
+			return done, io.EOF
+		}
+		page, err := c.page(pos / cachePageSize)
+		if err != nil {
+			return done, err
+		}
+		done += copy(buf[done:min(len(buf), done+int(c.size-pos))], page.data[pos%cachePageSize:])
+	}
+	return done, nil
+}
+
+func (c *CachedDevice) WriteAt(buf []byte, offset int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.policy == CacheWriteThrough {
+		if _, err := c.dev.WriteAt(buf, offset); err != nil {
+			return 0, err
+		}
+	}
+	c.size = max(c.size, offset+int64(len(buf)))
+	done := 0
+	for done < len(buf) {
+		pos := offset + int64(done)
+		page, err := c.page(pos / cachePageSize)
+		if err != nil {
+			return done, err
+		}
+		done += copy(page.data[pos%cachePageSize:], buf[done:])
+		if c.policy == CacheWriteBack {
+			page.dirty = true
+		}
+	}
+	return done, nil
+}
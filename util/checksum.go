@@ -0,0 +1,199 @@
+package util
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Checksums of files: sha256sum, md5sum, crc32, manifest and verify.
+//
+// The lines are written in the format of sha256sum of the host (the checksum, two spaces and the path), so
+// a manifest of a directory of the image can be checked by sha256sum -c on the host after outcp and a listing
+// made by sha256sum on the host can be checked by verify in the image.
+
+// checksumAlgorithms maps the names of the commands to the hash functions. The algorithm of a manifest
+// is recognized by the length of its checksums, which differs for each of them.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256sum": sha256.New,
+	"md5sum":    md5.New,
+	"crc32":     func() hash.Hash { return crc32.NewIEEE() },
+}
+
+// fileChecksum returns the checksum of a file of the filesystem in hexadecimal.
+func (i *Interpreter) fileChecksum(filePath string, newHash func() hash.Hash) (string, error) {
+	file, err := i.openForReading(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := newHash()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", msgError(MsgErrReadData, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Checksum prints the checksums of the files: sha256sum|md5sum|crc32 <files...>.
+func (i *Interpreter) Checksum(arr []string) error {
+	if len(arr) < 2 {
+		return msgError(MsgArgsFiles)
+	}
+	newHash := checksumAlgorithms[arr[0]]
+	for _, filePath := range arr[1:] {
+		sum, err := i.fileChecksum(filePath, newHash)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(i.out, "%s  %s\n", sum, filePath)
+	}
+	return nil
+}
+
+// manifestFiles returns the paths of all regular files in the directory and its subdirectories relative to it,
+// sorted by name.
+func (i *Interpreter) manifestFiles(dirPath string) ([]string, error) {
+	inode, _, err := PathToInode(i.fs, dirPath, i.superBlock, i.currentDirInode)
+	if err != nil {
+		return nil, msgError(MsgFileNotFound)
+	}
+	if !inode.IsDirectory {
+		return nil, msgError(MsgNotADirectory)
+	}
+	files, err := i.collectFiles("", inode, make([]string, 0))
+	if err != nil {
+		return nil, msgError(MsgErrLoadDir, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Manifest prints the SHA-256 checksums of all files in a directory and its subdirectories with paths relative
+// to it: manifest <dir>. Its output is meant to be redirected into a file and checked later by verify.
+func (i *Interpreter) Manifest(arr []string) error {
+	if len(arr) != 2 {
+		return msgError(MsgArgsManifest)
+	}
+	files, err := i.manifestFiles(arr[1])
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		sum, err := i.fileChecksum(path.Join(arr[1], file), sha256.New)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(i.out, "%s  %s\n", sum, file)
+	}
+	return nil
+}
+
+// parseManifest reads the lines of a manifest and returns the checksums by the cleaned relative paths.
+// Both the text (two spaces) and the binary (space and *) separators of sha256sum are accepted.
+func parseManifest(r io.Reader) (map[string]string, error) {
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, " ")
+		if !ok || len(name) < 2 || (name[0] != ' ' && name[0] != '*') {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		if _, err := hex.DecodeString(sum); err != nil {
+			return nil, fmt.Errorf("invalid checksum in line %q", line)
+		}
+		sums[path.Clean(name[1:])] = strings.ToLower(sum)
+	}
+	return sums, scanner.Err()
+}
+
+// manifestAlgorithm returns the hash function which produces checksums of the given length in hexadecimal.
+func manifestAlgorithm(sum string) (func() hash.Hash, bool) {
+	for _, newHash := range checksumAlgorithms {
+		if newHash().Size()*2 == len(sum) {
+			return newHash, true
+		}
+	}
+	return nil, false
+}
+
+// Verify checks the files of a directory against a manifest: verify <manifest> [dir]. The manifest is a file of
+// the filesystem or, with the host: prefix, of the host, and its paths are relative to dir (the current
+// directory by default). Files which are missing, were modified or are not in the manifest are printed.
+func (i *Interpreter) Verify(arr []string) error {
+	if len(arr) != 2 && len(arr) != 3 {
+		return msgError(MsgArgsVerify)
+	}
+	dirPath := "."
+	if len(arr) == 3 {
+		dirPath = arr[2]
+	}
+	manifest, err := i.openOperand(arr[1])
+	if err != nil {
+		return err
+	}
+	sums, err := parseManifest(manifest)
+	manifest.Close()
+	if err != nil {
+		return msgError(MsgErrManifest, err)
+	}
+	files, err := i.manifestFiles(dirPath)
+	if err != nil {
+		return err
+	}
+
+	var verified, missing, modified, extra int
+	present := make(map[string]bool, len(files))
+	for _, file := range files {
+		present[file] = true
+		//a manifest stored in the checked directory changed after it listed itself (manifest . > m)
+		if path.Join(dirPath, file) == path.Clean(arr[1]) {
+			continue
+		}
+		expected, ok := sums[file]
+		if !ok {
+			fmt.Fprintln(i.out, Msg(MsgVerifyExtra, file))
+			extra++
+			continue
+		}
+		newHash, ok := manifestAlgorithm(expected)
+		if !ok {
+			return msgError(MsgErrManifest, fmt.Errorf("unknown checksum of %s", file))
+		}
+		sum, err := i.fileChecksum(path.Join(dirPath, file), newHash)
+		if err != nil {
+			return err
+		}
+		if sum != expected {
+			fmt.Fprintln(i.out, Msg(MsgVerifyModified, file))
+			modified++
+			continue
+		}
+		verified++
+	}
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		if !present[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(i.out, Msg(MsgVerifyMissing, name))
+		missing++
+	}
+	fmt.Fprintln(i.out, Msg(MsgVerified, verified, missing, modified, extra))
+	return nil
+}
@@ -0,0 +1,321 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"io"
+	"path"
+)
+
+// Map of the clusters of the image (export-map).
+//
+// Every cluster of the image gets a role: the metadata regions at the start of the image are recognized by their
+// addresses, the data clusters by walking all used inodes through GetFileClusters. The map is written as an HTML
+// page with an SVG grid, one square per cluster, colored by the inode which owns it and its role, so fragmented
+// files and leaked clusters are seen at a glance.
+
+// ClusterRole is what a cluster of the image is used for.
+type ClusterRole string
+
+// Roles of clusters.
+const (
+	RoleSuperblock     ClusterRole = "superblock"
+	RoleDataBitmap     ClusterRole = "data bitmap"
+	RoleInodeBitmap    ClusterRole = "inode bitmap"
+	RoleInodes         ClusterRole = "inode table"
+	RoleData           ClusterRole = "file data"
+	RoleDirectory      ClusterRole = "directory"
+	RoleDirIndex       ClusterRole = "directory index"
+	RoleSingleIndirect ClusterRole = "singly indirect"
+	RoleDoubleIndirect ClusterRole = "doubly indirect"
+	RoleXattr          ClusterRole = "attributes"
+	RoleFree           ClusterRole = "free"
+	RoleLost           ClusterRole = "used, no owner" // set in the bitmap, but no inode points to it
+)
+
+// MapCluster describes one cluster of the image.
+type MapCluster struct {
+	Role  ClusterRole
+	Inode int32  // owning inode, 0 for metadata and free clusters
+	Path  string // path of the owning file, empty if it is not known
+	Block int    // position of the cluster in the file for data clusters
+}
+
+// BuildClusterMap returns the role and the owner of every cluster of the image, indexed by cluster number.
+func BuildClusterMap(fs BlockDevice, superBlock Superblock) ([]MapCluster, error) {
+	clusterSize := int64(superBlock.ClusterSize)
+	clusters := make([]MapCluster, superBlock.DiskSize/clusterSize)
+
+	//the regions before the data are not aligned to clusters, a cluster belongs to the region it starts in
+	inodeSize := int64(binary.Size(PseudoInode{}))
+	regions := []struct {
+		role       ClusterRole
+		start, end int64
+	}{
+		{RoleSuperblock, 0, int64(binary.Size(Superblock{}))},
+		{RoleInodeBitmap, superBlock.BitmapiStartAddress, superBlock.BitmapiStartAddress + int64(superBlock.BitmapiSize)},
+		{RoleDataBitmap, superBlock.BitmapStartAddress, superBlock.BitmapStartAddress + int64(superBlock.BitmapSize)},
+		{RoleInodes, superBlock.InodeStartAddress, superBlock.InodeStartAddress + int64(superBlock.InodeCount)*inodeSize},
+	}
+	firstDataCluster := superBlock.DataStartAddress / clusterSize
+	for cluster := int64(0); cluster < firstDataCluster; cluster++ {
+		address := cluster * clusterSize
+		for _, region := range regions {
+			if region.start < address+clusterSize && address < region.end {
+				clusters[cluster].Role = region.role
+			}
+		}
+	}
+
+	inodeBitmap, dataBitmap, err := loadBitmaps(fs, superBlock)
+	if err != nil {
+		return nil, err
+	}
+	for n := int32(0); n < superBlock.ClusterCount; n++ {
+		role := RoleFree
+		if getBit(dataBitmap[n/8], n%8) == 1 {
+			role = RoleLost
+		}
+		clusters[firstDataCluster+int64(n)].Role = role
+	}
+
+	paths, err := inodePaths(fs, superBlock)
+	if err != nil {
+		return nil, err
+	}
+	for id := int32(1); id <= superBlock.InodeCount; id++ {
+		if getBit(inodeBitmap[(id-1)/8], (id-1)%8) == 0 {
+			continue
+		}
+		inode, err := LoadInode(fs, id, superBlock.InodeStartAddress)
+		if err != nil {
+			return nil, err
+		}
+		if inode.NodeId != id {
+			continue
+		}
+		owned, err := inodeClusterRoles(fs, inode, superBlock)
+		if err != nil {
+			return nil, fmt.Errorf("could not read clusters of inode %d: %v", id, err)
+		}
+		for _, c := range owned {
+			if int64(c.cluster) < firstDataCluster || int64(c.cluster) >= int64(len(clusters)) {
+				continue
+			}
+			clusters[c.cluster] = MapCluster{Role: c.role, Inode: id, Path: paths[id], Block: c.block}
+		}
+	}
+	return clusters, nil
+}
+
+// ownedCluster is a cluster of an inode and its role.
+type ownedCluster struct {
+	cluster int32
+	role    ClusterRole
+	block   int //position in the file for data clusters
+}
+
+// inodeClusterRoles returns all clusters of an inode with their roles, the data clusters in the order of the file.
+// The positions of the data clusters count the holes of sparse files too.
+func inodeClusterRoles(fs BlockDevice, inode PseudoInode, superBlock Superblock) ([]ownedCluster, error) {
+	_, pointerClusters, err := GetFileClusters(fs, inode, superBlock)
+	if err != nil {
+		return nil, err
+	}
+	//one entry for every cluster of the file, zero for a hole
+	positions, err := fileClusterList(fs, superBlock, inode)
+	if err != nil {
+		return nil, err
+	}
+	dataRole := RoleData
+	if inode.IsDirectory {
+		dataRole = RoleDirectory
+	} else if inode.Flags&InodeFlagDirIndex != 0 {
+		dataRole = RoleDirIndex
+	}
+	owned := make([]ownedCluster, 0, len(positions)+len(pointerClusters)+1)
+	for block, cluster := range positions {
+		if cluster != 0 {
+			owned = append(owned, ownedCluster{cluster, dataRole, block})
+		}
+	}
+	//the singly indirect block of the inode, the rest are the blocks of the doubly indirect tree
+	for _, cluster := range pointerClusters {
+		role := RoleDoubleIndirect
+		if cluster == inode.Indirect[0] {
+			role = RoleSingleIndirect
+		}
+		owned = append(owned, ownedCluster{cluster, role, 0})
+	}
+	if inode.XattrCluster != 0 {
+		owned = append(owned, ownedCluster{inode.XattrCluster, RoleXattr, 0})
+	}
+	return owned, nil
+}
+
+// inodePaths returns a path of every inode which can be reached from the root directory.
+// A file with more links gets the first path found, the index of a directory gets the path of the directory.
+func inodePaths(fs BlockDevice, superBlock Superblock) (map[int32]string, error) {
+	paths := map[int32]string{1: "/"}
+	var walk func(dirInode PseudoInode, dirPath string) error
+	walk = func(dirInode PseudoInode, dirPath string) error {
+		if dirInode.DirIndex != 0 {
+			paths[dirInode.DirIndex] = dirPath + " (index)"
+		}
+		dir, err := LoadDirectory(fs, dirInode, superBlock)
+		if err != nil {
+			return err
+		}
+		for n, item := range dir {
+			//. and ..
+			if n < 2 || item.Inode == 0 {
+				continue
+			}
+			if _, seen := paths[item.Inode]; seen {
+				continue
+			}
+			itemPath := path.Join(dirPath, removeNullCharsFromString(string(item.ItemName[:])))
+			paths[item.Inode] = itemPath
+			inode, err := LoadInode(fs, item.Inode, superBlock.InodeStartAddress)
+			if err != nil {
+				return err
+			}
+			if inode.IsDirectory {
+				if err := walk(inode, itemPath); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	rootDir, err := LoadInode(fs, 1, superBlock.InodeStartAddress)
+	if err != nil {
+		return nil, err
+	}
+	return paths, walk(rootDir, "/")
+}
+
+// Layout of the map.
+const (
+	mapColumns  = 128
+	mapCellSize = 8
+)
+
+// roleLightness is the lightness of the color of each role in percent. The hue is given by the owning inode,
+// roles without an owner are gray or have a fixed color.
+var roleLightness = map[ClusterRole]int{
+	RoleData:           55,
+	RoleDirectory:      40,
+	RoleDirIndex:       70,
+	RoleSingleIndirect: 30,
+	RoleDoubleIndirect: 20,
+	RoleXattr:          80,
+}
+
+// roleColors are the colors of the roles without an owner.
+var roleColors = map[ClusterRole]string{
+	RoleSuperblock:  "#000000",
+	RoleDataBitmap:  "#5a5a8c",
+	RoleInodeBitmap: "#8c5a8c",
+	RoleInodes:      "#8c8c5a",
+	RoleFree:        "#eeeeee",
+	RoleLost:        "#ff0000",
+}
+
+// clusterColor returns the color of a cluster in the map.
+func clusterColor(cluster MapCluster) string {
+	if color, ok := roleColors[cluster.Role]; ok {
+		return color
+	}
+	//the golden angle spreads the hues of neighbouring inode ids
+	hue := (int(cluster.Inode) * 137) % 360
+	return fmt.Sprintf("hsl(%d, 70%%, %d%%)", hue, roleLightness[cluster.Role])
+}
+
+var clusterMapTemplate = template.Must(template.New("map").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+rect:hover { stroke: #000; stroke-width: 2; }
+.legend span { display: inline-block; width: 12px; height: 12px; margin: 0 4px 0 12px; vertical-align: middle; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Summary}}</p>
+<p class="legend">{{range .Legend}}<span style="background: {{.Color}}"></span>{{.Name}}{{end}}</p>
+<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="{{.Height}}">
+{{range .Cells}}<rect x="{{.X}}" y="{{.Y}}" width="{{$.CellSize}}" height="{{$.CellSize}}" fill="{{.Color}}"><title>{{.Title}}</title></rect>
+{{end}}</svg>
+</body>
+</html>
+`))
+
+type mapCell struct {
+	X, Y  int
+	Color template.CSS
+	Title string
+}
+
+type mapLegendItem struct {
+	Name  ClusterRole
+	Color template.CSS
+}
+
+// WriteClusterMap writes the map of the clusters as an HTML page with an SVG grid.
+// Hovering over a cluster shows its number, address, role and owner.
+func WriteClusterMap(w io.Writer, clusters []MapCluster, superBlock Superblock) error {
+	cells := make([]mapCell, len(clusters))
+	files := make(map[int32]bool)
+	fragmented := make(map[int32]bool)
+	used := 0
+	for n, cluster := range clusters {
+		title := fmt.Sprintf("cluster %d (address %d): %s", n, ClusterAddress(superBlock, int32(n)), cluster.Role)
+		if cluster.Inode != 0 {
+			title += fmt.Sprintf(", inode %d %s", cluster.Inode, cluster.Path)
+			if cluster.Role == RoleData || cluster.Role == RoleDirectory || cluster.Role == RoleDirIndex {
+				title += fmt.Sprintf(", block %d", cluster.Block)
+				files[cluster.Inode] = true
+				//the previous block of the file is not the previous cluster
+				if cluster.Block > 0 && (n == 0 || clusters[n-1].Inode != cluster.Inode || clusters[n-1].Block != cluster.Block-1) {
+					fragmented[cluster.Inode] = true
+				}
+			}
+		}
+		if cluster.Role != RoleFree {
+			used++
+		}
+		cells[n] = mapCell{
+			X:     (n % mapColumns) * mapCellSize,
+			Y:     (n / mapColumns) * mapCellSize,
+			Color: template.CSS(clusterColor(cluster)),
+			Title: title,
+		}
+	}
+
+	legend := make([]mapLegendItem, 0)
+	for _, role := range []ClusterRole{RoleSuperblock, RoleDataBitmap, RoleInodeBitmap, RoleInodes, RoleFree, RoleLost} {
+		legend = append(legend, mapLegendItem{role, template.CSS(roleColors[role])})
+	}
+	//the roles of files are shown in the color of inode 1
+	for _, role := range []ClusterRole{RoleData, RoleDirectory, RoleDirIndex, RoleSingleIndirect, RoleDoubleIndirect, RoleXattr} {
+		legend = append(legend, mapLegendItem{role, template.CSS(clusterColor(MapCluster{Role: role, Inode: 1}))})
+	}
+
+	rows := (len(clusters) + mapColumns - 1) / mapColumns
+	return clusterMapTemplate.Execute(w, map[string]any{
+		"Title": fmt.Sprintf("%s, %d clusters of %d bytes",
+			removeNullCharsFromString(string(superBlock.Signature[:])), len(clusters), superBlock.ClusterSize),
+		"Summary": fmt.Sprintf("%d clusters used, %d files and directories with data clusters, %d of them fragmented",
+			used, len(files), len(fragmented)),
+		"Legend":   legend,
+		"Cells":    cells,
+		"CellSize": mapCellSize - 1,
+		"Width":    mapColumns * mapCellSize,
+		"Height":   rows * mapCellSize,
+	})
+}
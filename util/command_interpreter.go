@@ -1,64 +1,90 @@
 package util
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // metody s (i *Interpreter) jsou metody, ktere jsou pristupne jen z Interpreteru (neco jako metoda tridy v jave)
 // tohle je v podstate neco jako OOP ale v Go
 
 type Interpreter struct {
-	fs              *os.File
+	fs              BlockDevice
 	superBlock      Superblock
 	dataBitmap      []uint8
 	inodeBitmap     []uint8
 	currentDirInode PseudoInode
-	currentDir      []DirectoryItem
 	currentPath     string
+	out             io.Writer     //where the output of commands is written
+	in              *bufio.Reader //where commands are read from
+	shared          bool          //the filesystem is used by other sessions at the same time
+	closeTrace      func() error  //closes the output of the trace started by trace on, nil if there is none
 }
 
 // NewInterpreter creates a new instance of the Interpreter struct.
-// It takes a pointer to an os.File as a parameter and returns a pointer to the Interpreter.
+// It takes the device with the filesystem image as a parameter and returns a pointer to the Interpreter.
 // The fs parameter represents the file system that the interpreter will operate on.
 // The currentPath field of the Interpreter is initialized to "/" or "\" depending on the system OS.
-func NewInterpreter(fs *os.File) *Interpreter {
+// The interpreter reads commands from the standard input and writes output to the standard output.
+func NewInterpreter(fs BlockDevice) *Interpreter {
+	return NewSession(fs, os.Stdin, os.Stdout, false)
+}
+
+// NewSession creates an interpreter which reads commands from in and writes output into out.
+// If shared is true, the filesystem is used by other sessions at the same time and commands
+// which would invalidate their state (format) are refused.
+func NewSession(fs BlockDevice, in io.Reader, out io.Writer, shared bool) *Interpreter {
 	return &Interpreter{
 		fs:          fs,
 		currentPath: string(os.PathSeparator),
+		out:         out,
+		in:          bufio.NewReader(in),
+		shared:      shared,
 	}
 }
 
-func (i *Interpreter) LoadInterpreter() {
+// ReadCommand reads and parses the next command from the input of the interpreter.
+func (i *Interpreter) ReadCommand() ([]string, error) {
+	return LoadCommand(i.in)
+}
+
+// LoadInterpreter loads the superblock, the bitmaps and the current directory of the session from the image.
+// It is called before every command, so the session sees the changes of the others.
+// Only the superblock is loaded from an image of another filesystem or version, the commands refuse it.
+func (i *Interpreter) LoadInterpreter() error {
 	var err error
 	i.superBlock = LoadSuperBlock(i.fs)
+	if CheckSuperBlock(i.superBlock) != nil {
+		return nil
+	}
 	currentDirInodeId := i.currentDirInode.NodeId
 	if currentDirInodeId == 0 {
 		currentDirInodeId = 1
 	}
 	i.currentDirInode, err = LoadInode(i.fs, currentDirInodeId, int64(i.superBlock.InodeStartAddress))
 	if err != nil {
-		log.Fatal(err)
-		return
+		return err
 	}
 	i.dataBitmap, err = LoadBitmap(i.fs, i.superBlock.BitmapStartAddress, i.superBlock.BitmapSize)
 	if err != nil {
-		log.Fatal(err)
-		return
+		return err
 	}
 	i.inodeBitmap, err = LoadBitmap(i.fs, i.superBlock.BitmapiStartAddress, i.superBlock.BitmapiSize)
 	if err != nil {
-		log.Fatal(err)
-		return
-	}
-	i.currentDir, err = LoadDirectory(i.fs, i.currentDirInode, i.superBlock)
-	if err != nil {
-		fmt.Println("could not load directory: " + err.Error())
-		return
+		return err
 	}
+	return nil
 }
 
 // getPathDir returns the directory component of the given path.
@@ -67,42 +93,226 @@ func getPathDir(path string) string {
 	return filepath.Dir(filepath.Clean(path))
 }
 
-func ExecFormat(sizeStr string, fsname string) (*os.File, error) {
-	size, err := ParseFormatString(sizeStr)
-	if err != nil {
-		return nil, err
+// ExecFormat formats the given device with the arguments of the format command:
+// <size> [cluster size] [--secure-delete], for example "600MB" "4KB".
+// The default cluster size is DefaultClusterSize. --secure-delete turns on secure deletion for the new filesystem.
+func ExecFormat(args []string, fs BlockDevice) error {
+	var flags uint32
+	sizes := make([]string, 0, 2)
+	for _, arg := range args {
+		switch {
+		case strings.ToLower(arg) == "--secure-delete":
+			flags |= SuperblockFlagSecureDelete
+		case strings.HasPrefix(arg, "--"):
+			return msgError(MsgUnknownOption, arg)
+		default:
+			sizes = append(sizes, arg)
+		}
 	}
-	_, _, _, err = Format(int(size), fsname)
-	if err != nil {
-		return nil, err
+	if len(sizes) != 1 && len(sizes) != 2 {
+		return msgError(MsgFormatSizeMissing)
 	}
-	fs, err := os.OpenFile(fsname, os.O_RDWR, 0666)
+	size, err := ParseFormatString(sizes[0])
 	if err != nil {
-		return nil, err
+		return err
+	}
+	clusterSize := uint64(DefaultClusterSize)
+	if len(sizes) == 2 {
+		clusterSize, err = ParseFormatString(sizes[1])
+		if err != nil {
+			return err
+		}
 	}
-	return fs, nil
+	if size > math.MaxInt64 {
+		return msgError(MsgSizeTooBig, sizes[0])
+	}
+	if clusterSize > MaxClusterSize {
+		return msgError(MsgSizeTooBig, sizes[1])
+	}
+	_, _, _, err = Format(int64(size), int32(clusterSize), flags, fs)
+	return err
 }
 
 // ExecCommand executes the specified command based on the input array. The arr parameter is an array of strings representing the command and its arguments.
 //
 // It returns an error if the command is unknown or if there is no filesystem loaded.
 //
-// The supported commands are: format, incp, cat, ls, mkdir, cd, rmdir, rm, pwd, info, cp, mv, outcp, load, xcp, and short.
+// The supported commands are: format, incp, cat, ls, mkdir, cd, rmdir, rm, pwd, info, cp, mv, outcp, load, xcp, short,
+// setxattr, getxattr, listxattr, rmxattr, trash, undelete, shred, wipefree, touch, write, append, edit, head, tail,
+// wc, grep, hexdump, xxd, cmp, diff, sha256sum, md5sum, crc32, manifest, verify, dumpfs, bitmap, istat,
+// dblock, export-map, trace, stats, tarin, tarout and sync.
+// The output of any command can be redirected into a file of the filesystem with "> file" (the file is replaced)
+// or ">> file" (the output is appended) at the end of the command.
 // Example usage: interpreter.ExecCommand([]string{"ls"})
-func (i *Interpreter) ExecCommand(arr []string) error {
+func (i *Interpreter) ExecCommand(arr []string) (err error) {
 	if i.fs == nil {
-		return fmt.Errorf("no filesystem loaded")
+		return msgError(MsgNoFilesystem)
+	}
+	arr, target, appendOutput, err := splitRedirect(arr)
+	if err != nil {
+		return err
+	}
+	//the command runs on the device which counts its accesses for the trace
+	fs := i.fs
+	traced, summary := traceCommand(fs, strings.ToLower(arr[0]), i.superBlock)
+	i.fs = traced
+	defer func() {
+		i.fs = fs
+		summary()
+	}()
+	start := time.Now()
+	defer func() {
+		countCommand(strings.ToLower(arr[0]), time.Since(start), err != nil)
+	}()
+	if target == "" {
+		return i.execCommand(arr)
+	}
+
+	output, err := i.openOutput(target, appendOutput)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	buffered := bufio.NewWriter(output)
+	stdout := i.out
+	i.out = buffered
+	err = i.execCommand(arr)
+	i.out = stdout
+	if flushErr := buffered.Flush(); flushErr != nil && err == nil {
+		err = msgError(MsgErrWriteData, flushErr)
+	}
+	return err
+}
+
+// splitRedirect removes the redirection ("> file", ">> file", ">file" or ">>file") from the end of the command.
+// It returns the command, the file (empty if there is no redirection) and whether the output is appended.
+func splitRedirect(arr []string) ([]string, string, bool, error) {
+	for n, arg := range arr {
+		if !strings.HasPrefix(arg, ">") {
+			continue
+		}
+		appendOutput := strings.HasPrefix(arg, ">>")
+		target := strings.TrimLeft(arg, ">")
+		arrows := len(arg) - len(target)
+		rest := arr[n+1:]
+		if target == "" && len(rest) == 1 {
+			target, rest = rest[0], nil
+		}
+		if n == 0 || target == "" || len(rest) != 0 || arrows > 2 {
+			return nil, "", false, msgError(MsgArgsRedirect)
+		}
+		return arr[:n], target, appendOutput, nil
+	}
+	return arr, "", false, nil
+}
+
+// openOutput opens the file at the given path for writing, it is created if it does not exist.
+// The file is emptied unless appendOutput is set.
+func (i *Interpreter) openOutput(filePath string, appendOutput bool) (*File, error) {
+	flag := OpenTruncate
+	if appendOutput {
+		flag = OpenAppend
+	}
+	inodeId, err := i.createFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	file, err := OpenFile(i.fs, inodeId, flag, i.superBlock)
+	if err != nil {
+		return nil, msgError(MsgErrWriteData, err)
+	}
+	return file, nil
+}
+
+// createFile returns the inode id of the regular file at the given path, an empty file is created if there is none.
+func (i *Interpreter) createFile(filePath string) (int32, error) {
+	destInode, _, err := PathToInode(i.fs, filePath, i.superBlock, i.currentDirInode)
+	if err == nil {
+		if destInode.IsDirectory {
+			return 0, msgError(MsgExist)
+		}
+		return destInode.NodeId, nil
+	}
+	parentInode, _, err := PathToInode(i.fs, getPathDir(filePath), i.superBlock, i.currentDirInode)
+	if err != nil || !parentInode.IsDirectory {
+		return 0, msgError(MsgDestPathNotFound)
+	}
+	if err := checkItemName(filepath.Base(filePath)); err != nil {
+		return 0, msgError(MsgErrAddDirItem, err)
+	}
+	_, inodeId, err := WriteAndSaveData(nil, i.fs, i.superBlock, false)
+	if err != nil {
+		return 0, msgError(MsgErrWriteData, err)
+	}
+	err = AddDirItem(parentInode.NodeId, int32(inodeId), filepath.Base(filePath), i.fs, i.superBlock)
+	if err != nil {
+		return 0, msgError(MsgErrAddDirItem, err)
+	}
+	return int32(inodeId), nil
+}
+
+// mkdirAll returns the inode id of the directory at the given path, the missing directories on the path are created.
+func (i *Interpreter) mkdirAll(dirPath string) (int32, error) {
+	destInode, _, err := PathToInode(i.fs, dirPath, i.superBlock, i.currentDirInode)
+	if err == nil {
+		if !destInode.IsDirectory {
+			return 0, msgError(MsgExist)
+		}
+		return destInode.NodeId, nil
+	}
+	if getPathDir(dirPath) == filepath.Clean(dirPath) {
+		return 0, msgError(MsgDestPathNotFound)
+	}
+	if err := checkItemName(filepath.Base(dirPath)); err != nil {
+		return 0, msgError(MsgErrCreateDir, err)
+	}
+	parentId, err := i.mkdirAll(getPathDir(dirPath))
+	if err != nil {
+		return 0, err
+	}
+	_, newDirNodeId, err := CreateDirectory(i.fs, i.superBlock, parentId)
+	if err != nil {
+		return 0, msgError(MsgErrCreateDir, err)
+	}
+	err = AddDirItem(parentId, int32(newDirNodeId), filepath.Base(dirPath), i.fs, i.superBlock)
+	if err != nil {
+		return 0, msgError(MsgErrAddDirItem, err)
+	}
+	return int32(newDirNodeId), nil
+}
+
+// hostCommands are the commands which read or write files of the host. A shared session refuses them,
+// its client could otherwise use the files of the server with the rights of the server.
+var hostCommands = map[string]bool{
+	"incp": true, "outcp": true, "load": true, "tarin": true, "tarout": true, "export-map": true,
+}
+
+// execCommand is ExecCommand without the redirection of the output.
+func (i *Interpreter) execCommand(arr []string) error {
+	if command := strings.ToLower(arr[0]); i.shared && hostCommands[command] {
+		return msgError(MsgHostShared, command)
+	}
+	//an image of another filesystem or version can only be formatted again
+	if command := strings.ToLower(arr[0]); command != "format" {
+		if err := CheckSuperBlock(i.superBlock); err != nil {
+			return err
+		}
 	}
 	switch command := strings.ToLower(arr[0]); command {
 	case "format":
-		var err error
-		i.fs, err = ExecFormat(arr[1], i.fs.Name())
-		//fmt.Println(i.fs.Name())
+		if i.shared {
+			return msgError(MsgFormatShared)
+		}
+		if len(arr) < 2 || len(arr) > 4 {
+			return msgError(MsgCannotCreateFile)
+		}
+		err := ExecFormat(arr[1:], i.fs)
 		if err != nil {
-			//return err
-			return fmt.Errorf("CANNOT CREATE FILE")
+			return msgError(MsgCannotFormat, err)
 		} else {
-			fmt.Println("OK")
+			i.currentPath = string(os.PathSeparator)
+			i.currentDirInode = PseudoInode{}
+			fmt.Fprintln(i.out, Msg(MsgOK))
 		}
 
 	case "incp":
@@ -110,7 +320,7 @@ func (i *Interpreter) ExecCommand(arr []string) error {
 		if err != nil {
 			return err
 		} else {
-			fmt.Println("OK")
+			fmt.Fprintln(i.out, Msg(MsgOK))
 		}
 	case "cat":
 		err := i.Cat(arr)
@@ -127,28 +337,28 @@ func (i *Interpreter) ExecCommand(arr []string) error {
 		if err != nil {
 			return err
 		} else {
-			fmt.Println("OK")
+			fmt.Fprintln(i.out, Msg(MsgOK))
 		}
 	case "cd":
 		err := i.Cd(arr)
 		if err != nil {
 			return err
 		} else {
-			fmt.Println("OK")
+			fmt.Fprintln(i.out, Msg(MsgOK))
 		}
 	case "rmdir":
 		err := i.Rmdir(arr)
 		if err != nil {
 			return err
 		} else {
-			fmt.Println("OK")
+			fmt.Fprintln(i.out, Msg(MsgOK))
 		}
 	case "rm":
 		err := i.Rm(arr)
 		if err != nil {
 			return err
 		} else {
-			fmt.Println("OK")
+			fmt.Fprintln(i.out, Msg(MsgOK))
 		}
 	case "pwd":
 		err := i.Pwd()
@@ -165,138 +375,293 @@ func (i *Interpreter) ExecCommand(arr []string) error {
 		if err != nil {
 			return err
 		} else {
-			fmt.Println("OK")
+			fmt.Fprintln(i.out, Msg(MsgOK))
 		}
 	case "mv":
 		err := i.Mv(arr)
 		if err != nil {
 			return err
 		} else {
-			fmt.Println("OK")
+			fmt.Fprintln(i.out, Msg(MsgOK))
 		}
 	case "outcp":
 		err := i.Outcp(arr)
 		if err != nil {
 			return err
 		} else {
-			fmt.Println("OK")
+			fmt.Fprintln(i.out, Msg(MsgOK))
 		}
 	case "load":
 		err := i.Load(arr)
 		if err != nil {
 			return err
 		} else {
-			fmt.Println("OK")
+			fmt.Fprintln(i.out, Msg(MsgOK))
 		}
 	case "xcp":
 		err := i.Xcp(arr)
 		if err != nil {
 			return err
 		} else {
-			fmt.Println("OK")
+			fmt.Fprintln(i.out, Msg(MsgOK))
 		}
 	case "short":
 		err := i.Short(arr)
 		if err != nil {
 			return err
 		} else {
-			fmt.Println("OK")
+			fmt.Fprintln(i.out, Msg(MsgOK))
+		}
+	case "setxattr":
+		err := i.Setxattr(arr)
+		if err != nil {
+			return err
+		} else {
+			fmt.Fprintln(i.out, Msg(MsgOK))
+		}
+	case "getxattr":
+		err := i.Getxattr(arr)
+		if err != nil {
+			return err
+		}
+	case "listxattr":
+		err := i.Listxattr(arr)
+		if err != nil {
+			return err
+		}
+	case "rmxattr":
+		err := i.Rmxattr(arr)
+		if err != nil {
+			return err
+		} else {
+			fmt.Fprintln(i.out, Msg(MsgOK))
+		}
+	case "stats":
+		return i.Stats(arr)
+	case "tarin":
+		return i.Tarin(arr)
+	case "tarout":
+		return i.Tarout(arr)
+	case "trace":
+		err := i.Trace(arr)
+		if err != nil {
+			return err
+		} else {
+			fmt.Fprintln(i.out, Msg(MsgOK))
+		}
+	case "trash":
+		err := i.Trash(arr)
+		if err != nil {
+			return err
+		}
+	case "undelete":
+		err := i.Undelete(arr)
+		if err != nil {
+			return err
+		} else {
+			fmt.Fprintln(i.out, Msg(MsgOK))
+		}
+	case "shred":
+		err := i.Shred(arr)
+		if err != nil {
+			return err
+		} else {
+			fmt.Fprintln(i.out, Msg(MsgOK))
+		}
+	case "wipefree":
+		err := i.Wipefree(arr)
+		if err != nil {
+			return err
+		}
+	case "touch":
+		err := i.Touch(arr)
+		if err != nil {
+			return err
+		} else {
+			fmt.Fprintln(i.out, Msg(MsgOK))
+		}
+	case "write":
+		err := i.Write(arr)
+		if err != nil {
+			return err
+		} else {
+			fmt.Fprintln(i.out, Msg(MsgOK))
+		}
+	case "append":
+		err := i.Append(arr)
+		if err != nil {
+			return err
+		} else {
+			fmt.Fprintln(i.out, Msg(MsgOK))
+		}
+	case "edit":
+		err := i.Edit(arr)
+		if err != nil {
+			return err
+		}
+	case "head":
+		return i.Head(arr)
+	case "tail":
+		return i.Tail(arr)
+	case "wc":
+		return i.Wc(arr)
+	case "grep":
+		return i.Grep(arr)
+	case "hexdump":
+		return i.Hexdump(arr)
+	case "xxd":
+		return i.Xxd(arr)
+	case "cmp":
+		return i.Cmp(arr)
+	case "diff":
+		return i.Diff(arr)
+	case "sha256sum", "md5sum", "crc32":
+		return i.Checksum(arr)
+	case "manifest":
+		return i.Manifest(arr)
+	case "verify":
+		return i.Verify(arr)
+	case "dumpfs":
+		return i.Dumpfs()
+	case "bitmap":
+		return i.Bitmap(arr)
+	case "istat":
+		return i.Istat(arr)
+	case "dblock":
+		return i.Dblock(arr)
+	case "export-map":
+		err := i.ExportMap(arr)
+		if err != nil {
+			return err
+		} else {
+			fmt.Fprintln(i.out, Msg(MsgOK))
+		}
+	case "sync":
+		err := i.Sync()
+		if err != nil {
+			return err
+		} else {
+			fmt.Fprintln(i.out, Msg(MsgOK))
 		}
 	default:
-		return fmt.Errorf("unknown command")
+		return msgError(MsgUnknownCommand)
 	}
 	return nil
 }
 
 func (i *Interpreter) Incp(arr []string) error {
+	if len(arr) > 1 && isCopyOption(arr[1]) {
+		return i.incpRecursive(arr)
+	}
 	if len(arr) != 3 {
-		return fmt.Errorf("Wrong amount of arguments. The arguments should be the name of the path to the file and the name of the file in the filesystem.")
+		return msgError(MsgArgsIncp)
 	}
 
-	data, err := os.ReadFile(arr[1])
+	src, err := os.Open(arr[1])
 	if err != nil {
-		//return fmt.Errorf(err.Error())
-		return fmt.Errorf("FILE NOT FOUND (není zdroj)")
+		return msgError(MsgSourceNotFound)
 	}
-
-	_, fileInodeId, err := WriteAndSaveData(data, i.fs, i.superBlock, i.inodeBitmap, i.dataBitmap, false)
-	if err != nil {
-		return fmt.Errorf("could not write data to the filesystem: " + err.Error())
+	defer src.Close()
+	if info, err := src.Stat(); err != nil || info.IsDir() {
+		return msgError(MsgSourceNotFound)
 	}
 
 	destInode, _, err := PathToInode(i.fs, getPathDir(arr[2]), i.superBlock, i.currentDirInode)
 	if err != nil {
-		//return fmt.Errorf("could not find destination: " + err.Error())
-		return fmt.Errorf("PATH NOT FOUND (neexistuje cílová cesta)")
+		return msgError(MsgDestPathNotFound)
 	}
 
+	_, fileInodeId, err := WriteAndSaveData(nil, i.fs, i.superBlock, false)
+	if err != nil {
+		return msgError(MsgErrWriteData, err)
+	}
 	err = AddDirItem(destInode.NodeId, int32(fileInodeId), filepath.Base(arr[2]), i.fs, i.superBlock)
 	if err != nil {
-		return fmt.Errorf("could not add directory item: " + err.Error())
+		return msgError(MsgErrAddDirItem, err)
+	}
+
+	//the holes of the source and its clusters of zeros are not allocated
+	file, err := OpenFile(i.fs, int32(fileInodeId), 0, i.superBlock)
+	if err == nil {
+		_, err = copyIntoFile(file, src, int64(i.superBlock.ClusterSize))
+		file.Close()
+	}
+	if err != nil {
+		RemoveDirItem(destInode.NodeId, storedName(filepath.Base(arr[2])), i.fs, i.superBlock, true)
+		return msgError(MsgErrWriteData, err)
 	}
 	return nil
 }
 
 func (i *Interpreter) Cat(arr []string) error {
 	if len(arr) != 2 {
-		return fmt.Errorf("Wrong amount of arguments. The argument should be the name of the file in the filesystem.")
+		return msgError(MsgArgsFile)
 	}
 
 	destInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
 	if err != nil {
-		//return fmt.Errorf("could not find destination: " + err.Error())
-		return fmt.Errorf("FILE NOT FOUND (není zdroj)")
+		return msgError(MsgSourceNotFound)
 	}
 
 	if destInode.IsDirectory {
-		return fmt.Errorf("cannot cat a directory")
+		return msgError(MsgCannotCatDir)
 	}
 
-	data, err := ReadFileData(i.fs, destInode, i.superBlock)
+	//the content is copied as it is, without a newline at the end if the file does not have one
+	file, err := OpenFile(i.fs, destInode.NodeId, 0, i.superBlock)
 	if err != nil {
-		return fmt.Errorf("could not read data: " + err.Error())
+		return msgError(MsgErrReadData, err)
+	}
+	defer file.Close()
+	_, err = io.Copy(i.out, file)
+	if err != nil {
+		return msgError(MsgErrReadData, err)
 	}
-
-	fmt.Println(string(data))
 	return nil
 }
 
 func (i *Interpreter) Ls(arr []string) error {
 	if len(arr) > 2 {
-		return fmt.Errorf("Wrong amount of arguments.")
+		return msgError(MsgArgsLs)
 	}
 
-	destDir := i.currentDir
+	//the directory is read now, not taken from the session, so a file created for the output (ls > f) is listed
+	destInode, err := LoadInode(i.fs, i.currentDirInode.NodeId, i.superBlock.InodeStartAddress)
+	if err != nil {
+		return msgError(MsgErrLoadInode, err)
+	}
 	if len(arr) == 2 {
-		destInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
+		destInode, _, err = PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
 		if err != nil {
-			//return fmt.Errorf("could not find destination: " + err.Error())
-			return fmt.Errorf("PATH NOT FOUND (neexistující adresář)")
+			return msgError(MsgListPathNotFound)
 		}
 		if !destInode.IsDirectory {
-			return fmt.Errorf("not a directory")
-		}
-		destDir, err = LoadDirectory(i.fs, destInode, i.superBlock)
-		if err != nil {
-			return fmt.Errorf("could not load directory: " + err.Error())
+			return msgError(MsgNotADirectory)
 		}
 	}
+	destDir, err := LoadDirectory(i.fs, destInode, i.superBlock)
+	if err != nil {
+		return msgError(MsgErrLoadDir, err)
+	}
+	destDirId := destInode.NodeId
 
-	//fmt.Printf("%-20s %-20s %-20s %-20s\n", "Name", "Inode", "Size", "References")
 	for _, v := range destDir {
 		if v.Inode == 0 {
 			continue
 		}
+		//the trash is hidden
+		if destDirId == 1 && removeNullCharsFromString(string(v.ItemName[:])) == TrashDirName {
+			continue
+		}
 		dirItemInode, err := LoadInode(i.fs, v.Inode, int64(i.superBlock.InodeStartAddress))
 		if err != nil {
-			return fmt.Errorf("could not load inode: " + err.Error())
+			return msgError(MsgErrLoadInode, err)
 		}
 		if !dirItemInode.IsDirectory {
-			fmt.Printf("-%s\n", v.ItemName)
+			fmt.Fprintf(i.out, "-%s\n", v.ItemName)
 		} else {
-			fmt.Printf("+%s\n", v.ItemName)
+			fmt.Fprintf(i.out, "+%s\n", v.ItemName)
 		}
-		//fmt.Printf("%-20s %-20d %-20d %-20d\n", v.ItemName, v.Inode, dirItemInode.FileSize, dirItemInode.References)
 	}
 
 	return nil
@@ -304,24 +669,22 @@ func (i *Interpreter) Ls(arr []string) error {
 
 func (i *Interpreter) Mkdir(arr []string) error {
 	if len(arr) != 2 {
-		return fmt.Errorf("Wrong amount of arguments. The argument should be the name of the directory.")
+		return msgError(MsgArgsDir)
 	}
 
 	destInode, _, err := PathToInode(i.fs, getPathDir(arr[1]), i.superBlock, i.currentDirInode)
 	if err != nil {
-		//return fmt.Errorf("could not find destination: " + err.Error())
-		return fmt.Errorf("PATH NOT FOUND (neexistuje zadaná cesta)")
+		return msgError(MsgGivenPathNotFound)
 	}
 
-	_, newDirNodeId, err := CreateDirectory(i.fs, i.superBlock, i.inodeBitmap, i.dataBitmap, destInode.NodeId)
+	_, newDirNodeId, err := CreateDirectory(i.fs, i.superBlock, destInode.NodeId)
 	if err != nil {
-		return fmt.Errorf("could not create directory: " + err.Error())
+		return msgError(MsgErrCreateDir, err)
 	}
 
 	err = AddDirItem(destInode.NodeId, int32(newDirNodeId), filepath.Base(arr[1]), i.fs, i.superBlock)
 	if err != nil {
-		//return fmt.Errorf("could not add directory item: " + err.Error())
-		return fmt.Errorf("EXIST (nelze založit, již existuje)")
+		return msgError(MsgExist)
 	}
 
 	return nil
@@ -329,21 +692,20 @@ func (i *Interpreter) Mkdir(arr []string) error {
 
 func (i *Interpreter) Cd(arr []string) error {
 	if len(arr) != 2 {
-		return fmt.Errorf("Wrong amount of arguments. The argument should be the name of the directory.")
+		return msgError(MsgArgsDir)
 	}
 
 	destInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
 	if err != nil {
-		//return fmt.Errorf("could not find destination: " + err.Error())
-		return fmt.Errorf("PATH NOT FOUND (neexistující cesta)")
+		return msgError(MsgPathNotFound)
 	}
 
 	isDir, err := IsInodeDirectory(i.fs, destInode.NodeId, int64(i.superBlock.InodeStartAddress))
 	if err != nil {
-		return fmt.Errorf("could not load inode: " + err.Error())
+		return msgError(MsgErrLoadInode, err)
 	}
 	if !isDir {
-		return fmt.Errorf("not a directory")
+		return msgError(MsgNotADirectory)
 	}
 
 	//update current directory path string
@@ -363,36 +725,26 @@ func (i *Interpreter) Cd(arr []string) error {
 
 func (i *Interpreter) Rmdir(arr []string) error {
 	if len(arr) != 2 {
-		return fmt.Errorf("Wrong amount of arguments. The argument should be the name of the file or directory.")
+		return msgError(MsgArgsFileOrDir)
 	}
 
 	destInode, parentInode, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
 	if err != nil {
-		//return fmt.Errorf("could not find destination: " + err.Error())
-		return fmt.Errorf("FILE NOT FOUND (neexistující adresář)")
+		return msgError(MsgDirNotFound)
 	}
 
-	if destInode.IsDirectory {
-		inodeDir, err := LoadDirectory(i.fs, destInode, i.superBlock)
-		if err != nil {
-			return fmt.Errorf("could not load directory: " + err.Error())
-		}
-		inodeDirLen := 0
-		for _, v := range inodeDir {
-			if v.Inode != 0 {
-				inodeDirLen++
-			}
-		}
-		if inodeDirLen > 2 {
-			//return fmt.Errorf("directory not empty")
-			return fmt.Errorf("NOT EMPTY (adresář obsahuje podadresáře, nebo soubory)")
-		}
-	} else {
-		return fmt.Errorf("not a directory")
+	if !destInode.IsDirectory {
+		return msgError(MsgNotADirectory)
+	}
+	err = RemoveDirectory(parentInode.NodeId, filepath.Base(arr[1]), i.fs, i.superBlock)
+	if err == ErrDirectoryNotEmpty {
+		return msgError(MsgNotEmpty)
+	}
+	if err == ErrNotDirectory {
+		return msgError(MsgNotADirectory)
 	}
-	err = RemoveDirItem(parentInode.NodeId, filepath.Base(arr[1]), i.fs, i.superBlock, true)
 	if err != nil {
-		return fmt.Errorf("could not remove directory: " + err.Error())
+		return msgError(MsgErrRemoveDir, err)
 	}
 
 	return nil
@@ -400,126 +752,178 @@ func (i *Interpreter) Rmdir(arr []string) error {
 
 func (i *Interpreter) Rm(arr []string) error {
 	if len(arr) != 2 {
-		return fmt.Errorf("Wrong amount of arguments. The argument should be the name of the file or directory.")
+		return msgError(MsgArgsFileOrDir)
 	}
 
 	destInode, parentInode, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
 	if err != nil {
-		//return fmt.Errorf("could not find destination: " + err.Error())
-		return fmt.Errorf("FILE NOT FOUND")
+		return msgError(MsgFileNotFound)
 	}
 
 	if destInode.IsDirectory {
-		return fmt.Errorf("cannot remove a directory with rm")
+		return msgError(MsgCannotRmDir)
 	}
-	err = RemoveDirItem(parentInode.NodeId, filepath.Base(arr[1]), i.fs, i.superBlock, true)
+	err = RemoveOrTrash(i.fs, parentInode.NodeId, filepath.Base(arr[1]), i.absPath(arr[1]), i.superBlock)
 	if err != nil {
-		return fmt.Errorf("could not remove file: " + err.Error())
+		return msgError(MsgErrRemoveFile, err)
 	}
 
 	return nil
 }
 
+// absPath returns the absolute path of the given path in the filesystem, separated by slashes.
+func (i *Interpreter) absPath(p string) string {
+	p = filepath.ToSlash(p)
+	if !path.IsAbs(p) {
+		p = path.Join(filepath.ToSlash(i.currentPath), p)
+	}
+	return path.Clean(p)
+}
+
 func (i *Interpreter) Pwd() error {
 	//prints the current directory path
-	fmt.Println(strings.ReplaceAll(i.currentPath, string(os.PathSeparator), "/"))
+	fmt.Fprintln(i.out, strings.ReplaceAll(i.currentPath, string(os.PathSeparator), "/"))
 	return nil
 }
 
 func (i *Interpreter) Info(arr []string) error {
 	if len(arr) != 2 {
-		return fmt.Errorf("Wrong amount of arguments. The argument should be the name of the file or directory.")
+		return msgError(MsgArgsFileOrDir)
 	}
 	destInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
 	if err != nil {
-		//return fmt.Errorf("could not find destination: " + err.Error())
-		return fmt.Errorf("FILE NOT FOUND (není zdroj)")
+		return msgError(MsgSourceNotFound)
+	}
+	//strict output keeps the format of the assignment: name - size - i-node - links
+	strict := activeLanguage == LangStrict
+	fmt.Fprintf(i.out, "%s - %d - %d - ", arr[1], destInode.FileSize, destInode.NodeId)
+	if isInline(destInode) {
+		//the pointers hold the data of the file, it has no clusters
+		if strict {
+			fmt.Fprintln(i.out, strings.Repeat("0 ", len(destInode.Direct)+len(destInode.Indirect)))
+			return nil
+		}
+		fmt.Fprintln(i.out, Msg(MsgInfoInline))
+		fmt.Fprintln(i.out, Msg(MsgInfoSizes, destInode.FileSize, 0))
+		return nil
 	}
-	fmt.Printf("%s - %d - %d - ", arr[1], destInode.FileSize, destInode.NodeId)
 	for _, v := range destInode.Direct {
-		fmt.Printf("%d ", v)
+		fmt.Fprintf(i.out, "%d ", v)
 	}
 	for _, v := range destInode.Indirect {
-		fmt.Printf("%d ", v)
+		fmt.Fprintf(i.out, "%d ", v)
 	}
-	fmt.Println()
-	/*
-		clusterAddrs, indirectPtrAddrs, err := GetFileClusters(i.fs, destInode, i.superBlock)
-		if err != nil {
-			return fmt.Errorf("could not get file clusters: " + err.Error())
-		}
-		fmt.Printf("inode: %d\n", destInode.NodeId)
-		fmt.Printf("size: %d\n", destInode.FileSize)
-		fmt.Printf("references: %d\n", destInode.References)
-		fmt.Printf("cluster addresses: %v\n", clusterAddrs)
-		fmt.Printf("extra clusters for indirect pointers: %v\n", indirectPtrAddrs)
-		fmt.Printf("is directory: %v\n", destInode.IsDirectory)*/
+	fmt.Fprintln(i.out)
+	if strict {
+		return nil
+	}
+	//holes of a sparse file have no clusters, so the allocated size can be smaller than the size
+	dataClusters, pointerClusters, err := GetFileClusters(i.fs, destInode, i.superBlock)
+	if err != nil {
+		return msgError(MsgErrReadData, err)
+	}
+	allocated := int64(len(dataClusters)+len(pointerClusters)) * int64(i.superBlock.ClusterSize)
+	fmt.Fprintln(i.out, Msg(MsgInfoSizes, destInode.FileSize, allocated))
 	return nil
 }
 
 func (i *Interpreter) Cp(arr []string) error {
 	if len(arr) != 3 {
-		return fmt.Errorf("Wrong amount of arguments. The arguments should be the name of the source and destination.")
+		return msgError(MsgArgsSrcDest)
 	}
 	srcInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
 	if err != nil {
-		//return fmt.Errorf("could not find source: " + err.Error())
-		return fmt.Errorf("FILE NOT FOUND (není zdroj)")
+		return msgError(MsgSourceNotFound)
 	}
 	destInode, _, err := PathToInode(i.fs, getPathDir(arr[2]), i.superBlock, i.currentDirInode)
 	if err != nil {
-		//return fmt.Errorf("could not find destination: " + err.Error())
-		return fmt.Errorf("PATH NOT FOUND (neexistuje cílová cesta)")
+		return msgError(MsgDestPathNotFound)
 	}
 	if srcInode.IsDirectory {
-		return fmt.Errorf("cannot copy a directory")
+		return msgError(MsgCannotCopyDir)
 	}
-	data, err := ReadFileData(i.fs, srcInode, i.superBlock)
+	copyInodeId, err := i.copyToNewFile(srcInode)
 	if err != nil {
-		return fmt.Errorf("could not read data: " + err.Error())
+		return msgError(MsgErrWriteData, err)
 	}
-
-	_, copyInodeId, err := WriteAndSaveData(data, i.fs, i.superBlock, i.inodeBitmap, i.dataBitmap, false)
+	err = CopyXattrs(i.fs, srcInode.NodeId, int32(copyInodeId), i.superBlock)
 	if err != nil {
-		return fmt.Errorf("could not write data to the filesystem: " + err.Error())
+		//the copy is in no directory yet
+		if copyInode, loadErr := LoadInode(i.fs, int32(copyInodeId), i.superBlock.InodeStartAddress); loadErr == nil {
+			DeleteFile(i.fs, copyInode, i.superBlock)
+		}
+		return msgError(MsgErrWriteXattr, err)
 	}
 
 	err = AddDirItem(destInode.NodeId, int32(copyInodeId), filepath.Base(arr[2]), i.fs, i.superBlock)
 	if err != nil {
-		return fmt.Errorf("could not add directory item: " + err.Error())
+		return msgError(MsgErrAddDirItem, err)
 	}
 
 	return nil
 }
 
+// copyToNewFile creates a new file in no directory with the data of the files one after another, their holes
+// stay holes. If the copy fails, the new file is freed again. It returns the inode id of the new file.
+func (i *Interpreter) copyToNewFile(sources ...PseudoInode) (int32, error) {
+	_, newInodeId, err := WriteAndSaveData(nil, i.fs, i.superBlock, false)
+	if err != nil {
+		return 0, err
+	}
+	inodeId := int32(newInodeId)
+	err = i.copyFilesInto(inodeId, sources)
+	if err != nil {
+		if inode, loadErr := LoadInode(i.fs, inodeId, i.superBlock.InodeStartAddress); loadErr == nil {
+			DeleteFile(i.fs, inode, i.superBlock)
+		}
+		return 0, err
+	}
+	return inodeId, nil
+}
+
+// copyFilesInto writes the data of the files one after another into the empty file with the given inode id.
+func (i *Interpreter) copyFilesInto(inodeId int32, sources []PseudoInode) error {
+	dst, err := OpenFile(i.fs, inodeId, 0, i.superBlock)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	var size int64
+	for _, source := range sources {
+		src, err := OpenFile(i.fs, source.NodeId, 0, i.superBlock)
+		if err != nil {
+			return err
+		}
+		n, err := copyBetweenFiles(dst, src, size, int64(i.superBlock.ClusterSize))
+		src.Close()
+		if err != nil {
+			return err
+		}
+		size += n
+	}
+	//holes at the end, writes only reach the last data
+	return dst.Truncate(size)
+}
+
 func (i *Interpreter) Mv(arr []string) error {
 	if len(arr) != 3 {
-		return fmt.Errorf("Wrong amount of arguments. The arguments should be the name of the source and destination.")
+		return msgError(MsgArgsSrcDest)
 	}
 	var filename string
+	//the whole move has to be done before anything else is moved
+	defer lockRename(i.fs)()
 	srcInode, srcParentNode, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
 	if err != nil {
-		//return fmt.Errorf("could not find source: " + err.Error())
-		return fmt.Errorf("FILE NOT FOUND (není zdroj)")
+		return msgError(MsgSourceNotFound)
 	}
-	/* destInode, _, err := PathToInode(i.fs, arr[2], i.superBlock, i.currentDirInode)
-	if err != nil {
-		destInode, _, err = PathToInode(i.fs, filepath.Dir(arr[2]), i.superBlock, i.currentDirInode)
-		if err != nil && destInode.IsDirectory {
-			return fmt.Errorf("could not find destination: " + err.Error())
-		}
-		//dest file does not exist so rename it
-		filename = filepath.Base(arr[2])
-	} */
 
 	destInode, _, err := PathToInode(i.fs, getPathDir(arr[2]), i.superBlock, i.currentDirInode)
 	if err != nil && destInode.IsDirectory {
-		//return fmt.Errorf("could not find destination: " + err.Error())
-		return fmt.Errorf("PATH NOT FOUND (neexistuje cílová cesta)")
+		return msgError(MsgDestPathNotFound)
 	}
 	destInodeDir, err := LoadDirectory(i.fs, destInode, i.superBlock)
 	if err != nil {
-		return fmt.Errorf("could not load directory: " + err.Error())
+		return msgError(MsgErrLoadDir, err)
 	}
 	var finalDestInodeId int32
 	if itemIndex := GetDirItemIndex(destInodeDir, filepath.Base(arr[2])); itemIndex != -1 {
@@ -529,15 +933,19 @@ func (i *Interpreter) Mv(arr []string) error {
 		destInode, _, err = PathToInode(i.fs, arr[2], i.superBlock, i.currentDirInode)
 		finalDestInodeId = destInode.NodeId
 		if err != nil {
-			//return fmt.Errorf("could not load inode: " + err.Error())
-			return fmt.Errorf("PATH NOT FOUND (neexistuje cílová cesta)")
+			return msgError(MsgDestPathNotFound)
 		}
 		if !destInode.IsDirectory {
-			fmt.Printf("%s is a file, overwriting\n", destInodeDir[itemIndex].ItemName)
-			err = RemoveDirItem(oldDestInodeId, string(removeNullCharsFromString(string(destInodeDir[itemIndex].ItemName[:]))), i.fs, i.superBlock, true)
+			//the file is moved onto itself (or another link of it)
+			if destInode.NodeId == srcInode.NodeId {
+				return nil
+			}
+			filename = removeNullCharsFromString(string(destInodeDir[itemIndex].ItemName[:]))
+			fmt.Fprintln(i.out, Msg(MsgOverwritingFile, filename))
+			err = removeOrTrash(i.fs, oldDestInodeId, filename, i.absPath(arr[2]), i.superBlock)
 			finalDestInodeId = oldDestInodeId //dest is a file so we want to overwrite it, add dir item takes parent node id where file resides
 			if err != nil {
-				return fmt.Errorf("could not remove directory item: " + err.Error())
+				return msgError(MsgErrRemoveDirItem, err)
 			}
 		}
 	} else {
@@ -546,42 +954,41 @@ func (i *Interpreter) Mv(arr []string) error {
 		filename = filepath.Base(arr[2])
 	}
 
-	//remove src
-	err = RemoveDirItem(srcParentNode.NodeId, filepath.Base(arr[1]), i.fs, i.superBlock, false)
+	//add src to dest or rename, src is removed after it so it never loses its last reference
+	err = AddDirItem(finalDestInodeId, srcInode.NodeId, filename, i.fs, i.superBlock)
 	if err != nil {
-		fmt.Println("could not remove directory item: " + err.Error())
+		return msgError(MsgErrAddDirItem, err)
 	}
-	//add src to dest or rename
-	err = AddDirItem(finalDestInodeId, srcInode.NodeId, filename, i.fs, i.superBlock)
+	err = RemoveDirItem(srcParentNode.NodeId, filepath.Base(arr[1]), i.fs, i.superBlock, false)
 	if err != nil {
-		fmt.Println("could not add directory item: " + err.Error())
-		err = AddDirItem(srcParentNode.NodeId, srcInode.NodeId, filepath.Base(arr[1]), i.fs, i.superBlock)
-		if err != nil {
-			return fmt.Errorf("could not add directory item: " + err.Error())
-		}
+		return msgError(MsgErrRemoveDirItem, err)
 	}
 
 	return nil
 }
 
 func (i *Interpreter) Outcp(arr []string) error {
+	if len(arr) > 1 && isCopyOption(arr[1]) {
+		return i.outcpRecursive(arr)
+	}
 	if len(arr) != 3 {
-		return fmt.Errorf("Wrong amount of arguments. The arguments should be the name of the source and destination.")
+		return msgError(MsgArgsSrcDest)
 	}
 	srcInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
 	if err != nil {
-		//return fmt.Errorf("could not find source: " + err.Error())
-		return fmt.Errorf("FILE NOT FOUND (není zdroj)")
+		return msgError(MsgSourceNotFound)
 	}
-	data, err := ReadFileData(i.fs, srcInode, i.superBlock)
-	if err != nil {
-		return fmt.Errorf("could not read data: " + err.Error())
+	if srcInode.IsDirectory {
+		return msgError(MsgCannotCopyDir)
+	}
+	//the file is copied to a specific absolute or relative path in OS, its holes stay holes
+	_, err = i.copyFileOut(srcInode.NodeId, arr[2])
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return msgError(MsgDestPathNotFound)
 	}
-	//write data slice to specific absolute or relative path in OS
-	err = os.WriteFile(arr[2], data, 0666)
 	if err != nil {
-		//return fmt.Errorf("could not write data to file: " + err.Error())
-		return fmt.Errorf("PATH NOT FOUND (neexistuje cílová cesta)")
+		return msgError(MsgErrReadData, err)
 	}
 
 	return nil
@@ -589,20 +996,29 @@ func (i *Interpreter) Outcp(arr []string) error {
 
 func (i *Interpreter) Load(arr []string) error {
 	if len(arr) != 2 {
-		return fmt.Errorf("Wrong amount of arguments. The argument should be the name of the filesystem.")
+		return msgError(MsgArgsLoad)
 	}
 	content, err := os.ReadFile(arr[1])
 	if err != nil {
-		//return fmt.Errorf("could not read file: %v", err)
-		return fmt.Errorf("FILE NOT FOUND (není zdroj)")
+		return msgError(MsgSourceNotFound)
 	}
 
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		i.LoadInterpreter()
+	//commands which read input (write) read the following lines of the script
+	script := bufio.NewReader(bytes.NewReader(content))
+	input := i.in
+	i.in = script
+	defer func() { i.in = input }()
+	for {
+		line, err := script.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err := i.LoadInterpreter(); err != nil {
+			return msgError(MsgErrExecCommand, err)
+		}
 		arg, err := parseCommand(line)
 		if err != nil {
-			return fmt.Errorf("error parsing command: %v", err)
+			return msgError(MsgErrParseCommand, err)
 		}
 		if arg[0] == "format" {
 			i.currentPath = string(os.PathSeparator)
@@ -610,7 +1026,7 @@ func (i *Interpreter) Load(arr []string) error {
 		}
 		err = i.ExecCommand(arg)
 		if err != nil {
-			return fmt.Errorf("error executing command: %v", err)
+			return msgError(MsgErrExecCommand, err)
 		}
 	}
 	return nil
@@ -619,45 +1035,42 @@ func (i *Interpreter) Load(arr []string) error {
 func (i *Interpreter) Xcp(arr []string) error {
 	//combines 2 files into 1 and creates a new file
 	if len(arr) != 4 {
-		return fmt.Errorf("Wrong amount of arguments. The arguments should be the name of the source and destination.")
+		return msgError(MsgArgsXcp)
 	}
 	srcInode1, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
 	if err != nil {
-		return fmt.Errorf("could not find source: " + err.Error())
+		return msgError(MsgErrFindSource, err)
 	}
 	srcInode2, _, err := PathToInode(i.fs, arr[2], i.superBlock, i.currentDirInode)
 	if err != nil {
-		return fmt.Errorf("could not find source: " + err.Error())
-	}
-	data1, err := ReadFileData(i.fs, srcInode1, i.superBlock)
-	if err != nil {
-		return fmt.Errorf("could not read data: " + err.Error())
+		return msgError(MsgErrFindSource, err)
 	}
-	data2, err := ReadFileData(i.fs, srcInode2, i.superBlock)
-	if err != nil {
-		return fmt.Errorf("could not read data: " + err.Error())
+	if srcInode1.IsDirectory || srcInode2.IsDirectory {
+		return msgError(MsgCannotCopyDir)
 	}
-	//combine data
-	data := append(data1, data2...)
 	//get location of new file
 	destInode, _, err := PathToInode(i.fs, getPathDir(arr[3]), i.superBlock, i.currentDirInode)
 	if err != nil {
-		return fmt.Errorf("could not find destination: " + err.Error())
+		return msgError(MsgErrFindDest, err)
 	}
-	//write data to new file
-	_, newFileInodeId, err := WriteAndSaveData(data, i.fs, i.superBlock, i.inodeBitmap, i.dataBitmap, false)
+	//the new file gets the data of both files
+	newFileInodeId, err := i.copyToNewFile(srcInode1, srcInode2)
 	if err != nil {
-		return fmt.Errorf("could not write data to the filesystem: " + err.Error())
-	}
-	//remove old files
-	err = RemoveDirItem(destInode.NodeId, filepath.Base(arr[3]), i.fs, i.superBlock, true)
-	if err == nil {
-		fmt.Println("overwriting file with same name...")
+		return msgError(MsgErrWriteData, err)
+	}
+	//remove old files, a directory of the same name stays and the new file cannot be added
+	if oldId, err := LookupDirItem(i.fs, destInode.NodeId, filepath.Base(arr[3]), i.superBlock); err == nil {
+		if old, err := LoadInode(i.fs, oldId, i.superBlock.InodeStartAddress); err == nil && !old.IsDirectory {
+			err = RemoveOrTrash(i.fs, destInode.NodeId, filepath.Base(arr[3]), i.absPath(arr[3]), i.superBlock)
+			if err == nil {
+				fmt.Fprintln(i.out, Msg(MsgOverwritingSame))
+			}
+		}
 	}
 	//add new file to directory
 	err = AddDirItem(destInode.NodeId, int32(newFileInodeId), filepath.Base(arr[3]), i.fs, i.superBlock)
 	if err != nil {
-		return fmt.Errorf("could not add directory item: " + err.Error())
+		return msgError(MsgErrAddDirItem, err)
 	}
 	return nil
 }
@@ -665,33 +1078,374 @@ func (i *Interpreter) Xcp(arr []string) error {
 func (i *Interpreter) Short(arr []string) error {
 	//if file is longer than 3000 bytes, it will be shortened to 3000 bytes
 	if len(arr) != 2 {
-		return fmt.Errorf("Wrong amount of arguments. The argument should be the name of the file.")
+		return msgError(MsgArgsShort)
+	}
+	destInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
+	if err != nil {
+		return msgError(MsgErrFindDest, err)
+	}
+	if destInode.IsDirectory {
+		return msgError(MsgCannotShortenDir)
+	}
+	if destInode.FileSize <= 3000 {
+		return nil
+	}
+	//the file keeps its inode, so hard links and attributes stay as they were
+	file, err := OpenFile(i.fs, destInode.NodeId, 0, i.superBlock)
+	if err != nil {
+		return msgError(MsgErrWriteData, err)
+	}
+	defer file.Close()
+	err = file.Truncate(3000)
+	if err != nil {
+		return msgError(MsgErrWriteData, err)
+	}
+	return nil
+}
+
+// Setxattr sets an extended attribute of a file or directory: setxattr <file> <name> <value>.
+// The value is the rest of the line, so it may contain spaces (they are collapsed into one).
+func (i *Interpreter) Setxattr(arr []string) error {
+	if len(arr) < 4 {
+		return msgError(MsgArgsSetxattr)
+	}
+	destInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
+	if err != nil {
+		return msgError(MsgFileNotFound)
+	}
+	err = SetXattr(i.fs, destInode.NodeId, arr[2], []byte(strings.Join(arr[3:], " ")), i.superBlock)
+	if err != nil {
+		return msgError(MsgErrWriteXattr, err)
+	}
+	return nil
+}
+
+// Getxattr prints the value of an extended attribute: getxattr <file> <name>.
+func (i *Interpreter) Getxattr(arr []string) error {
+	if len(arr) != 3 {
+		return msgError(MsgArgsXattr)
+	}
+	destInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
+	if err != nil {
+		return msgError(MsgFileNotFound)
+	}
+	value, err := GetXattr(i.fs, destInode.NodeId, arr[2], i.superBlock)
+	if err == ErrXattrNotFound {
+		return msgError(MsgXattrNotFound, arr[2])
+	}
+	if err != nil {
+		return msgError(MsgErrReadXattr, err)
+	}
+	fmt.Fprintln(i.out, string(value))
+	return nil
+}
+
+// Listxattr prints the names of the extended attributes of a file or directory, one per line.
+func (i *Interpreter) Listxattr(arr []string) error {
+	if len(arr) != 2 {
+		return msgError(MsgArgsFileOrDir)
+	}
+	destInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
+	if err != nil {
+		return msgError(MsgFileNotFound)
+	}
+	names, err := ListXattrs(i.fs, destInode.NodeId, i.superBlock)
+	if err != nil {
+		return msgError(MsgErrReadXattr, err)
+	}
+	for _, name := range names {
+		fmt.Fprintln(i.out, name)
+	}
+	return nil
+}
+
+// Rmxattr removes an extended attribute: rmxattr <file> <name>.
+func (i *Interpreter) Rmxattr(arr []string) error {
+	if len(arr) != 3 {
+		return msgError(MsgArgsXattr)
+	}
+	destInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
+	if err != nil {
+		return msgError(MsgFileNotFound)
+	}
+	err = RemoveXattr(i.fs, destInode.NodeId, arr[2], i.superBlock)
+	if err == ErrXattrNotFound {
+		return msgError(MsgXattrNotFound, arr[2])
+	}
+	if err != nil {
+		return msgError(MsgErrWriteXattr, err)
+	}
+	return nil
+}
+
+// Trash manages the trash: trash [list] prints the files in the trash, trash empty deletes them
+// and trash on|off turns moving removed files into the trash on or off.
+func (i *Interpreter) Trash(arr []string) error {
+	if len(arr) > 2 {
+		return msgError(MsgArgsTrash)
+	}
+	subcommand := "list"
+	if len(arr) == 2 {
+		subcommand = strings.ToLower(arr[1])
+	}
+	switch subcommand {
+	case "list":
+		items, err := ListTrash(i.fs, i.superBlock)
+		if err != nil {
+			return msgError(MsgErrTrash, err)
+		}
+		for _, item := range items {
+			fmt.Fprintf(i.out, "%s - %s - %d - %s\n", item.Name, item.Path, item.Size, item.Removed.Format("2006-01-02 15:04:05"))
+		}
+	case "empty":
+		count, err := EmptyTrash(i.fs, i.superBlock)
+		if err != nil {
+			return msgError(MsgErrTrash, err)
+		}
+		fmt.Fprintln(i.out, Msg(MsgTrashEmptied, count))
+	case "on", "off":
+		superBlock, err := SetTrashEnabled(i.fs, subcommand == "on")
+		if err != nil {
+			return msgError(MsgErrTrash, err)
+		}
+		i.superBlock = superBlock
+		fmt.Fprintln(i.out, Msg(MsgOK))
+	default:
+		return msgError(MsgArgsTrash)
+	}
+	return nil
+}
+
+// Undelete moves a file from the trash back to the path it was removed from: undelete <name>.
+// The name is the one printed by trash list.
+func (i *Interpreter) Undelete(arr []string) error {
+	if len(arr) != 2 {
+		return msgError(MsgArgsUndelete)
+	}
+	_, err := Undelete(i.fs, arr[1], i.superBlock)
+	if err == ErrNotInTrash {
+		return msgError(MsgFileNotFound)
+	}
+	if err == ErrExist {
+		return msgError(MsgExist)
+	}
+	if err != nil {
+		return msgError(MsgErrUndelete, err)
+	}
+	return nil
+}
+
+// Shred removes a file and overwrites its data with zeros before they are freed: shred <file>.
+// The file does not go into the trash.
+func (i *Interpreter) Shred(arr []string) error {
+	if len(arr) != 2 {
+		return msgError(MsgArgsFile)
 	}
 	destInode, parentInode, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
 	if err != nil {
-		return fmt.Errorf("could not find destination: " + err.Error())
+		return msgError(MsgFileNotFound)
 	}
 	if destInode.IsDirectory {
-		return fmt.Errorf("cannot shorten a directory")
+		return msgError(MsgCannotRmDir)
+	}
+	err = ShredDirItem(parentInode.NodeId, filepath.Base(arr[1]), i.fs, i.superBlock)
+	if err != nil {
+		return msgError(MsgErrRemoveFile, err)
+	}
+	return nil
+}
+
+// Wipefree overwrites all free clusters and inodes of the filesystem with zeros and prints how many were overwritten.
+func (i *Interpreter) Wipefree(arr []string) error {
+	if len(arr) != 1 {
+		return msgError(MsgArgsLs)
 	}
-	data, err := ReadFileData(i.fs, destInode, i.superBlock)
+	clusters, inodes, err := WipeFree(i.fs, i.superBlock)
 	if err != nil {
-		return fmt.Errorf("could not read data: " + err.Error())
+		return msgError(MsgErrWipe, err)
 	}
-	if len(data) > 3000 {
-		data = data[:3000]
+	fmt.Fprintln(i.out, Msg(MsgWiped, clusters, inodes))
+	return nil
+}
+
+// Touch creates an empty file or sets the access and modification time of an existing file to now: touch <file>.
+func (i *Interpreter) Touch(arr []string) error {
+	if len(arr) != 2 {
+		return msgError(MsgArgsFileOrDir)
 	}
-	_, newFileInodeId, err := WriteAndSaveData(data, i.fs, i.superBlock, i.inodeBitmap, i.dataBitmap, false)
+	destInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
 	if err != nil {
-		return fmt.Errorf("could not write data to the filesystem: " + err.Error())
+		_, err = i.createFile(arr[1])
+		return err
 	}
-	err = RemoveDirItem(i.currentDirInode.NodeId, filepath.Base(arr[1]), i.fs, i.superBlock, true)
+	err = Touch(i.fs, destInode.NodeId, time.Now(), i.superBlock)
 	if err != nil {
-		return fmt.Errorf("could not remove directory item: " + err.Error())
+		return msgError(MsgErrWriteData, err)
 	}
-	err = AddDirItem(parentInode.NodeId, int32(newFileInodeId), filepath.Base(arr[1]), i.fs, i.superBlock)
+	return nil
+}
+
+// Write replaces the content of a file with the lines read from the input until the terminator line:
+// write <file> [terminator]. The default terminator is a line with a single dot. The file is created if needed.
+func (i *Interpreter) Write(arr []string) error {
+	if len(arr) != 2 && len(arr) != 3 {
+		return msgError(MsgArgsWrite)
+	}
+	terminator := "."
+	if len(arr) == 3 {
+		terminator = arr[2]
+	}
+	file, err := i.openOutput(arr[1], false)
 	if err != nil {
-		return fmt.Errorf("could not add directory item: " + err.Error())
+		return err
+	}
+	defer file.Close()
+	buffered := bufio.NewWriter(file)
+	for {
+		line, err := i.in.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return msgError(MsgErrReadData, err)
+		}
+		if strings.TrimRight(line, "\r\n") == terminator || (err == io.EOF && line == "") {
+			break
+		}
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		buffered.WriteString(line)
+		if err == io.EOF {
+			break
+		}
+	}
+	err = buffered.Flush()
+	if err != nil {
+		return msgError(MsgErrWriteData, err)
 	}
 	return nil
 }
+
+// Append adds a line of text at the end of a file: append <file> <text>. The file is created if needed.
+// Like setxattr, the words of the text are joined by single spaces.
+func (i *Interpreter) Append(arr []string) error {
+	if len(arr) < 3 {
+		return msgError(MsgArgsAppend)
+	}
+	file, err := i.openOutput(arr[1], true)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write([]byte(strings.Join(arr[2:], " ") + "\n"))
+	if err != nil {
+		return msgError(MsgErrWriteData, err)
+	}
+	return nil
+}
+
+// Edit opens a file in the editor of the host: edit <file>.
+// The file is exported into a temporary file and $VISUAL or $EDITOR (vi if neither is set) is started on it.
+// The edited content replaces the content of the file only if it changed, the file keeps its inode.
+// If the file changed in the image while it was being edited, it is not overwritten and the edited version
+// is left in the temporary file.
+func (i *Interpreter) Edit(arr []string) error {
+	if len(arr) != 2 {
+		return msgError(MsgArgsFile)
+	}
+	if i.shared {
+		//the editor would run on the terminal of the server
+		return msgError(MsgEditShared)
+	}
+	destInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
+	if err != nil {
+		return msgError(MsgFileNotFound)
+	}
+	if destInode.IsDirectory {
+		return msgError(MsgCannotEditDir)
+	}
+	src, err := OpenFile(i.fs, destInode.NodeId, 0, i.superBlock)
+	if err != nil {
+		return msgError(MsgErrReadData, err)
+	}
+	defer src.Close()
+	//only the checksum of the content is kept to find out whether the editor changed it
+	h := sha256.New()
+	_, err = io.Copy(h, src)
+	if err != nil {
+		return msgError(MsgErrReadData, err)
+	}
+	original := h.Sum(nil)
+
+	tmp, err := os.CreateTemp("", "vfs-edit-*-"+filepath.Base(arr[1]))
+	if err != nil {
+		return msgError(MsgErrEditor, err)
+	}
+	tmpPath := tmp.Name()
+	_, err = copyOutOfFile(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return msgError(MsgErrEditor, err)
+	}
+
+	editor := strings.Fields(os.Getenv("VISUAL"))
+	if len(editor) == 0 {
+		editor = strings.Fields(os.Getenv("EDITOR"))
+	}
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+	cmd := exec.Command(editor[0], append(editor[1:], tmpPath)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		os.Remove(tmpPath)
+		return msgError(MsgErrEditor, err)
+	}
+	edited, err := os.ReadFile(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return msgError(MsgErrEditor, err)
+	}
+	if editedSum := sha256.Sum256(edited); bytes.Equal(editedSum[:], original) {
+		os.Remove(tmpPath)
+		fmt.Fprintln(i.out, Msg(MsgNotChanged))
+		return nil
+	}
+
+	//other processes (--force) may have written into the image while the editor was running
+	err = InvalidateDevice(i.fs)
+	if err != nil {
+		return msgError(MsgErrEditSave, err, tmpPath)
+	}
+	i.superBlock = LoadSuperBlock(i.fs)
+	err = WriteFileDataIfUnchanged(i.fs, destInode.NodeId, edited, destInode.ModifyTime, i.superBlock)
+	if err == ErrFileChanged {
+		return msgError(MsgEditConflict, arr[1], tmpPath)
+	}
+	if err != nil {
+		return msgError(MsgErrEditSave, err, tmpPath)
+	}
+	os.Remove(tmpPath)
+	fmt.Fprintln(i.out, Msg(MsgOK))
+	return nil
+}
+
+// Sync writes all changes kept in the cache back into the image file.
+func (i *Interpreter) Sync() error {
+	err := i.fs.Sync()
+	if err != nil {
+		return msgError(MsgErrSync, err)
+	}
+	return nil
+}
+
+// Close writes all cached changes into the image and closes it.
+func (i *Interpreter) Close() error {
+	StopTrace(i.fs)
+	i.stopTrace()
+	releaseLocks(i.fs)
+	dropDentries(i.fs)
+	return i.fs.Close()
+}
@@ -2,8 +2,10 @@ package util
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"math"
 	"strconv"
 	"strings"
 	"unicode"
@@ -20,20 +22,21 @@ func parseCommand(command string) ([]string, error) {
 	return args, nil
 }
 
-// LoadCommand reads a command from the given input file and returns a slice of strings representing the parsed command.
-// It takes an *os.File as input and returns the parsed command as a []string.
+// LoadCommand reads a command from the given input and returns a slice of strings representing the parsed command.
+// The input should be a *bufio.Reader kept between calls, otherwise data buffered after the first line is lost.
 // If an error occurs while reading the command, it returns nil and the error.
-func LoadCommand(input *os.File) ([]string, error) {
+func LoadCommand(input io.Reader) ([]string, error) {
 	reader := bufio.NewReader(input)
 	command, err := reader.ReadString('\n')
-	if err != nil {
+	if err != nil && (err != io.EOF || len(command) == 0) {
 		return nil, err
 	}
-	command = command[:len(command)-1] // remove the newline
+	command = strings.TrimRight(command, "\r\n") // remove the newline
 	return parseCommand(command)
 }
 
 // ParseFormatString parses a string in format for example: "2B" or "2KB" or "2GB" and returns the corresponding target size in bytes.
+// Sizes which do not fit into 64 bits are rejected.
 // The inputString parameter is the formatted string to be parsed.
 // The function returns the target size in bytes and an error if any occurred during parsing.
 func ParseFormatString(inputString string) (uint64, error) {
@@ -45,22 +48,29 @@ func ParseFormatString(inputString string) (uint64, error) {
 
 	index := strings.IndexFunc(inputString, unicode.IsLetter)
 	if index == -1 {
-		return 0, fmt.Errorf("unspecified suffix (K, M, G, T)")
+		return 0, msgError(MsgSizeSuffixMissing)
 	}
 
 	parsedValue, err = strconv.ParseUint(inputString[:index], 10, 64)
-	if err != nil {
-		return 0, err
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, msgError(MsgSizeTooBig, inputString)
+	} else if err != nil {
+		return 0, msgError(MsgSizeInvalid, inputString)
 	}
 
 	suffix := inputString[index:][0]
 	suffixMatch := strings.Index(sizeSuffixes, string(suffix))
 
-	if suffixMatch == -1 {
-		return 0, fmt.Errorf("invalid size suffix")
+	if suffix == 'B' {
+		shiftAmount = 0
+	} else if suffixMatch == -1 {
+		return 0, msgError(MsgSizeSuffixInvalid)
 	} else {
 		shiftAmount = uint64((suffixMatch + 1) * 10)
 	}
+	if parsedValue > math.MaxUint64>>shiftAmount {
+		return 0, msgError(MsgSizeTooBig, inputString)
+	}
 	targetSize := parsedValue * (1 << shiftAmount)
 
 	return targetSize, nil
@@ -0,0 +1,283 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Comparison of files: cmp and diff.
+// Each operand is a path in the filesystem or a path on the host with the host: prefix, for example
+// cmp host:photo.jpg photo.jpg checks that a file was copied in without a change.
+
+// hostPrefix marks a path on the host in the operands of cmp and diff.
+const hostPrefix = "host:"
+
+// diffContext is the number of unchanged lines printed around every change by diff.
+const diffContext = 3
+
+// openOperand opens a file of the filesystem or, with the host: prefix, a file of the host for reading.
+func (i *Interpreter) openOperand(name string) (io.ReadCloser, error) {
+	if hostPath, ok := strings.CutPrefix(name, hostPrefix); ok {
+		if i.shared {
+			return nil, msgError(MsgHostShared, hostPrefix)
+		}
+		file, err := os.Open(hostPath)
+		if err != nil {
+			return nil, msgError(MsgSourceNotFound)
+		}
+		info, err := file.Stat()
+		if err == nil && info.IsDir() {
+			file.Close()
+			return nil, msgError(MsgIsADirectory, name)
+		}
+		return file, nil
+	}
+	return i.openForReading(name)
+}
+
+// Cmp compares two files byte by byte and prints the first byte which differs: cmp <a> <b>.
+func (i *Interpreter) Cmp(arr []string) error {
+	if len(arr) != 3 {
+		return msgError(MsgArgsCompare)
+	}
+	a, err := i.openOperand(arr[1])
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	b, err := i.openOperand(arr[2])
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	readerA, readerB := bufio.NewReader(a), bufio.NewReader(b)
+	//byte and line are counted from 1 like in cmp of the host
+	position, line := int64(1), int64(1)
+	for {
+		byteA, errA := readerA.ReadByte()
+		byteB, errB := readerB.ReadByte()
+		if errA != nil && errA != io.EOF {
+			return msgError(MsgErrReadData, errA)
+		}
+		if errB != nil && errB != io.EOF {
+			return msgError(MsgErrReadData, errB)
+		}
+		switch {
+		case errA == io.EOF && errB == io.EOF:
+			fmt.Fprintln(i.out, Msg(MsgFilesIdentical))
+			return nil
+		case errA == io.EOF:
+			fmt.Fprintln(i.out, Msg(MsgCmpEOF, arr[1], position-1))
+			return nil
+		case errB == io.EOF:
+			fmt.Fprintln(i.out, Msg(MsgCmpEOF, arr[2], position-1))
+			return nil
+		case byteA != byteB:
+			fmt.Fprintln(i.out, Msg(MsgCmpDiffer, arr[1], arr[2], position, line))
+			return nil
+		}
+		if byteA == '\n' {
+			line++
+		}
+		position++
+	}
+}
+
+// readLines reads all lines of a file. The lines keep their newline, so a missing newline at the end is seen.
+func readLines(r io.Reader) ([]string, error) {
+	lines := make([]string, 0)
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Diff prints the differences of two files as a unified diff: diff <a> <b>.
+func (i *Interpreter) Diff(arr []string) error {
+	if len(arr) != 3 {
+		return msgError(MsgArgsCompare)
+	}
+	files := make([][]string, 2)
+	for n, name := range arr[1:] {
+		file, err := i.openOperand(name)
+		if err != nil {
+			return err
+		}
+		files[n], err = readLines(file)
+		file.Close()
+		if err != nil {
+			return msgError(MsgErrReadData, err)
+		}
+	}
+
+	edits := diffLines(files[0], files[1])
+	hunks := diffHunks(edits, diffContext)
+	if len(hunks) == 0 {
+		fmt.Fprintln(i.out, Msg(MsgFilesIdentical))
+		return nil
+	}
+	var sb bytes.Buffer
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", arr[1], arr[2])
+	for _, hunk := range hunks {
+		writeHunk(&sb, hunk)
+	}
+	_, err := i.out.Write(sb.Bytes())
+	return err
+}
+
+// Kinds of lines in a diff.
+const (
+	diffEqual  = ' '
+	diffDelete = '-'
+	diffInsert = '+'
+)
+
+// diffEdit is one line of a diff. lineA and lineB are the numbers of the line in the files counted from 0,
+// a deleted line only has lineA and an inserted line only lineB.
+type diffEdit struct {
+	kind  byte
+	text  string
+	lineA int
+	lineB int
+}
+
+// diffLines returns the shortest list of edits which turns the lines a into the lines b.
+// It uses the O(ND) algorithm of Myers, so files with few changes are compared quickly.
+func diffLines(a, b []string) []diffEdit {
+	n, m := len(a), len(b)
+	limit := n + m
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	//the diagonals -d..d of v after every step d are kept to walk the path back, trace[d][k+d] is v[k] of step d
+	trace := make([][]int, 0)
+	found := false
+	for d := 0; d <= limit && !found; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+
+	//the path is walked back from the end, so the edits are collected in reverse
+	edits := make([]diffEdit, 0, limit)
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		prevOffset := d - 1
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev[prevOffset+k-1] < prev[prevOffset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[prevOffset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, diffEdit{kind: diffEqual, text: a[x], lineA: x, lineB: y})
+		}
+		if x == prevX {
+			y--
+			edits = append(edits, diffEdit{kind: diffInsert, text: b[y], lineA: x, lineB: y})
+		} else {
+			x--
+			edits = append(edits, diffEdit{kind: diffDelete, text: a[x], lineA: x, lineB: y})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		edits = append(edits, diffEdit{kind: diffEqual, text: a[x], lineA: x, lineB: y})
+	}
+	for l, r := 0, len(edits)-1; l < r; l, r = l+1, r-1 {
+		edits[l], edits[r] = edits[r], edits[l]
+	}
+	return edits
+}
+
+// diffHunks groups the changed lines with context unchanged lines around them into hunks.
+// Changes closer than twice the context are put into one hunk.
+func diffHunks(edits []diffEdit, context int) [][]diffEdit {
+	hunks := make([][]diffEdit, 0)
+	start, end := -1, -1
+	for n, edit := range edits {
+		if edit.kind == diffEqual {
+			continue
+		}
+		if start != -1 && n-end > 2*context {
+			hunks = append(hunks, edits[start:end])
+			start = -1
+		}
+		if start == -1 {
+			start = max(n-context, 0)
+		}
+		end = min(n+context+1, len(edits))
+	}
+	if start != -1 {
+		hunks = append(hunks, edits[start:end])
+	}
+	return hunks
+}
+
+// writeHunk writes a hunk of a unified diff with its @@ header.
+func writeHunk(w io.Writer, hunk []diffEdit) {
+	var countA, countB int
+	for _, edit := range hunk {
+		if edit.kind != diffInsert {
+			countA++
+		}
+		if edit.kind != diffDelete {
+			countB++
+		}
+	}
+	fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(hunk[0].lineA, countA), hunkRange(hunk[0].lineB, countB))
+	for _, edit := range hunk {
+		fmt.Fprintf(w, "%c%s", edit.kind, edit.text)
+		if !strings.HasSuffix(edit.text, "\n") {
+			fmt.Fprint(w, "\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange formats the start and length of a hunk in one file. Lines are counted from 1,
+// an empty range refers to the line before it like in diff -u of the host.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -0,0 +1,348 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dumps of the structures stored in the image: dumpfs, bitmap, istat, dblock and export-map (see cluster_map.go).
+// They read the image directly and print the raw values, so they also show what is wrong with a damaged image.
+
+// bitmapBitsPerLine is the number of bits printed on one line by bitmap.
+const bitmapBitsPerLine = 64
+
+// Dumpfs prints all fields of the superblock and the boundaries of the regions of the image.
+// The superblock is read from the image again, not taken from the session.
+func (i *Interpreter) Dumpfs() error {
+	sb := LoadSuperBlock(i.fs)
+	inodeSize := int64(binary.Size(PseudoInode{}))
+	firstCluster := sb.DataStartAddress / int64(sb.ClusterSize)
+
+	fields := []struct {
+		name  string
+		value any
+	}{
+		{"Signature", removeNullCharsFromString(string(sb.Signature[:]))},
+		{"VolumeDescriptor", removeNullCharsFromString(string(sb.VolumeDescriptor[:]))},
+		{"Flags", fmt.Sprintf("%#x %s", sb.Flags, superblockFlagNames(sb.Flags))},
+		{"Version", sb.Version},
+		{"DiskSize", sb.DiskSize},
+		{"ClusterSize", sb.ClusterSize},
+		{"ClusterCount", sb.ClusterCount},
+		{"InodeCount", sb.InodeCount},
+		{"BitmapiStartAddress", sb.BitmapiStartAddress},
+		{"BitmapiSize", sb.BitmapiSize},
+		{"BitmapSize", sb.BitmapSize},
+		{"BitmapStartAddress", sb.BitmapStartAddress},
+		{"InodeStartAddress", sb.InodeStartAddress},
+		{"DataStartAddress", sb.DataStartAddress},
+	}
+	for _, field := range fields {
+		fmt.Fprintf(i.out, "%-20s %v\n", field.name, field.value)
+	}
+
+	fmt.Fprintln(i.out)
+	regions := []struct {
+		name       string
+		start, end int64
+	}{
+		{"superblock", 0, int64(binary.Size(Superblock{}))},
+		{"inode bitmap", sb.BitmapiStartAddress, sb.BitmapiStartAddress + int64(sb.BitmapiSize)},
+		{"data bitmap", sb.BitmapStartAddress, sb.BitmapStartAddress + int64(sb.BitmapSize)},
+		{"inodes", sb.InodeStartAddress, sb.InodeStartAddress + int64(sb.InodeCount)*inodeSize},
+		{"data", sb.DataStartAddress, sb.DataStartAddress + int64(sb.ClusterCount)*int64(sb.ClusterSize)},
+	}
+	//in the order they are stored in
+	sort.Slice(regions, func(a, b int) bool {
+		return regions[a].start < regions[b].start
+	})
+	for _, region := range regions {
+		fmt.Fprintf(i.out, "%-12s %10d - %10d (%d bytes)\n", region.name, region.start, region.end, region.end-region.start)
+	}
+	fmt.Fprintf(i.out, "inode size %d bytes, data clusters %d - %d\n",
+		inodeSize, firstCluster, firstCluster+int64(sb.ClusterCount)-1)
+
+	inodeBitmap, dataBitmap, err := loadBitmaps(i.fs, sb)
+	if err != nil {
+		return msgError(MsgErrReadData, err)
+	}
+	fmt.Fprintf(i.out, "used inodes %d of %d, used clusters %d of %d\n",
+		countSetBits(inodeBitmap, sb.InodeCount), sb.InodeCount, countSetBits(dataBitmap, sb.ClusterCount), sb.ClusterCount)
+	return nil
+}
+
+// superblockFlagNames returns the names of the set flags of the superblock.
+func superblockFlagNames(flags uint32) string {
+	names := make([]string, 0)
+	if flags&SuperblockFlagTrash != 0 {
+		names = append(names, "trash")
+	}
+	if flags&SuperblockFlagSecureDelete != 0 {
+		names = append(names, "secure-delete")
+	}
+	return "(" + strings.Join(names, ", ") + ")"
+}
+
+// countSetBits returns the number of set bits among the first count bits of the bitmap.
+func countSetBits(bitmap []uint8, count int32) int32 {
+	var set int32
+	for n := int32(0); n < count; n++ {
+		set += int32(getBit(bitmap[n/8], n%8))
+	}
+	return set
+}
+
+// parseRange parses a range "first-last" or a single number and checks that it lies within first and last.
+func parseRange(s string, first, last int64) (int64, int64, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	start, err := strconv.ParseInt(from, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	end := start
+	if isRange {
+		end, err = strconv.ParseInt(to, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if start < first || end > last || start > end {
+		return 0, 0, fmt.Errorf("range %s is outside of %d-%d", s, first, last)
+	}
+	return start, end, nil
+}
+
+// Bitmap prints the bits of the data or the inode bitmap: bitmap data|inode [range].
+// The bits are numbered by the cluster numbers of the data clusters or by the inode ids.
+func (i *Interpreter) Bitmap(arr []string) error {
+	if len(arr) != 2 && len(arr) != 3 {
+		return msgError(MsgArgsBitmap)
+	}
+	sb := i.superBlock
+	inodeBitmap, dataBitmap, err := loadBitmaps(i.fs, sb)
+	if err != nil {
+		return msgError(MsgErrReadData, err)
+	}
+	//number of the first bit and the bits
+	var first int64
+	var bitmap []uint8
+	var count int32
+	switch arr[1] {
+	case "data":
+		first, bitmap, count = sb.DataStartAddress/int64(sb.ClusterSize), dataBitmap, sb.ClusterCount
+	case "inode":
+		first, bitmap, count = 1, inodeBitmap, sb.InodeCount
+	default:
+		return msgError(MsgArgsBitmap)
+	}
+	start, end := first, first+int64(count)-1
+	if len(arr) == 3 {
+		start, end, err = parseRange(arr[2], start, end)
+		if err != nil {
+			return msgError(MsgErrRange, err)
+		}
+	}
+
+	var used int64
+	var line strings.Builder
+	for n := start; n <= end; n++ {
+		if (n-start)%bitmapBitsPerLine == 0 {
+			if line.Len() > 0 {
+				fmt.Fprintln(i.out, strings.TrimRight(line.String(), " "))
+				line.Reset()
+			}
+			fmt.Fprintf(&line, "%10d  ", n)
+		}
+		bit := int32(n - first)
+		if getBit(bitmap[bit/8], bit%8) == 1 {
+			line.WriteByte('1')
+			used++
+		} else {
+			line.WriteByte('.')
+		}
+		if (n-start)%8 == 7 {
+			line.WriteByte(' ')
+		}
+	}
+	fmt.Fprintln(i.out, strings.TrimRight(line.String(), " "))
+	fmt.Fprintf(i.out, "%d used, %d free\n", used, end-start+1-used)
+	return nil
+}
+
+// Istat prints the record of the inode with the given id and the clusters of the file: istat <inode id>.
+func (i *Interpreter) Istat(arr []string) error {
+	if len(arr) != 2 {
+		return msgError(MsgArgsIstat)
+	}
+	sb := i.superBlock
+	id, err := strconv.ParseInt(arr[1], 10, 32)
+	if err != nil || id < 1 || id > int64(sb.InodeCount) {
+		return msgError(MsgErrRange, fmt.Errorf("inode id %s is outside of 1-%d", arr[1], sb.InodeCount))
+	}
+	inodeId := int32(id)
+	inode, err := LoadInode(i.fs, inodeId, sb.InodeStartAddress)
+	if err != nil {
+		return msgError(MsgErrLoadInode, err)
+	}
+	inodeBitmap, err := LoadBitmap(i.fs, sb.BitmapiStartAddress, sb.BitmapiSize)
+	if err != nil {
+		return msgError(MsgErrReadData, err)
+	}
+	state := "free"
+	if getBit(inodeBitmap[(inodeId-1)/8], (inodeId-1)%8) == 1 {
+		state = "used"
+	}
+
+	fmt.Fprintf(i.out, "%-12s %d (address %d, %s)\n", "inode", inodeId,
+		sb.InodeStartAddress+int64(inodeId-1)*int64(binary.Size(inode)), state)
+	fmt.Fprintf(i.out, "%-12s %d\n", "NodeId", inode.NodeId)
+	fmt.Fprintf(i.out, "%-12s %v\n", "IsDirectory", inode.IsDirectory)
+	fmt.Fprintf(i.out, "%-12s %d\n", "References", inode.References)
+	fmt.Fprintf(i.out, "%-12s %#x %s\n", "Flags", inode.Flags, inodeFlagNames(inode.Flags))
+	fmt.Fprintf(i.out, "%-12s %d\n", "FileSize", inode.FileSize)
+	fmt.Fprintf(i.out, "%-12s %s\n", "AccessTime", formatInodeTime(inode.AccessTime))
+	fmt.Fprintf(i.out, "%-12s %s\n", "ModifyTime", formatInodeTime(inode.ModifyTime))
+	fmt.Fprintf(i.out, "%-12s %v\n", "Direct", inode.Direct)
+	fmt.Fprintf(i.out, "%-12s %v\n", "Indirect", inode.Indirect)
+	fmt.Fprintf(i.out, "%-12s %d\n", "DirIndex", inode.DirIndex)
+	fmt.Fprintf(i.out, "%-12s %d\n", "XattrCluster", inode.XattrCluster)
+	if inode.NodeId != inodeId {
+		//a free record, its pointers mean nothing
+		return nil
+	}
+
+	if isInline(inode) {
+		fmt.Fprintf(i.out, "%-12s %q\n", "inline data", inlineData(inode))
+		return nil
+	}
+	dataClusters, pointerClusters, err := GetFileClusters(i.fs, inode, sb)
+	if err != nil {
+		return msgError(MsgErrReadData, err)
+	}
+	fmt.Fprintf(i.out, "%-12s %d %s\n", "data", len(dataClusters), formatClusterRuns(dataClusters))
+	fmt.Fprintf(i.out, "%-12s %d %s\n", "pointers", len(pointerClusters), formatClusterRuns(pointerClusters))
+	return nil
+}
+
+// inodeFlagNames returns the names of the set flags of an inode.
+func inodeFlagNames(flags uint8) string {
+	names := make([]string, 0)
+	if flags&InodeFlagInline != 0 {
+		names = append(names, "inline")
+	}
+	if flags&InodeFlagDirIndex != 0 {
+		names = append(names, "dir-index")
+	}
+	return "(" + strings.Join(names, ", ") + ")"
+}
+
+// formatInodeTime formats a time stored in an inode, 0 means the time is not known.
+func formatInodeTime(t int64) string {
+	if t == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d (%s)", t, time.Unix(0, t).Format(time.RFC3339Nano))
+}
+
+// formatClusterRuns formats cluster numbers in parentheses with the runs of consecutive clusters shortened,
+// e.g. "(40-47 52)".
+func formatClusterRuns(clusters []int32) string {
+	parts := make([]string, 0)
+	for n := 0; n < len(clusters); {
+		end := n
+		for end+1 < len(clusters) && clusters[end+1] == clusters[end]+1 {
+			end++
+		}
+		if end == n {
+			parts = append(parts, strconv.Itoa(int(clusters[n])))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", clusters[n], clusters[end]))
+		}
+		n = end + 1
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+// Dblock prints a cluster of the image: dblock <cluster> [hex|dir|ptr]. By default it is printed like hexdump -C
+// with the addresses in the image, dir decodes it as directory items and ptr as an array of cluster pointers.
+func (i *Interpreter) Dblock(arr []string) error {
+	if len(arr) != 2 && len(arr) != 3 {
+		return msgError(MsgArgsDblock)
+	}
+	sb := i.superBlock
+	lastCluster := sb.DiskSize/int64(sb.ClusterSize) - 1
+	cluster, _, err := parseRange(arr[1], 0, lastCluster)
+	if err != nil || strings.Contains(arr[1], "-") {
+		return msgError(MsgErrRange, fmt.Errorf("cluster %s is outside of 0-%d", arr[1], lastCluster))
+	}
+	format := "hex"
+	if len(arr) == 3 {
+		format = arr[2]
+	}
+	block, err := readBlock(i.fs, ClusterAddress(sb, int32(cluster)), sb.ClusterSize)
+	if err != nil {
+		return msgError(MsgErrReadData, err)
+	}
+
+	switch format {
+	case "hex":
+		dumper := &dumpWriter{w: i.out, offset: ClusterAddress(sb, int32(cluster)), formatLine: hexdumpLine, end: true}
+		dumper.Write(block)
+		return dumper.Close()
+	case "dir":
+		items := make([]DirectoryItem, len(block)/binary.Size(DirectoryItem{}))
+		binary.Read(bytes.NewReader(block), binary.LittleEndian, items)
+		for n, item := range items {
+			if item.Inode == 0 && item.ItemName == [12]byte{} {
+				continue
+			}
+			fmt.Fprintf(i.out, "%4d  inode %-8d %q\n", n, item.Inode, removeNullCharsFromString(string(item.ItemName[:])))
+		}
+	case "ptr":
+		pointers := make([]int32, len(block)/AddressByteLen)
+		binary.Read(bytes.NewReader(block), binary.LittleEndian, pointers)
+		for n, pointer := range pointers {
+			if pointer != 0 {
+				fmt.Fprintf(i.out, "%4d  %d\n", n, pointer)
+			}
+		}
+	default:
+		return msgError(MsgArgsDblock)
+	}
+	return nil
+}
+
+// ExportMap writes the map of all clusters of the image as an HTML page into a file of the host:
+// export-map <out.html>.
+func (i *Interpreter) ExportMap(arr []string) error {
+	if len(arr) != 2 {
+		return msgError(MsgArgsExportMap)
+	}
+	clusters, err := BuildClusterMap(i.fs, i.superBlock)
+	if err != nil {
+		return msgError(MsgErrReadData, err)
+	}
+	file, err := os.Create(arr[1])
+	if err != nil {
+		return msgError(MsgDestPathNotFound)
+	}
+	w := bufio.NewWriter(file)
+	err = WriteClusterMap(w, clusters, i.superBlock)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return msgError(MsgErrExportMap, err)
+	}
+	return nil
+}
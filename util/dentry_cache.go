@@ -0,0 +1,113 @@
+package util
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DentryCacheSize is the number of directory entries remembered for every device.
+const DentryCacheSize = 65536
+
+// dentryKey identifies an item of a directory.
+type dentryKey struct {
+	parent int32
+	name   string
+}
+
+// dentry is a cached directory item.
+type dentry struct {
+	key   dentryKey
+	inode int32
+}
+
+// dentryCache remembers recently resolved directory items, so resolving a path does not read the directories again.
+// Entries are added while the directory is locked for reading and removed while it is locked for writing,
+// so the cache never returns an item which is no longer in the directory.
+type dentryCache struct {
+	mu      sync.Mutex
+	entries map[dentryKey]*list.Element
+	lru     *list.List //front is the most recently used entry
+}
+
+var (
+	dentriesMu sync.Mutex
+	dentriesOf = map[BlockDevice]*dentryCache{}
+)
+
+// dentriesFor returns the dentry cache of the device, creating it on first use.
+func dentriesFor(dev BlockDevice) *dentryCache {
+	dev = baseDevice(dev)
+	dentriesMu.Lock()
+	defer dentriesMu.Unlock()
+	c, ok := dentriesOf[dev]
+	if !ok {
+		c = &dentryCache{entries: map[dentryKey]*list.Element{}, lru: list.New()}
+		dentriesOf[dev] = c
+	}
+	return c
+}
+
+// dropDentries forgets all cached items of the device, used when it is formatted or closed.
+func dropDentries(dev BlockDevice) {
+	dev = baseDevice(dev)
+	dentriesMu.Lock()
+	defer dentriesMu.Unlock()
+	delete(dentriesOf, dev)
+}
+
+// lookupDentry returns the inode id of the cached item of the directory.
+func lookupDentry(dev BlockDevice, parent int32, name string) (int32, bool) {
+	c := dentriesFor(dev)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[dentryKey{parent, name}]
+	if !ok {
+		return 0, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*dentry).inode, true
+}
+
+// addDentry remembers an item of the directory. The caller must hold at least the read lock of the directory.
+func addDentry(dev BlockDevice, parent int32, name string, inodeId int32) {
+	c := dentriesFor(dev)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := dentryKey{parent, name}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*dentry).inode = inodeId
+		c.lru.MoveToFront(elem)
+		return
+	}
+	if c.lru.Len() >= DentryCacheSize {
+		oldest := c.lru.Back()
+		delete(c.entries, oldest.Value.(*dentry).key)
+		c.lru.Remove(oldest)
+	}
+	c.entries[key] = c.lru.PushFront(&dentry{key: key, inode: inodeId})
+}
+
+// forgetDentry removes a cached item of the directory. The caller must hold the write lock of the directory.
+func forgetDentry(dev BlockDevice, parent int32, name string) {
+	c := dentriesFor(dev)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := dentryKey{parent, name}
+	if elem, ok := c.entries[key]; ok {
+		delete(c.entries, key)
+		c.lru.Remove(elem)
+	}
+}
+
+// forgetDirectory removes all cached items of a deleted directory, its inode id may be used by another one.
+func forgetDirectory(dev BlockDevice, parent int32) {
+	c := dentriesFor(dev)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.entries {
+		if key.parent == parent {
+			delete(c.entries, key)
+			c.lru.Remove(elem)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// Hashed index of a large directory.
+//
+// A directory with more than DirIndexThreshold item slots gets an index, a file whose inode is flagged with
+// InodeFlagDirIndex and referenced by PseudoInode.DirIndex of the directory. The index is a hash table with
+// open addressing (linear probing):
+//
+//	entries int32   number of items in the table
+//	deleted int32   number of deleted slots
+//	slots   []int32 0 = empty, -1 = deleted, otherwise position of the item in the directory + 1
+//
+// The number of slots is a power of two and the table is rebuilt when more than half of the slots are used,
+// so a lookup reads a few slots and items instead of the whole directory.
+// The index is protected by the lock of its directory.
+
+const (
+	dirIndexHeaderSize = 8
+	dirIndexMinSlots   = 256
+	dirIndexEmpty      = 0
+	dirIndexDeleted    = -1
+)
+
+// dirIndexHeader is stored at the start of the index.
+type dirIndexHeader struct {
+	Entries int32
+	Deleted int32
+}
+
+// dirIndexHash returns the hash of an item name.
+func dirIndexHash(key [12]byte) uint32 {
+	h := fnv.New32a()
+	h.Write(bytes.TrimRight(key[:], "\x00"))
+	return h.Sum32()
+}
+
+// dirIndexSlots returns the number of slots of the index.
+func dirIndexSlots(index PseudoInode) int64 {
+	return (index.FileSize - dirIndexHeaderSize) / AddressByteLen
+}
+
+// buildDirIndex creates (or recreates) the index of the directory from its items and saves the directory inode.
+// The caller must hold the write lock of the directory, so the trash is not purged when there is not enough space.
+func buildDirIndex(fs BlockDevice, superBlock Superblock, dirInode *PseudoInode) error {
+	dir, err := loadDirectory(fs, *dirInode, superBlock)
+	if err != nil {
+		return err
+	}
+	header := dirIndexHeader{}
+	for _, item := range dir {
+		if item.Inode != 0 {
+			header.Entries++
+		}
+	}
+	slotCount := int64(dirIndexMinSlots)
+	for slotCount < 4*int64(header.Entries) {
+		slotCount *= 2
+	}
+	slots := make([]int32, slotCount)
+	for pos, item := range dir {
+		if item.Inode == 0 {
+			continue
+		}
+		slot := int64(dirIndexHash(item.ItemName)) & (slotCount - 1)
+		for slots[slot] != dirIndexEmpty {
+			slot = (slot + 1) & (slotCount - 1)
+		}
+		slots[slot] = int32(pos) + 1
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, header)
+	binary.Write(buf, binary.LittleEndian, slots)
+	if dirInode.DirIndex != 0 {
+		return rewriteFileData(fs, dirInode.DirIndex, buf.Bytes(), superBlock)
+	}
+
+	//the flag is set from the start, so the empty slots are allocated and not left as holes
+	_, indexId, err := writeNewFile(buf.Bytes(), fs, superBlock, false, InodeFlagDirIndex)
+	if err != nil {
+		return err
+	}
+	dirInode.DirIndex = int32(indexId)
+	return saveInode(fs, superBlock.InodeStartAddress, *dirInode)
+}
+
+// dirIndexProbe walks the slots of the index starting at the hash of the name and calls visit for every slot
+// until visit returns true, returns an error or an empty slot is found.
+func dirIndexProbe(fs BlockDevice, superBlock Superblock, dirInode PseudoInode, key [12]byte, visit func(slot int64, value int32) (bool, error)) error {
+	index, err := LoadInode(fs, dirInode.DirIndex, superBlock.InodeStartAddress)
+	if err != nil {
+		return err
+	}
+	slotCount := dirIndexSlots(index)
+	slot := int64(dirIndexHash(key)) & (slotCount - 1)
+	for i := int64(0); i < slotCount; i++ {
+		var value int32
+		err := readFileStruct(fs, superBlock, index, dirIndexHeaderSize+slot*AddressByteLen, &value)
+		if err != nil {
+			return err
+		}
+		done, err := visit(slot, value)
+		if done || err != nil {
+			return err
+		}
+		if value == dirIndexEmpty {
+			return nil
+		}
+		slot = (slot + 1) & (slotCount - 1)
+	}
+	return nil
+}
+
+// dirIndexLookup returns the position of the item with the given name in the directory, -1 if there is none.
+func dirIndexLookup(fs BlockDevice, superBlock Superblock, dirInode PseudoInode, key [12]byte) (int64, DirectoryItem, error) {
+	position := int64(-1)
+	var found DirectoryItem
+	err := dirIndexProbe(fs, superBlock, dirInode, key, func(slot int64, value int32) (bool, error) {
+		if value == dirIndexEmpty || value == dirIndexDeleted {
+			return false, nil
+		}
+		item, err := readDirItem(fs, superBlock, dirInode, int64(value-1))
+		if err != nil {
+			return false, err
+		}
+		if item.Inode != 0 && item.ItemName == key {
+			position, found = int64(value-1), item
+			return true, nil
+		}
+		return false, nil
+	})
+	return position, found, err
+}
+
+// dirIndexInsert adds the item at the given position into the index of the directory.
+// The item has to be written into the directory already, because a full index is rebuilt from the directory.
+func dirIndexInsert(fs BlockDevice, superBlock Superblock, dirInode *PseudoInode, key [12]byte, position int64) error {
+	index, err := LoadInode(fs, dirInode.DirIndex, superBlock.InodeStartAddress)
+	if err != nil {
+		return err
+	}
+	header := dirIndexHeader{}
+	err = readFileStruct(fs, superBlock, index, 0, &header)
+	if err != nil {
+		return err
+	}
+	if 2*int64(header.Entries+header.Deleted+1) > dirIndexSlots(index) {
+		return buildDirIndex(fs, superBlock, dirInode)
+	}
+	return dirIndexProbe(fs, superBlock, *dirInode, key, func(slot int64, value int32) (bool, error) {
+		if value != dirIndexEmpty && value != dirIndexDeleted {
+			return false, nil
+		}
+		if value == dirIndexDeleted {
+			header.Deleted--
+		}
+		header.Entries++
+		err := writeFileStruct(fs, superBlock, index, dirIndexHeaderSize+slot*AddressByteLen, int32(position)+1)
+		if err != nil {
+			return false, err
+		}
+		return true, writeFileStruct(fs, superBlock, index, 0, header)
+	})
+}
+
+// dirIndexRemove removes the item at the given position from the index of the directory.
+func dirIndexRemove(fs BlockDevice, superBlock Superblock, dirInode PseudoInode, key [12]byte, position int64) error {
+	index, err := LoadInode(fs, dirInode.DirIndex, superBlock.InodeStartAddress)
+	if err != nil {
+		return err
+	}
+	header := dirIndexHeader{}
+	err = readFileStruct(fs, superBlock, index, 0, &header)
+	if err != nil {
+		return err
+	}
+	return dirIndexProbe(fs, superBlock, dirInode, key, func(slot int64, value int32) (bool, error) {
+		if value != int32(position)+1 {
+			return false, nil
+		}
+		header.Entries--
+		header.Deleted++
+		err := writeFileStruct(fs, superBlock, index, dirIndexHeaderSize+slot*AddressByteLen, int32(dirIndexDeleted))
+		if err != nil {
+			return false, err
+		}
+		return true, writeFileStruct(fs, superBlock, index, 0, header)
+	})
+}
@@ -0,0 +1,185 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+)
+
+// The directory of the tests gets items until it has a hashed index, every second item is removed and half of them
+// are added again as new files. Lookups go through the index, the dentry cache is dropped before them.
+
+const dirIndexTestItems = 3 * DirIndexThreshold
+
+// newTestDirectory creates a directory in the root directory and returns its inode id.
+func newTestDirectory(t *testing.T, dev BlockDevice, superBlock Superblock, name string) int32 {
+	t.Helper()
+	_, dirId, err := CreateDirectory(dev, superBlock, 1)
+	if err != nil {
+		t.Fatalf("create directory: %v", err)
+	}
+	if err := AddDirItem(1, int32(dirId), name, dev, superBlock); err != nil {
+		t.Fatalf("add directory: %v", err)
+	}
+	return int32(dirId)
+}
+
+// addEmptyFile creates an empty file in the directory and returns its inode id.
+func addEmptyFile(t *testing.T, dev BlockDevice, superBlock Superblock, dirId int32, name string) int32 {
+	t.Helper()
+	_, inodeId, err := WriteAndSaveData(nil, dev, superBlock, false)
+	if err != nil {
+		t.Fatalf("create %s: %v", name, err)
+	}
+	if err := AddDirItem(dirId, int32(inodeId), name, dev, superBlock); err != nil {
+		t.Fatalf("add %s: %v", name, err)
+	}
+	return int32(inodeId)
+}
+
+// checkDirLookups looks up every name of the map in the directory, a zero inode id means the name was removed.
+// The positions found by the index are compared with the ones found by reading the whole directory.
+func checkDirLookups(t *testing.T, dev BlockDevice, superBlock Superblock, dirId int32, items map[string]int32) {
+	t.Helper()
+	dropDentries(dev)
+	dirInode, err := LoadInode(dev, dirId, superBlock.InodeStartAddress)
+	if err != nil {
+		t.Fatalf("load directory: %v", err)
+	}
+	if dirInode.DirIndex == 0 {
+		t.Fatalf("the directory with %d items has no index", len(items))
+	}
+	dir, err := LoadDirectory(dev, dirInode, superBlock)
+	if err != nil {
+		t.Fatalf("load directory: %v", err)
+	}
+	//every item of the directory is in the index once, removed items are not
+	index, err := LoadInode(dev, dirInode.DirIndex, superBlock.InodeStartAddress)
+	if err != nil {
+		t.Fatalf("load index: %v", err)
+	}
+	header := dirIndexHeader{}
+	if err := readFileStruct(dev, superBlock, index, 0, &header); err != nil {
+		t.Fatalf("read index: %v", err)
+	}
+	used := int32(0)
+	for slot := int64(0); slot < dirIndexSlots(index); slot++ {
+		var value int32
+		if err := readFileStruct(dev, superBlock, index, dirIndexHeaderSize+slot*AddressByteLen, &value); err != nil {
+			t.Fatalf("read index: %v", err)
+		}
+		if value != dirIndexEmpty && value != dirIndexDeleted {
+			used++
+		}
+	}
+	live := int32(0)
+	for _, item := range dir {
+		if item.Inode != 0 {
+			live++
+		}
+	}
+	if header.Entries != live || used != live {
+		t.Errorf("the index has %d entries and %d used slots, the directory %d items", header.Entries, used, live)
+	}
+	for name, want := range items {
+		got, err := LookupDirItem(dev, dirId, name, superBlock)
+		if want == 0 {
+			if err == nil {
+				t.Errorf("removed %s found as inode %d", name, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("lookup %s: %d, %v, want %d", name, got, err, want)
+		}
+		position, _, err := dirItemPosition(dev, dirInode, name, superBlock)
+		if err != nil || position != int64(GetDirItemIndex(dir, name)) {
+			t.Errorf("index of %s: position %d, %v, the directory has it at %d", name, position, err, GetDirItemIndex(dir, name))
+		}
+	}
+}
+
+func TestDirIndex(t *testing.T) {
+	dev, superBlock := newStressFilesystem(t)
+	dirId := newTestDirectory(t, dev, superBlock, "big")
+	items := map[string]int32{}
+	for n := 0; n < dirIndexTestItems; n++ {
+		name := fmt.Sprintf("f%03d", n)
+		items[name] = addEmptyFile(t, dev, superBlock, dirId, name)
+	}
+	checkDirLookups(t, dev, superBlock, dirId, items)
+
+	for n := 1; n < dirIndexTestItems; n += 2 {
+		name := fmt.Sprintf("f%03d", n)
+		if err := RemoveDirItem(dirId, name, dev, superBlock, true); err != nil {
+			t.Fatalf("remove %s: %v", name, err)
+		}
+		items[name] = 0
+	}
+	checkDirLookups(t, dev, superBlock, dirId, items)
+
+	//the removed names come back with other inodes
+	for n := 1; n < dirIndexTestItems; n += 4 {
+		name := fmt.Sprintf("f%03d", n)
+		items[name] = addEmptyFile(t, dev, superBlock, dirId, name)
+	}
+	checkDirLookups(t, dev, superBlock, dirId, items)
+}
+
+func TestDentryCache(t *testing.T) {
+	dev, superBlock := newStressFilesystem(t)
+	dirId := newTestDirectory(t, dev, superBlock, "d")
+	fileId := addEmptyFile(t, dev, superBlock, dirId, "x")
+
+	if _, err := LookupDirItem(dev, dirId, "x", superBlock); err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if inodeId, ok := lookupDentry(dev, dirId, "x"); !ok || inodeId != fileId {
+		t.Fatalf("cached x: %d, %v, want %d", inodeId, ok, fileId)
+	}
+	//commands run on a traced device, which shares the cache of the device under it
+	if inodeId, ok := lookupDentry(&tracedDevice{BlockDevice: dev}, dirId, "x"); !ok || inodeId != fileId {
+		t.Errorf("cached x through the traced device: %d, %v", inodeId, ok)
+	}
+
+	if err := RemoveDirItem(dirId, "x", dev, superBlock, true); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, ok := lookupDentry(dev, dirId, "x"); ok {
+		t.Error("removed x is still cached")
+	}
+	if _, err := LookupDirItem(dev, dirId, "x", superBlock); err == nil {
+		t.Error("removed x found")
+	}
+
+	//the items of a removed directory are forgotten, its inode id can be reused
+	if _, err := LookupDirItem(dev, dirId, ".", superBlock); err != nil {
+		t.Fatalf("lookup .: %v", err)
+	}
+	if err := RemoveDirectory(1, "d", dev, superBlock); err != nil {
+		t.Fatalf("remove directory: %v", err)
+	}
+	if _, ok := lookupDentry(dev, dirId, "."); ok {
+		t.Error("an item of the removed directory is still cached")
+	}
+}
+
+func TestDentryCacheEviction(t *testing.T) {
+	dev := NewMemDevice(nil)
+	t.Cleanup(func() { dropDentries(dev) })
+	for n := 0; n <= DentryCacheSize; n++ {
+		addDentry(dev, 1, fmt.Sprintf("f%d", n), int32(n+2))
+		if n == 0 {
+			continue
+		}
+		//the first entry is used again and again, so the second one is the oldest
+		if _, ok := lookupDentry(dev, 1, "f0"); !ok {
+			t.Fatalf("f0 evicted after %d entries", n)
+		}
+	}
+	if _, ok := lookupDentry(dev, 1, "f1"); ok {
+		t.Error("the least recently used entry was not evicted")
+	}
+	if inodeId, ok := lookupDentry(dev, 1, fmt.Sprintf("f%d", DentryCacheSize)); !ok || inodeId != DentryCacheSize+2 {
+		t.Errorf("the newest entry: %d, %v", inodeId, ok)
+	}
+}
@@ -0,0 +1,557 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Access to single clusters of a file.
+//
+// Cluster index n of a file (its bytes n*ClusterSize up to (n+1)*ClusterSize) is found in
+//
+//   - Direct[n] for the first 12 clusters,
+//   - the singly indirect block Indirect[0] for the next ClusterSize/4 clusters,
+//   - the doubly indirect block Indirect[1] for the rest, entry k of it is the singly indirect block of the
+//     clusters 12 + ClusterSize/4 + k*ClusterSize/4 and further.
+//
+// A zero pointer is a hole: a cluster which is not allocated and reads as zeros. Files get holes where they were
+// written after their end or truncated to a bigger size, and where the stored data have clusters of zeros only.
+
+// pointersPerCluster returns how many cluster pointers fit into one indirect block.
+func pointersPerCluster(superBlock Superblock) int64 {
+	return int64(superBlock.ClusterSize / AddressByteLen)
+}
+
+// readPointer reads the pointer with the given index from the indirect block.
+func readPointer(fs BlockDevice, superBlock Superblock, block int32, index int64) (int32, error) {
+	var pointer int32
+	traceIO(fs, "readPointer", false, ClusterAddress(superBlock, block)+index*AddressByteLen, AddressByteLen)
+	err := readStruct(fs, ClusterAddress(superBlock, block)+index*AddressByteLen, &pointer)
+	if err != nil {
+		return 0, fmt.Errorf("could not read indirect block: %v", err)
+	}
+	return pointer, nil
+}
+
+// writePointer writes the pointer with the given index into the indirect block.
+func writePointer(fs BlockDevice, superBlock Superblock, block int32, index int64, pointer int32) error {
+	traceIO(fs, "writePointer", true, ClusterAddress(superBlock, block)+index*AddressByteLen, AddressByteLen)
+	err := writeStruct(fs, ClusterAddress(superBlock, block)+index*AddressByteLen, pointer)
+	if err != nil {
+		return fmt.Errorf("could not write indirect block: %v", err)
+	}
+	return nil
+}
+
+// fileClusterAt returns the cluster number of the cluster with the given index of the file, 0 if it is not allocated.
+func fileClusterAt(fs BlockDevice, superBlock Superblock, inode PseudoInode, index int64) (int32, error) {
+	perCluster := pointersPerCluster(superBlock)
+	if isInline(inode) {
+		return 0, nil
+	}
+	if index < int64(len(inode.Direct)) {
+		return inode.Direct[index], nil
+	}
+	index -= int64(len(inode.Direct))
+	if index < perCluster {
+		if inode.Indirect[0] == 0 {
+			return 0, nil
+		}
+		return readPointer(fs, superBlock, inode.Indirect[0], index)
+	}
+	index -= perCluster
+	if index >= perCluster*perCluster || inode.Indirect[1] == 0 {
+		return 0, nil
+	}
+	singly, err := readPointer(fs, superBlock, inode.Indirect[1], index/perCluster)
+	if err != nil || singly == 0 {
+		return 0, err
+	}
+	return readPointer(fs, superBlock, singly, index%perCluster)
+}
+
+// fileClusterList returns the cluster numbers of all clusters of the file in the order of the file, 0 for the holes.
+// Every indirect block is read only once. A file stored inline in the inode has no clusters.
+func fileClusterList(fs BlockDevice, superBlock Superblock, inode PseudoInode) ([]int32, error) {
+	if isInline(inode) {
+		return nil, nil
+	}
+	clusterSize := int64(superBlock.ClusterSize)
+	perCluster := pointersPerCluster(superBlock)
+	count := (inode.FileSize + clusterSize - 1) / clusterSize
+	clusters := make([]int32, 0, count)
+	clusters = append(clusters, inode.Direct[:min(count, int64(len(inode.Direct)))]...)
+	//appendPointers adds n pointers of the indirect block, zeros if the block is missing
+	appendPointers := func(block int32, n int64) error {
+		if block == 0 {
+			clusters = append(clusters, make([]int32, n)...)
+			return nil
+		}
+		pointers, err := readBlockInt32(fs, ClusterAddress(superBlock, block), superBlock.ClusterSize)
+		if err != nil {
+			return fmt.Errorf("could not read indirect block: %v", err)
+		}
+		clusters = append(clusters, pointers[:n]...)
+		return nil
+	}
+	if rest := count - int64(len(clusters)); rest > 0 {
+		if err := appendPointers(inode.Indirect[0], min(rest, perCluster)); err != nil {
+			return nil, err
+		}
+	}
+	if rest := count - int64(len(clusters)); rest > 0 {
+		singly := make([]int32, perCluster)
+		if inode.Indirect[1] != 0 {
+			var err error
+			singly, err = readBlockInt32(fs, ClusterAddress(superBlock, inode.Indirect[1]), superBlock.ClusterSize)
+			if err != nil {
+				return nil, fmt.Errorf("could not read indirect block: %v", err)
+			}
+		}
+		for k := 0; rest > 0 && k < len(singly); k++ {
+			if err := appendPointers(singly[k], min(rest, perCluster)); err != nil {
+				return nil, err
+			}
+			rest = count - int64(len(clusters))
+		}
+	}
+	return clusters, nil
+}
+
+// setFileCluster sets the cluster with the given index of the file. Missing indirect blocks are allocated
+// from the data bitmap and zeroed. The caller must hold the allocator lock and save the inode and the returned bitmap.
+func setFileCluster(fs BlockDevice, superBlock Superblock, inode *PseudoInode, index int64, cluster int32, dataBitmap []uint8) ([]uint8, error) {
+	perCluster := pointersPerCluster(superBlock)
+	var err error
+	if index < int64(len(inode.Direct)) {
+		inode.Direct[index] = cluster
+		return dataBitmap, nil
+	}
+	index -= int64(len(inode.Direct))
+	if index < perCluster {
+		if inode.Indirect[0] == 0 {
+			inode.Indirect[0], dataBitmap, err = allocateZeroedCluster(fs, superBlock, dataBitmap)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return dataBitmap, writePointer(fs, superBlock, inode.Indirect[0], index, cluster)
+	}
+	index -= perCluster
+	if index >= perCluster*perCluster {
+		return nil, ErrFileTooBig
+	}
+	if inode.Indirect[1] == 0 {
+		inode.Indirect[1], dataBitmap, err = allocateZeroedCluster(fs, superBlock, dataBitmap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	singly, err := readPointer(fs, superBlock, inode.Indirect[1], index/perCluster)
+	if err != nil {
+		return nil, err
+	}
+	if singly == 0 {
+		singly, dataBitmap, err = allocateZeroedCluster(fs, superBlock, dataBitmap)
+		if err != nil {
+			return nil, err
+		}
+		err = writePointer(fs, superBlock, inode.Indirect[1], index/perCluster, singly)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dataBitmap, writePointer(fs, superBlock, singly, index%perCluster, cluster)
+}
+
+// allocateZeroedCluster takes one free cluster from the data bitmap and fills it with zeros.
+// The caller must hold the allocator lock and save the returned bitmap.
+func allocateZeroedCluster(fs BlockDevice, superBlock Superblock, dataBitmap []uint8) (int32, []uint8, error) {
+	clusters, dataBitmap, err := GetAvailableDataBlocks(dataBitmap, superBlock, int64(superBlock.ClusterSize))
+	if err != nil {
+		return 0, nil, err
+	}
+	traceIO(fs, "allocateZeroedCluster", true, ClusterAddress(superBlock, clusters[0]), int(superBlock.ClusterSize))
+	_, err = fs.WriteAt(make([]byte, superBlock.ClusterSize), ClusterAddress(superBlock, clusters[0]))
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not write into datablock: %v", err)
+	}
+	return clusters[0], dataBitmap, nil
+}
+
+// appendFileCluster adds one zeroed cluster at the end of the file and saves the inode.
+// The size of the file grows by one cluster, so it should only be used for files whose size is a multiple
+// of the cluster size (directories). It returns the number of the new cluster.
+func appendFileCluster(fs BlockDevice, superBlock Superblock, inode *PseudoInode) (int32, error) {
+	defer lockAlloc(fs)()
+	dataBitmap, err := LoadBitmap(fs, superBlock.BitmapStartAddress, superBlock.BitmapSize)
+	if err != nil {
+		return 0, err
+	}
+	cluster, dataBitmap, err := allocateZeroedCluster(fs, superBlock, dataBitmap)
+	if err != nil {
+		return 0, err
+	}
+	newInode := *inode
+	dataBitmap, err = setFileCluster(fs, superBlock, &newInode, newInode.FileSize/int64(superBlock.ClusterSize), cluster, dataBitmap)
+	if err != nil {
+		return 0, err
+	}
+	newInode.FileSize += int64(superBlock.ClusterSize)
+	err = saveBitmap(fs, superBlock.BitmapStartAddress, dataBitmap)
+	if err != nil {
+		return 0, err
+	}
+	err = saveInode(fs, superBlock.InodeStartAddress, newInode)
+	if err != nil {
+		return 0, err
+	}
+	*inode = newInode
+	return cluster, nil
+}
+
+// readFileAt reads len(buf) bytes of the file starting at the offset. Clusters which are not allocated read as zeros.
+// It returns io.EOF if the file ends before buf is filled.
+func readFileAt(fs BlockDevice, superBlock Superblock, inode PseudoInode, buf []byte, offset int64) (int, error) {
+	if isInline(inode) {
+		data := inlineData(inode)
+		if offset >= int64(len(data)) {
+			return 0, io.EOF
+		}
+		n := copy(buf, data[offset:])
+		if n < len(buf) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	clusterSize := int64(superBlock.ClusterSize)
+	done := 0
+	for done < len(buf) {
+		pos := offset + int64(done)
+		if pos >= inode.FileSize {
+			return done, io.EOF
+		}
+		length := min(int64(len(buf)-done), clusterSize-pos%clusterSize, inode.FileSize-pos)
+		part := buf[done : done+int(length)]
+		cluster, err := fileClusterAt(fs, superBlock, inode, pos/clusterSize)
+		if err != nil {
+			return done, err
+		}
+		if cluster == 0 {
+			clear(part)
+		} else {
+			traceIO(fs, "readFileAt", false, ClusterAddress(superBlock, cluster)+pos%clusterSize, len(part))
+			if _, err := fs.ReadAt(part, ClusterAddress(superBlock, cluster)+pos%clusterSize); err != nil {
+				return done, err
+			}
+		}
+		done += int(length)
+	}
+	return done, nil
+}
+
+// writeFileAt overwrites len(buf) bytes of the file starting at the offset.
+// It only writes into allocated clusters inside the file, it does not allocate anything nor change the size.
+func writeFileAt(fs BlockDevice, superBlock Superblock, inode PseudoInode, buf []byte, offset int64) error {
+	clusterSize := int64(superBlock.ClusterSize)
+	if isInline(inode) || offset+int64(len(buf)) > inode.FileSize {
+		return fmt.Errorf("write outside of the allocated part of the file")
+	}
+	done := 0
+	for done < len(buf) {
+		pos := offset + int64(done)
+		length := min(int64(len(buf)-done), clusterSize-pos%clusterSize)
+		cluster, err := fileClusterAt(fs, superBlock, inode, pos/clusterSize)
+		if err != nil {
+			return err
+		}
+		if cluster == 0 {
+			return fmt.Errorf("write outside of the allocated part of the file")
+		}
+		traceIO(fs, "writeFileAt", true, ClusterAddress(superBlock, cluster)+pos%clusterSize, int(length))
+		_, err = fs.WriteAt(buf[done:done+int(length)], ClusterAddress(superBlock, cluster)+pos%clusterSize)
+		if err != nil {
+			return fmt.Errorf("could not write into datablock: %v", err)
+		}
+		done += int(length)
+	}
+	return nil
+}
+
+// readFileStruct decodes a little endian value stored at the offset of the file.
+func readFileStruct(fs BlockDevice, superBlock Superblock, inode PseudoInode, offset int64, value any) error {
+	buf := make([]byte, binary.Size(value))
+	if _, err := readFileAt(fs, superBlock, inode, buf, offset); err != nil {
+		return err
+	}
+	return binary.Read(bytes.NewReader(buf), binary.LittleEndian, value)
+}
+
+// writeFileStruct encodes a value in little endian and stores it at the offset of the file (see writeFileAt).
+func writeFileStruct(fs BlockDevice, superBlock Superblock, inode PseudoInode, offset int64, value any) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, value); err != nil {
+		return err
+	}
+	return writeFileAt(fs, superBlock, inode, buf.Bytes(), offset)
+}
+
+// isZero reports whether the buffer contains only zero bytes.
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// zeroTail fills the last cluster of the file with zeros from the end of the file up to the given offset
+// (at most to the end of the cluster). A file which grows must read as zeros after its old end,
+// but the rest of its last cluster may hold what was written there before the cluster was freed.
+func zeroTail(fs BlockDevice, superBlock Superblock, inode PseudoInode, upTo int64) error {
+	clusterSize := int64(superBlock.ClusterSize)
+	if isInline(inode) || inode.FileSize%clusterSize == 0 || upTo <= inode.FileSize {
+		return nil
+	}
+	cluster, err := fileClusterAt(fs, superBlock, inode, inode.FileSize/clusterSize)
+	if err != nil || cluster == 0 {
+		return err
+	}
+	length := min(upTo, (inode.FileSize/clusterSize+1)*clusterSize) - inode.FileSize
+	address := ClusterAddress(superBlock, cluster) + inode.FileSize%clusterSize
+	traceIO(fs, "zeroTail", true, address, int(length))
+	if _, err := fs.WriteAt(make([]byte, length), address); err != nil {
+		return fmt.Errorf("could not write into datablock: %v", err)
+	}
+	return nil
+}
+
+// fileRange is data written at an offset of a file.
+type fileRange struct {
+	data   []byte
+	offset int64
+}
+
+// writeFileRange writes data into the file at the offset, allocating the clusters the file does not have yet,
+// and saves the inode. An offset after the end of the file leaves a hole between the end and the offset.
+// A small file stays inline and moves into clusters when it grows over InlineDataSize.
+// If there is not enough space, nothing is changed and ErrNoSpace is returned.
+// The caller must hold the lock of the inode.
+func writeFileRange(fs BlockDevice, superBlock Superblock, inode *PseudoInode, data []byte, offset int64) error {
+	if offset < 0 {
+		return fmt.Errorf("write outside of the file")
+	}
+	end := offset + int64(len(data))
+	newInode := *inode
+	newInode.ModifyTime = timeNow().UnixNano()
+	if len(data) == 0 {
+		//writing nothing does not change the size, not even after the end
+		*inode = newInode
+		return saveInode(fs, superBlock.InodeStartAddress, newInode)
+	}
+	ranges := []fileRange{{data, offset}}
+	if isInline(newInode) {
+		content := inlineData(newInode)
+		if end <= InlineDataSize {
+			if end > int64(len(content)) {
+				content = append(content, make([]byte, end-int64(len(content)))...)
+			}
+			copy(content[offset:], data)
+			newInode.FileSize = int64(len(content))
+			setInlineData(&newInode, content)
+			*inode = newInode
+			return saveInode(fs, superBlock.InodeStartAddress, newInode)
+		}
+		//the file moves into clusters, the inline part is written together with the new data
+		if offset <= int64(len(content)) {
+			ranges[0] = fileRange{append(content[:offset:offset], data...), 0}
+		} else if len(content) > 0 {
+			ranges = append(ranges, fileRange{content, 0})
+		}
+		newInode.Flags &^= InodeFlagInline
+		newInode.Direct = [12]int32{}
+		newInode.Indirect = [3]int32{}
+		newInode.FileSize = 0
+	}
+
+	defer lockAlloc(fs)()
+	dataBitmap, err := LoadBitmap(fs, superBlock.BitmapStartAddress, superBlock.BitmapSize)
+	if err != nil {
+		return err
+	}
+	clusterSize := int64(superBlock.ClusterSize)
+	//the doubly indirect block of the saved inode gets pointers to new singly indirect blocks,
+	//its old content is kept so they can be unlinked again
+	var doublyBefore []int32
+	if inode.Indirect[1] != 0 && !isInline(*inode) && (end-1)/clusterSize >= int64(len(inode.Direct))+pointersPerCluster(superBlock) {
+		doublyBefore, err = readBlockInt32(fs, ClusterAddress(superBlock, inode.Indirect[1]), superBlock.ClusterSize)
+		if err != nil {
+			return fmt.Errorf("could not read indirect block: %v", err)
+		}
+	}
+	allocated := make([]int64, 0)
+	//unlink takes back the pointers to the new clusters, which stay free because the bitmap is not saved.
+	//The indirect blocks the saved inode already has must not point to them.
+	unlink := func() {
+		for _, index := range allocated {
+			//an index whose indirect block could not be allocated has nothing to unlink
+			if cluster, err := fileClusterAt(fs, superBlock, newInode, index); err == nil && cluster != 0 {
+				setFileCluster(fs, superBlock, &newInode, index, 0, dataBitmap)
+			}
+		}
+		if doublyBefore != nil {
+			writePointerBlock(fs, superBlock, inode.Indirect[1], doublyBefore)
+		}
+	}
+	for _, r := range ranges {
+		for index := r.offset / clusterSize; index <= (r.offset+int64(len(r.data))-1)/clusterSize; index++ {
+			cluster, err := fileClusterAt(fs, superBlock, newInode, index)
+			if err == nil && cluster == 0 {
+				cluster, dataBitmap, err = allocateZeroedCluster(fs, superBlock, dataBitmap)
+				if err == nil {
+					allocated = append(allocated, index)
+					var grown []uint8
+					grown, err = setFileCluster(fs, superBlock, &newInode, index, cluster, dataBitmap)
+					if err == nil {
+						dataBitmap = grown
+					}
+				}
+			}
+			if err != nil {
+				unlink()
+				return err
+			}
+		}
+	}
+
+	err = zeroTail(fs, superBlock, newInode, offset)
+	if err != nil {
+		unlink()
+		return err
+	}
+	newInode.FileSize = max(newInode.FileSize, end)
+	for _, r := range ranges {
+		err = writeFileAt(fs, superBlock, newInode, r.data, r.offset)
+		if err != nil {
+			unlink()
+			return err
+		}
+	}
+	err = saveBitmap(fs, superBlock.BitmapStartAddress, dataBitmap)
+	if err != nil {
+		unlink()
+		return err
+	}
+	*inode = newInode
+	return saveInode(fs, superBlock.InodeStartAddress, newInode)
+}
+
+// truncateFile changes the size of the file and saves the inode. The clusters after the new end are freed,
+// a file which grows gets a hole at its end. The caller must hold the lock of the inode.
+func truncateFile(fs BlockDevice, superBlock Superblock, inode *PseudoInode, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("negative size")
+	}
+	newInode := *inode
+	newInode.ModifyTime = timeNow().UnixNano()
+	if isInline(newInode) {
+		content := inlineData(newInode)
+		if size <= InlineDataSize {
+			content = append(content, make([]byte, max(0, size-int64(len(content))))...)
+			setInlineData(&newInode, content[:size])
+			newInode.FileSize = size
+			*inode = newInode
+			return saveInode(fs, superBlock.InodeStartAddress, newInode)
+		}
+		//the file moves into clusters, its data are written into the first cluster and the rest is a hole
+		newInode.Flags &^= InodeFlagInline
+		newInode.Direct = [12]int32{}
+		newInode.Indirect = [3]int32{}
+		newInode.FileSize = 0
+		if len(content) > 0 {
+			if err := writeFileRange(fs, superBlock, &newInode, content, 0); err != nil {
+				return err
+			}
+		}
+	}
+	if size >= newInode.FileSize {
+		if err := zeroTail(fs, superBlock, newInode, size); err != nil {
+			return err
+		}
+		newInode.FileSize = size
+		*inode = newInode
+		return saveInode(fs, superBlock.InodeStartAddress, newInode)
+	}
+
+	defer lockAlloc(fs)()
+	dataBitmap, err := LoadBitmap(fs, superBlock.BitmapStartAddress, superBlock.BitmapSize)
+	if err != nil {
+		return err
+	}
+	clusters, err := fileClusterList(fs, superBlock, newInode)
+	if err != nil {
+		return err
+	}
+	clusterSize := int64(superBlock.ClusterSize)
+	keep := (size + clusterSize - 1) / clusterSize
+	freed := make([]int32, 0)
+	for index := keep; index < int64(len(clusters)); index++ {
+		if clusters[index] == 0 {
+			continue
+		}
+		//the indirect blocks of the freed clusters stay with the file, they are freed with it
+		dataBitmap, err = setFileCluster(fs, superBlock, &newInode, index, 0, dataBitmap)
+		if err != nil {
+			return err
+		}
+		freed = append(freed, clusters[index])
+	}
+	dataBitmap = SetValuesInDataBitmap(dataBitmap, freed, superBlock, false)
+	if SecureDeleteEnabled(superBlock) {
+		if err := wipeClusters(fs, superBlock, freed); err != nil {
+			return err
+		}
+	}
+	newInode.FileSize = size
+	err = saveBitmap(fs, superBlock.BitmapStartAddress, dataBitmap)
+	if err != nil {
+		return err
+	}
+	*inode = newInode
+	return saveInode(fs, superBlock.InodeStartAddress, newInode)
+}
+
+// seekDataOrHole returns the first offset at or after the given one which is in data (data is true)
+// or in a hole of the file, like lseek with SEEK_DATA and SEEK_HOLE. The end of the file counts as a hole.
+// Allocated clusters are data even if they hold zeros. It returns ErrNoData if there is no data after the offset.
+func seekDataOrHole(fs BlockDevice, superBlock Superblock, inode PseudoInode, offset int64, data bool) (int64, error) {
+	if offset >= inode.FileSize {
+		if data {
+			return 0, ErrNoData
+		}
+		return offset, nil
+	}
+	clusters, err := fileClusterList(fs, superBlock, inode)
+	if err != nil {
+		return 0, err
+	}
+	if isInline(inode) {
+		if data {
+			return offset, nil
+		}
+		return inode.FileSize, nil
+	}
+	clusterSize := int64(superBlock.ClusterSize)
+	for index := offset / clusterSize; index < int64(len(clusters)); index++ {
+		if (clusters[index] != 0) == data {
+			return max(offset, index*clusterSize), nil
+		}
+	}
+	if data {
+		return 0, ErrNoData
+	}
+	return inode.FileSize, nil
+}
@@ -0,0 +1,178 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Flags of OpenFile.
+const (
+	// OpenAppend makes every write go to the end of the file.
+	OpenAppend = 1 << iota
+	// OpenTruncate empties the file when it is opened.
+	OpenTruncate
+)
+
+// Whence values of File.Seek which find the data and the holes of a sparse file,
+// the same as SEEK_DATA and SEEK_HOLE of lseek on Linux.
+const (
+	SeekData = 3
+	SeekHole = 4
+)
+
+// File is an open regular file of the filesystem. It reads and writes at its own offset like os.File,
+// only the written part of the file changes and new clusters are allocated as the file grows.
+// The inode is loaded and locked for every call, so several handles of one file see each other's changes.
+type File struct {
+	fs         BlockDevice
+	superBlock Superblock
+	inodeId    int32
+	offset     int64
+	appendMode bool
+}
+
+// OpenFile opens the regular file with the given inode id. flag is a combination of OpenAppend and OpenTruncate.
+func OpenFile(fs BlockDevice, inodeId int32, flag int, superBlock Superblock) (*File, error) {
+	f := &File{fs: fs, superBlock: superBlock, inodeId: inodeId, appendMode: flag&OpenAppend != 0}
+	inode, err := f.loadInode()
+	if err != nil {
+		return nil, err
+	}
+	if inode.IsDirectory {
+		return nil, fmt.Errorf("%d is a directory", inodeId)
+	}
+	if flag&OpenTruncate != 0 && inode.FileSize > 0 {
+		err = WriteFileData(fs, inodeId, nil, superBlock)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// loadInode loads the inode of the file and checks that it was not deleted. The caller locks the inode.
+func (f *File) loadInode() (PseudoInode, error) {
+	inode, err := LoadInode(f.fs, f.inodeId, f.superBlock.InodeStartAddress)
+	if err != nil {
+		return PseudoInode{}, err
+	}
+	if inode.NodeId != f.inodeId {
+		return PseudoInode{}, fmt.Errorf("file does not exist")
+	}
+	return inode, nil
+}
+
+// Write writes p at the offset of the file (at its end in append mode) and moves the offset after it.
+// If there is not enough space, files are purged from the trash and the write is tried again.
+func (f *File) Write(p []byte) (int, error) {
+	if f.fs == nil {
+		return 0, os.ErrClosed
+	}
+	err := purgeTrashOnNoSpace(f.fs, f.superBlock, func() error {
+		defer lockInode(f.fs, f.inodeId)()
+		inode, err := f.loadInode()
+		if err != nil {
+			return err
+		}
+		if f.appendMode {
+			f.offset = inode.FileSize
+		}
+		return writeFileRange(f.fs, f.superBlock, &inode, p, f.offset)
+	})
+	if err != nil {
+		return 0, err
+	}
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+// Read reads from the offset of the file and moves the offset after the read bytes.
+// It returns io.EOF at the end of the file.
+func (f *File) Read(p []byte) (int, error) {
+	if f.fs == nil {
+		return 0, os.ErrClosed
+	}
+	unlock := rlockInode(f.fs, f.inodeId)
+	inode, err := f.loadInode()
+	if err != nil {
+		unlock()
+		return 0, err
+	}
+	n, err := readFileAt(f.fs, f.superBlock, inode, p, f.offset)
+	unlock()
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		//the next call reports the end
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next Read or Write like io.Seeker. SeekData and SeekHole move the offset to the first
+// data or hole at or after the given offset, with SeekData it returns ErrNoData if the file has no more data.
+// An offset after the end of the file is allowed, a write there leaves a hole.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if f.fs == nil {
+		return 0, os.ErrClosed
+	}
+	stats.seeks.Add(1)
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		unlock := rlockInode(f.fs, f.inodeId)
+		inode, err := f.loadInode()
+		unlock()
+		if err != nil {
+			return 0, err
+		}
+		offset += inode.FileSize
+	case SeekData, SeekHole:
+		if offset < 0 {
+			return 0, fmt.Errorf("negative offset")
+		}
+		unlock := rlockInode(f.fs, f.inodeId)
+		inode, err := f.loadInode()
+		if err == nil {
+			offset, err = seekDataOrHole(f.fs, f.superBlock, inode, offset, whence == SeekData)
+		}
+		unlock()
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Truncate changes the size of the file like os.File.Truncate. The clusters after a new smaller size are freed,
+// a file which grows gets a hole at its end. The offset does not change.
+func (f *File) Truncate(size int64) error {
+	if f.fs == nil {
+		return os.ErrClosed
+	}
+	return purgeTrashOnNoSpace(f.fs, f.superBlock, func() error {
+		defer lockInode(f.fs, f.inodeId)()
+		inode, err := f.loadInode()
+		if err != nil {
+			return err
+		}
+		return truncateFile(f.fs, f.superBlock, &inode, size)
+	})
+}
+
+// Close closes the file. Every write is already stored, so it only makes the handle unusable.
+func (f *File) Close() error {
+	if f.fs == nil {
+		return os.ErrClosed
+	}
+	f.fs = nil
+	return nil
+}
@@ -3,11 +3,14 @@ package util
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 )
 
 func CreateBitmap(bytes int) []uint8 {
@@ -15,69 +18,90 @@ func CreateBitmap(bytes int) []uint8 {
 	return bitmap
 }
 
-// Creates a superblock and calculates required addresses
-func createSuperBlock(filename string, diskSize int, clusterSize int) Superblock {
+// checkClusterSize returns an error if the cluster size is not a power of two between MinClusterSize and MaxClusterSize.
+func checkClusterSize(clusterSize int32) error {
+	if clusterSize < MinClusterSize || clusterSize > MaxClusterSize || clusterSize&(clusterSize-1) != 0 {
+		return fmt.Errorf("cluster size must be a power of two between %d and %d bytes", MinClusterSize, MaxClusterSize)
+	}
+	return nil
+}
+
+// Creates a superblock and calculates required addresses.
+// It returns an error if the cluster size is invalid or the disk cannot be addressed with it.
+func createSuperBlock(diskSize int64, clusterSize int32) (Superblock, error) {
 	var superBlock Superblock
 	pseudoInode := PseudoInode{}
-	copy(superBlock.Signature[:], "nuva")
+	if err := checkClusterSize(clusterSize); err != nil {
+		return Superblock{}, err
+	}
+	//cluster numbers are 32-bit, so the last cluster of the disk has to fit into int32
+	if maxSize := int64(math.MaxInt32) * int64(clusterSize); diskSize > maxSize {
+		return Superblock{}, fmt.Errorf("disk size %d cannot be addressed with %d byte clusters (at most %d bytes)", diskSize, clusterSize, maxSize)
+	}
+	copy(superBlock.Signature[:], SuperblockSignature)
+	superBlock.Version = SuperblockVersion
 	copy(superBlock.VolumeDescriptor[:], "description")
-	superBlock.DiskSize = int64(diskSize)
-	superBlock.ClusterSize = int32(clusterSize)
-	superBlock.ClusterCount = int32(diskSize / clusterSize)
-	superBlock.InodeCount = int32(diskSize / BytesPerInode)
+	superBlock.DiskSize = diskSize
+	superBlock.ClusterSize = clusterSize
+	superBlock.InodeCount = int32(min(diskSize/BytesPerInode, MaxInodeCount))
 
 	//divided by 8 because for example: 1000 blocks = 1000 bits and i need to calculate how many bytes i need for 1000bits
-	superBlock.BitmapSize = int32(math.Ceil(float64(superBlock.ClusterCount) / 8.0))
+	//the data bitmap is sized for the whole disk, the metadata takes a few clusters of it
+	superBlock.BitmapSize = int32(math.Ceil(float64(diskSize/int64(clusterSize)) / 8.0))
 	superBlock.BitmapiSize = int32(math.Ceil(float64(superBlock.InodeCount) / 8.0))
 
-	superBlock.BitmapStartAddress = int32(binary.Size(superBlock))
-	superBlock.BitmapiStartAddress = superBlock.BitmapStartAddress + int32(superBlock.BitmapSize)
-	superBlock.InodeStartAddress = superBlock.BitmapiStartAddress + int32(superBlock.BitmapiSize)
-	superBlock.DataStartAddress = superBlock.InodeStartAddress + superBlock.InodeCount*int32(binary.Size(pseudoInode))
-	return superBlock
+	superBlock.BitmapStartAddress = int64(binary.Size(superBlock))
+	superBlock.BitmapiStartAddress = superBlock.BitmapStartAddress + int64(superBlock.BitmapSize)
+	superBlock.InodeStartAddress = superBlock.BitmapiStartAddress + int64(superBlock.BitmapiSize)
+	inodesEnd := superBlock.InodeStartAddress + int64(superBlock.InodeCount)*int64(binary.Size(pseudoInode))
+	superBlock.DataStartAddress = (inodesEnd + int64(clusterSize) - 1) / int64(clusterSize) * int64(clusterSize)
+	if superBlock.InodeCount == 0 || superBlock.DataStartAddress >= diskSize {
+		return Superblock{}, fmt.Errorf("disk size %d is too small for the filesystem metadata", diskSize)
+	}
+	superBlock.ClusterCount = int32((diskSize - superBlock.DataStartAddress) / int64(clusterSize))
+	return superBlock, nil
 }
 
-// Format formats a filesystem with the specified diskSize and fsName.
+// Format formats a filesystem with the specified diskSize and clusterSize on the given device.
+// flags are the SuperblockFlag... bits the filesystem starts with.
 // It creates a superblock, data bitmap, inode bitmap, and root directory and saves it into the filesystem.
 // The function returns the created superblock, data bitmap, inode bitmap, and any error encountered.
-func Format(diskSize int, fsName string) (Superblock, []uint8, []uint8, error) {
-	totalSize := diskSize
-	superBlock := createSuperBlock(fsName, diskSize, DefaultClusterSize)
+func Format(diskSize int64, clusterSize int32, flags uint32, fp BlockDevice) (Superblock, []uint8, []uint8, error) {
+	superBlock, err := createSuperBlock(diskSize, clusterSize)
+	if err != nil {
+		return Superblock{}, nil, nil, err
+	}
+	superBlock.Flags = flags
 	dataBitmap := CreateBitmap(int(superBlock.BitmapSize))
 	inodeBitmap := CreateBitmap(int(superBlock.BitmapiSize))
 
-	fp, err := os.Create(fsName)
-	if err != nil {
-		return Superblock{}, nil, nil, fmt.Errorf("failed to create file: %v", err)
+	//throw away the old content, the resized device reads as zeros
+	err = fp.Truncate(0)
+	if err == nil {
+		err = fp.Truncate(diskSize)
 	}
-	defer fp.Close()
-
-	err = binary.Write(fp, binary.LittleEndian, &superBlock)
 	if err != nil {
-		return Superblock{}, nil, nil, fmt.Errorf("failed to write superblock: %v", err)
+		return Superblock{}, nil, nil, fmt.Errorf("failed to resize device: %v", err)
 	}
 
-	err = saveBitmap(fp, int64(superBlock.BitmapStartAddress), dataBitmap)
-	if err != nil {
-		return Superblock{}, nil, nil, fmt.Errorf("failed to create data bitmap: %v", err)
-	}
+	dropDentries(fp)
 
-	err = saveBitmap(fp, int64(superBlock.BitmapiStartAddress), inodeBitmap)
+	err = saveSuperBlock(fp, superBlock)
 	if err != nil {
-		return Superblock{}, nil, nil, fmt.Errorf("failed to create inode bitmap: %v", err)
+		return Superblock{}, nil, nil, err
 	}
 
-	_, err = fp.Seek(int64(totalSize-1), 0)
+	err = saveBitmap(fp, superBlock.BitmapStartAddress, dataBitmap)
 	if err != nil {
-		return Superblock{}, nil, nil, fmt.Errorf("failed to seek to end of file: %v", err)
+		return Superblock{}, nil, nil, fmt.Errorf("failed to create data bitmap: %v", err)
 	}
 
-	_, err = fp.Write([]byte{0})
+	err = saveBitmap(fp, superBlock.BitmapiStartAddress, inodeBitmap)
 	if err != nil {
-		return Superblock{}, nil, nil, fmt.Errorf("failed to write to end of file: %v", err)
+		return Superblock{}, nil, nil, fmt.Errorf("failed to create inode bitmap: %v", err)
 	}
 
-	_, _, err = CreateDirectory(fp, superBlock, inodeBitmap, dataBitmap, 1)
+	_, _, err = CreateDirectory(fp, superBlock, 1)
 	if err != nil {
 		return Superblock{}, nil, nil, fmt.Errorf("failed to create root directory: %v", err)
 	}
@@ -95,18 +119,23 @@ func Format(diskSize int, fsName string) (Superblock, []uint8, []uint8, error) {
 	return superBlock, dataBitmap, inodeBitmap, nil
 }
 
-// Creates a new inode
+// timeNow returns the time stored into the timestamps of inodes.
+var timeNow = time.Now
+
+// Creates a new inode, both its timestamps are set to the current time
 // Returns the inode and new inode bitmap
-func CreateInode(inodeBitmap []uint8, superBlock Superblock, isDirectory bool, filesize int32) (PseudoInode, []uint8, error) {
+func CreateInode(inodeBitmap []uint8, superBlock Superblock, isDirectory bool, filesize int64) (PseudoInode, []uint8, error) {
 	//inodeBitmap = append([]uint8(nil), inodeBitmap...)
 	inode := PseudoInode{}
 	availableInode, inodeBitmapNew, err := GetAvailableInodeAddress(inodeBitmap, superBlock.InodeStartAddress, int32(binary.Size(PseudoInode{})))
 	if err != nil {
 		return PseudoInode{}, nil, err
 	}
-	inode.NodeId = 1 + ((availableInode - superBlock.InodeStartAddress) / int32(binary.Size(PseudoInode{}))) //plus 1 because 0 is reserved for free inodes
+	inode.NodeId = 1 + int32((availableInode-superBlock.InodeStartAddress)/int64(binary.Size(PseudoInode{}))) //plus 1 because 0 is reserved for free inodes
 	inode.FileSize = filesize
 	inode.IsDirectory = isDirectory
+	inode.AccessTime = timeNow().UnixNano()
+	inode.ModifyTime = inode.AccessTime
 	//inodeBitmap[(inode.NodeId-1)/8] = setBit(inodeBitmap[(inode.NodeId-1)/8], uint8((inode.NodeId-1)%8), true)
 	return inode, inodeBitmapNew, nil
 }
@@ -120,25 +149,38 @@ func mapDataToInode(superBlock Superblock, inode *PseudoInode, availableDataBloc
 	IndirectOne := SinglyIndirectBlock{}
 	IndirectTwo := DoublyIndirectBlock{}
 
-	doublyIndirectBlockNeeded := 0
 	//one singly will belong in indirect 1 and other singlys will belong in indirect 2
 	singlyIndirectBlockNeeded := int(math.Ceil(float64(len(availableDataBlocks)-directAddrLen) / float64(addrInOneBlock)))
-	if singlyIndirectBlockNeeded > 1 {
+	singlyIndirectBlocks := make([]SinglyIndirectBlock, max(singlyIndirectBlockNeeded, 0))
+	//a singly block which points only to holes is a hole too and gets no cluster
+	extraBlocksNeeded := 0
+	for i := range singlyIndirectBlocks {
+		startIndex := directAddrLen + i*int(addrInOneBlock)
+		endIndex := min(startIndex+int(addrInOneBlock), len(availableDataBlocks))
+		singlyIndirectBlocks[i].Pointers = make([]int32, endIndex-startIndex)
+		copy(singlyIndirectBlocks[i].Pointers, availableDataBlocks[startIndex:endIndex])
+		if slices.ContainsFunc(singlyIndirectBlocks[i].Pointers, func(p int32) bool { return p != 0 }) {
+			singlyIndirectBlocks[i].Address = -1
+			extraBlocksNeeded++
+		}
+	}
+	doublyIndirectBlockNeeded := 0
+	if len(singlyIndirectBlocks) > 1 && slices.ContainsFunc(singlyIndirectBlocks[1:], func(b SinglyIndirectBlock) bool { return b.Address != 0 }) {
 		doublyIndirectBlockNeeded++
 	}
 
 	//addrInLastBlock := singlyIndirectBlockNeeded*int(addrInOneBlock) - (len(availableDataBlocks) - directAddrLen)
 	//lastBlockDataLen := (int(inode.FileSize) - int(dataMaxBlocks-1)*int(blockSize))
 	//pointingToDataBlocks := singlyIndirectBlockNeeded * int(addrInOneBlock)
-	extraBlocksNeeded := doublyIndirectBlockNeeded + singlyIndirectBlockNeeded
-	extraBlocksSize := extraBlocksNeeded * int(superBlock.ClusterSize)
+	extraBlocksNeeded += doublyIndirectBlockNeeded
+	extraBlocksSize := int64(extraBlocksNeeded) * int64(superBlock.ClusterSize)
 
 	//number of addresses pointing to data blocks vs amount of data blocks for data
-	if int(addrInOneBlock*addrInOneBlock+addrInOneBlock)+directAddrLen < len(availableDataBlocks) {
-		return SinglyIndirectBlock{}, DoublyIndirectBlock{}, nil, fmt.Errorf("file is too big (not enough references available)")
+	if int(addrInOneBlock)*int(addrInOneBlock)+int(addrInOneBlock)+directAddrLen < len(availableDataBlocks) {
+		return SinglyIndirectBlock{}, DoublyIndirectBlock{}, nil, ErrFileTooBig
 	}
 
-	extraDataBlocks, dataBitmapNew, err := GetAvailableDataBlocks(dataBitmap, superBlock.DataStartAddress, int32(extraBlocksSize), superBlock.ClusterSize)
+	extraDataBlocks, dataBitmapNew, err := GetAvailableDataBlocks(dataBitmap, superBlock, extraBlocksSize)
 	if err != nil {
 		return SinglyIndirectBlock{}, DoublyIndirectBlock{}, nil, err
 	}
@@ -146,20 +188,12 @@ func mapDataToInode(superBlock Superblock, inode *PseudoInode, availableDataBloc
 	copy(inode.Direct[:], availableDataBlocks)
 
 	if len(extraDataBlocks) != 0 {
-		remainingDataBlocks := availableDataBlocks[directAddrLen:]
-
-		singlyIndirectBlocks := make([]SinglyIndirectBlock, singlyIndirectBlockNeeded)
-		for i := 0; i < singlyIndirectBlockNeeded; i++ {
-			startIndex := i * int(addrInOneBlock)
-			endIndex := (i + 1) * int(addrInOneBlock)
-			if i == singlyIndirectBlockNeeded-1 {
-				singlyIndirectBlocks[i].Pointers = make([]int32, len(remainingDataBlocks[startIndex:]))
-				copy(singlyIndirectBlocks[i].Pointers, remainingDataBlocks[startIndex:])
-			} else {
-				singlyIndirectBlocks[i].Pointers = make([]int32, len(remainingDataBlocks[startIndex:endIndex]))
-				copy(singlyIndirectBlocks[i].Pointers, remainingDataBlocks[startIndex:endIndex])
+		next := 0
+		for i := range singlyIndirectBlocks {
+			if singlyIndirectBlocks[i].Address != 0 {
+				singlyIndirectBlocks[i].Address = extraDataBlocks[next]
+				next++
 			}
-			singlyIndirectBlocks[i].Address = extraDataBlocks[i]
 		}
 
 		doublyIndirectBlock := DoublyIndirectBlock{}
@@ -181,28 +215,29 @@ func mapDataToInode(superBlock Superblock, inode *PseudoInode, availableDataBloc
 
 // Writes data into the file system given available data blocks for the data.
 // If the data is larger than the available data blocks, data will be truncated.
+// The data of a zero block (a hole) are not written.
 //
 // Use GetAvailableDataBlocks() method to get correct amount of data blocks needed for the data.
 // Returns the number of bytes written and an error if any.
-func saveDataBlocks(src []byte, destPtr *os.File, superBlock Superblock, availableDataBlocks []int32) (int, error) {
+func saveDataBlocks(src []byte, destPtr BlockDevice, superBlock Superblock, availableDataBlocks []int32) (int, error) {
 	data := src
 	bytesWritten := 0
 	for i, v := range availableDataBlocks {
-		var writeData []byte
-		if i == 0 {
-			writeData = data[:]
-		} else if i == len(availableDataBlocks)-1 {
-			writeData = data[i*int(superBlock.ClusterSize):]
-		} else {
-			writeData = data[i*int(superBlock.ClusterSize) : i*int(superBlock.ClusterSize)+int(superBlock.ClusterSize)]
+		start := i * int(superBlock.ClusterSize)
+		if start >= len(data) {
+			break
+		}
+		if v == 0 {
+			continue
 		}
+		writeData := data[start:min(start+int(superBlock.ClusterSize), len(data))]
 
-		_, err2 := destPtr.Seek(int64(v), 0)
-		err := binary.Write(destPtr, binary.LittleEndian, writeData)
+		traceIO(destPtr, "saveDataBlocks", true, ClusterAddress(superBlock, v), len(writeData))
+		_, err := destPtr.WriteAt(writeData, ClusterAddress(superBlock, v))
 		bytesWritten += int(superBlock.ClusterSize)
 
-		if err2 != nil || err != nil {
-			return 0, fmt.Errorf("could not write into datablock: %v, %v", err, err2)
+		if err != nil {
+			return 0, fmt.Errorf("could not write into datablock: %v", err)
 		}
 	}
 
@@ -212,101 +247,295 @@ func saveDataBlocks(src []byte, destPtr *os.File, superBlock Superblock, availab
 // saveIndirectData handles writing required indirect pointers into the file system.
 // In other words, handles writing SinglyIndirectBlock and DoublyIndirectBlock into file system.
 // Returns an error if there is any issue writing the data to the file system.
-func saveIndirectData(fs *os.File, inode PseudoInode, singlyIndirectBlock SinglyIndirectBlock, doublyIndirectBlock DoublyIndirectBlock) error {
+func saveIndirectData(fs BlockDevice, superBlock Superblock, singlyIndirectBlock SinglyIndirectBlock, doublyIndirectBlock DoublyIndirectBlock) error {
 	//write indirect one
 	if singlyIndirectBlock.Address != 0 {
-		fs.Seek(int64(singlyIndirectBlock.Address), 0)
-		err := binary.Write(fs, binary.LittleEndian, singlyIndirectBlock.Pointers)
+		err := writePointerBlock(fs, superBlock, singlyIndirectBlock.Address, singlyIndirectBlock.Pointers)
 		if err != nil {
-			return fmt.Errorf("could not write into datablock: %v", err)
+			return err
 		}
 	}
 
 	//write indirect two
 	if doublyIndirectBlock.Address != 0 {
-		doublyIndirectBlockPointers := make([]int32, len(doublyIndirectBlock.Pointers))
+		doublyIndirectBlockPointers := make([]int32, 0, len(doublyIndirectBlock.Pointers))
 		for _, singlyIndirectBlock := range doublyIndirectBlock.Pointers {
 			doublyIndirectBlockPointers = append(doublyIndirectBlockPointers, singlyIndirectBlock.Address)
-			fs.Seek(int64(singlyIndirectBlock.Address), 0)
-			err := binary.Write(fs, binary.LittleEndian, singlyIndirectBlock.Pointers)
+			if singlyIndirectBlock.Address == 0 {
+				continue
+			}
+			err := writePointerBlock(fs, superBlock, singlyIndirectBlock.Address, singlyIndirectBlock.Pointers)
 			if err != nil {
-				return fmt.Errorf("could not write into datablock: %v", err)
+				return err
 			}
 		}
-		fs.Seek(int64(doublyIndirectBlock.Address), 0)
-		err := binary.Write(fs, binary.LittleEndian, doublyIndirectBlockPointers)
+		err := writePointerBlock(fs, superBlock, doublyIndirectBlock.Address, doublyIndirectBlockPointers)
 		if err != nil {
-			return fmt.Errorf("could not write into datablock: %v", err)
+			return err
 		}
 	}
 
 	return nil
 }
 
-// WriteAndSaveData writes and saves data to the file system.
+// writePointerBlock writes the pointers into the indirect block at the given cluster, the rest of the cluster
+// is filled with zeros. The cluster may hold data of a freed file, which must not be taken for pointers.
+func writePointerBlock(fs BlockDevice, superBlock Superblock, cluster int32, pointers []int32) error {
+	block := make([]int32, pointersPerCluster(superBlock))
+	copy(block, pointers)
+	traceIO(fs, "saveIndirectData", true, ClusterAddress(superBlock, cluster), len(block)*AddressByteLen)
+	err := writeStruct(fs, ClusterAddress(superBlock, cluster), block)
+	if err != nil {
+		return fmt.Errorf("could not write into datablock: %v", err)
+	}
+	return nil
+}
+
+// WriteAndSaveData writes and saves data to the file system as a new file (or directory).
+// The bitmaps are loaded from the file system while the allocator is locked.
+// If there is not enough space, files are purged from the trash until the data fit or the trash is empty.
 // It returns the number of bytes written, the inode ID of the new file, and an error if any.
-func WriteAndSaveData(src []byte, destPtr *os.File, superBlock Superblock, inodeBitmap []uint8, dataBitmap []uint8, isDirectory bool) (int, int, error) {
-	bytesWritten := 0
-	data := src
-	//Create inode, get new inodebitmap
-	inode, inodeBitmap, err := CreateInode(inodeBitmap, superBlock, isDirectory, int32(len(data)))
+func WriteAndSaveData(src []byte, destPtr BlockDevice, superBlock Superblock, isDirectory bool) (int, int, error) {
+	var bytesWritten, inodeId int
+	err := purgeTrashOnNoSpace(destPtr, superBlock, func() error {
+		var err error
+		bytesWritten, inodeId, err = writeNewFile(src, destPtr, superBlock, isDirectory, 0)
+		return err
+	})
+	return bytesWritten, inodeId, err
+}
+
+// writeNewFile is WriteAndSaveData without purging the trash, for callers which hold the lock of a directory.
+func writeNewFile(src []byte, destPtr BlockDevice, superBlock Superblock, isDirectory bool, flags uint8) (int, int, error) {
+	defer lockAlloc(destPtr)()
+	inodeBitmap, dataBitmap, err := loadBitmaps(destPtr, superBlock)
 	if err != nil {
 		return 0, 0, err
 	}
-	//get datablocks needed
-	availableDataBlocks, dataBitmap, err := GetAvailableDataBlocks(dataBitmap, superBlock.DataStartAddress, int32(len(data)), superBlock.ClusterSize)
+	return writeAndSaveData(src, destPtr, superBlock, inodeBitmap, dataBitmap, isDirectory, flags)
+}
+
+// writeAndSaveData is WriteAndSaveData with the given bitmaps, the caller must hold the allocator lock.
+// flags are the InodeFlag... bits the new inode starts with.
+func writeAndSaveData(src []byte, destPtr BlockDevice, superBlock Superblock, inodeBitmap []uint8, dataBitmap []uint8, isDirectory bool, flags uint8) (int, int, error) {
+	data := src
+	//Create inode, get new inodebitmap
+	inode, inodeBitmap, err := CreateInode(inodeBitmap, superBlock, isDirectory, int64(len(data)))
 	if err != nil {
 		return 0, 0, err
 	}
+	inode.Flags = flags
 
 	//save data, get new databitmap
-	bytesWritten, err = saveDataBlocks(data, destPtr, superBlock, availableDataBlocks)
+	bytesWritten, dataBitmap, err := storeFileData(data, destPtr, superBlock, &inode, dataBitmap)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	/* 	//dataBitmap gets modified
-	   	indirectBlockOne, indirectBlockTwo, dataBitmap, err := mapDataInode(superBlock, &inode, availableDataBlocks, dataBitmap)
-	   	if err != nil {
-	   		return 0, 0, err
-	   	}
-
-	   	err = saveIndirectData(destPtr, inode, indirectBlockOne, indirectBlockTwo)
-	   	if err != nil {
-	   		return 0, 0, err
-	   	} */
-
-	singlyIndirectBlock, doublyIndirectBlock, dataBitmap, err := mapDataToInode(superBlock, &inode, availableDataBlocks, dataBitmap)
+	err = saveInode(destPtr, superBlock.InodeStartAddress, inode)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	err = saveIndirectData(destPtr, inode, singlyIndirectBlock, doublyIndirectBlock)
+	err = saveBitmap(destPtr, superBlock.BitmapStartAddress, dataBitmap)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	err = saveInode(destPtr, int64(superBlock.InodeStartAddress), inode)
+	err = saveBitmap(destPtr, superBlock.BitmapiStartAddress, inodeBitmap)
 	if err != nil {
 		return 0, 0, err
 	}
+	stats.inodesAllocated.Add(1)
+	return bytesWritten, int(inode.NodeId), nil
+}
+
+// storeFileData stores the data of a file whose inode has no data yet and sets the size and pointers of the inode.
+// Files up to InlineDataSize bytes are stored inline in the inode, larger files and directories in data blocks
+// allocated from the given bitmap. The inode is not saved.
+// It returns the number of bytes written into data blocks and the new data bitmap.
+func storeFileData(data []byte, destPtr BlockDevice, superBlock Superblock, inode *PseudoInode, dataBitmap []uint8) (int, []uint8, error) {
+	inode.FileSize = int64(len(data))
+	if !inode.IsDirectory && len(data) <= InlineDataSize {
+		setInlineData(inode, data)
+		return 0, dataBitmap, nil
+	}
+
+	//clusters of a regular file which hold only zeros are not allocated, they stay holes
+	clusterSize := int(superBlock.ClusterSize)
+	clusterCount := (len(data) + clusterSize - 1) / clusterSize
+	holes := make([]bool, clusterCount)
+	needed := clusterCount
+	if mayHaveHoles(*inode) {
+		for i := range holes {
+			holes[i] = isZero(data[i*clusterSize : min((i+1)*clusterSize, len(data))])
+			if holes[i] {
+				needed--
+			}
+		}
+	}
+
+	//get datablocks needed
+	allocated, dataBitmap, err := GetAvailableDataBlocks(dataBitmap, superBlock, int64(needed)*int64(clusterSize))
+	if err != nil {
+		return 0, nil, err
+	}
+	availableDataBlocks := make([]int32, clusterCount)
+	for i := range availableDataBlocks {
+		if !holes[i] {
+			availableDataBlocks[i], allocated = allocated[0], allocated[1:]
+		}
+	}
 
-	err = saveBitmap(destPtr, int64(superBlock.BitmapStartAddress), dataBitmap)
+	bytesWritten, err := saveDataBlocks(data, destPtr, superBlock, availableDataBlocks)
 	if err != nil {
-		return 0, 0, err
+		return 0, nil, err
 	}
 
-	err = saveBitmap(destPtr, int64(superBlock.BitmapiStartAddress), inodeBitmap)
+	singlyIndirectBlock, doublyIndirectBlock, dataBitmap, err := mapDataToInode(superBlock, inode, availableDataBlocks, dataBitmap)
 	if err != nil {
-		return 0, 0, err
+		return 0, nil, err
 	}
-	return bytesWritten, int(inode.NodeId), nil
+
+	err = saveIndirectData(destPtr, superBlock, singlyIndirectBlock, doublyIndirectBlock)
+	if err != nil {
+		return 0, nil, err
+	}
+	return bytesWritten, dataBitmap, nil
+}
+
+// WriteFileData replaces the content of the file with the given inode id, the file keeps its inode.
+// A file which grows over InlineDataSize moves from the inode into data blocks and a file which shrinks moves back.
+// The new data blocks are allocated before the old ones are freed, so the file stays whole if there is not enough space.
+// Then files are purged from the trash and the write is tried again.
+func WriteFileData(destPtr BlockDevice, inodeId int32, data []byte, superBlock Superblock) error {
+	return purgeTrashOnNoSpace(destPtr, superBlock, func() error {
+		return rewriteFileData(destPtr, inodeId, data, superBlock)
+	})
+}
+
+// WriteFileDataIfUnchanged is WriteFileData which replaces the content only if the file still has the given
+// modification time, that is nothing changed it since it was read. It returns ErrFileChanged otherwise,
+// also if the file was deleted.
+func WriteFileDataIfUnchanged(destPtr BlockDevice, inodeId int32, data []byte, modifyTime int64, superBlock Superblock) error {
+	return purgeTrashOnNoSpace(destPtr, superBlock, func() error {
+		defer lockInode(destPtr, inodeId)()
+		inode, err := LoadInode(destPtr, inodeId, superBlock.InodeStartAddress)
+		if err != nil {
+			return err
+		}
+		if inode.NodeId != inodeId || inode.ModifyTime != modifyTime {
+			return ErrFileChanged
+		}
+		return writeFileData(destPtr, &inode, data, superBlock)
+	})
+}
+
+// rewriteFileData is WriteFileData without purging the trash, for callers which hold the lock of a directory.
+func rewriteFileData(destPtr BlockDevice, inodeId int32, data []byte, superBlock Superblock) error {
+	defer lockInode(destPtr, inodeId)()
+	inode, err := LoadInode(destPtr, inodeId, superBlock.InodeStartAddress)
+	if err != nil {
+		return err
+	}
+	if inode.NodeId != inodeId {
+		//the file was deleted, for example purged from the trash to make space
+		return fmt.Errorf("file does not exist")
+	}
+	return writeFileData(destPtr, &inode, data, superBlock)
+}
+
+// writeFileData is WriteFileData for an inode which is already locked. The inode is saved.
+func writeFileData(destPtr BlockDevice, inode *PseudoInode, data []byte, superBlock Superblock) error {
+	defer lockAlloc(destPtr)()
+	dataBitmap, err := LoadBitmap(destPtr, superBlock.BitmapStartAddress, superBlock.BitmapSize)
+	if err != nil {
+		return err
+	}
+	oldDataBlocks, oldIndirectBlocks, err := GetFileClusters(destPtr, *inode, superBlock)
+	if err != nil {
+		return err
+	}
+
+	newInode := *inode
+	newInode.Flags &^= InodeFlagInline
+	newInode.Direct = [12]int32{}
+	newInode.Indirect = [3]int32{}
+	newInode.ModifyTime = timeNow().UnixNano()
+	_, dataBitmap, err = storeFileData(data, destPtr, superBlock, &newInode, dataBitmap)
+	if err != nil {
+		return err
+	}
+	dataBitmap = SetValuesInDataBitmap(dataBitmap, oldDataBlocks, superBlock, false)
+	dataBitmap = SetValuesInDataBitmap(dataBitmap, oldIndirectBlocks, superBlock, false)
+	if SecureDeleteEnabled(superBlock) {
+		err = wipeClusters(destPtr, superBlock, append(oldDataBlocks, oldIndirectBlocks...))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = saveInode(destPtr, superBlock.InodeStartAddress, newInode)
+	if err != nil {
+		return err
+	}
+	*inode = newInode
+	return saveBitmap(destPtr, superBlock.BitmapStartAddress, dataBitmap)
+}
+
+// Touch sets the access and modification time of the inode with the given id to the given time.
+func Touch(destPtr BlockDevice, inodeId int32, t time.Time, superBlock Superblock) error {
+	defer lockInode(destPtr, inodeId)()
+	inode, err := LoadInode(destPtr, inodeId, superBlock.InodeStartAddress)
+	if err != nil {
+		return err
+	}
+	inode.AccessTime = t.UnixNano()
+	inode.ModifyTime = t.UnixNano()
+	return saveInode(destPtr, superBlock.InodeStartAddress, inode)
+}
+
+// mayHaveHoles reports whether clusters of zeros of the inode are left as holes when its data are stored.
+// Only regular files have holes, directories and their indexes are updated in place by writeFileAt,
+// which needs all their clusters allocated.
+func mayHaveHoles(inode PseudoInode) bool {
+	return !inode.IsDirectory && inode.Flags&InodeFlagDirIndex == 0
+}
+
+// isInline reports whether the data of the file are stored in the inode.
+func isInline(inode PseudoInode) bool {
+	return inode.Flags&InodeFlagInline != 0
+}
+
+// inlineData returns the data of a file stored in the inode.
+func inlineData(inode PseudoInode) []byte {
+	data := make([]byte, 0, InlineDataSize)
+	for _, v := range inode.Direct {
+		data = binary.LittleEndian.AppendUint32(data, uint32(v))
+	}
+	for _, v := range inode.Indirect {
+		data = binary.LittleEndian.AppendUint32(data, uint32(v))
+	}
+	return data[:min(int64(len(data)), inode.FileSize)]
+}
+
+// setInlineData stores the data (at most InlineDataSize bytes) in place of the pointers of the inode.
+func setInlineData(inode *PseudoInode, data []byte) {
+	buf := make([]byte, InlineDataSize)
+	copy(buf, data)
+	for i := range inode.Direct {
+		inode.Direct[i] = int32(binary.LittleEndian.Uint32(buf[i*AddressByteLen:]))
+	}
+	for i := range inode.Indirect {
+		inode.Indirect[i] = int32(binary.LittleEndian.Uint32(buf[(len(inode.Direct)+i)*AddressByteLen:]))
+	}
+	inode.Flags |= InodeFlagInline
 }
 
 // PathToInode takes a file system, a path, a superblock, and a current inode as input.
 // It converts a relative or absolute path into an inode, representing the file or directory specified by the path.
 // The function returns the current inode, the parent inode, and an error (if any).
-func PathToInode(fs *os.File, path string, superBlock Superblock, currentInode PseudoInode) (PseudoInode, PseudoInode, error) {
+func PathToInode(fs BlockDevice, path string, superBlock Superblock, currentInode PseudoInode) (PseudoInode, PseudoInode, error) {
 	// Split the path into individual directories and file name
 	directories := strings.Split(filepath.Clean(path), string(os.PathSeparator))
 	fileName := directories[len(directories)-1]
@@ -315,7 +544,7 @@ func PathToInode(fs *os.File, path string, superBlock Superblock, currentInode P
 	i := 0
 
 	if directories[0] == "" {
-		currentInode, err = LoadInode(fs, 1, int64(superBlock.InodeStartAddress))
+		currentInode, err = LoadInode(fs, 1, superBlock.InodeStartAddress)
 		if err != nil {
 			return PseudoInode{}, PseudoInode{}, err
 		}
@@ -332,33 +561,28 @@ func PathToInode(fs *os.File, path string, superBlock Superblock, currentInode P
 			return currentInode, parentInode, nil
 		}
 
-		directory, err := LoadDirectory(fs, currentInode, superBlock)
-		if err != nil {
-			return PseudoInode{}, PseudoInode{}, err
-		}
-
 		if i == len(directories)-1 {
-			dirItemIndex := GetDirItemIndex(directory, fileName)
 			if len(strings.TrimSpace(fileName)) == 0 {
 				return PseudoInode{}, PseudoInode{}, fmt.Errorf("filename is empty")
 			}
-			if dirItemIndex == -1 {
-				return PseudoInode{}, PseudoInode{}, fmt.Errorf("file does not exist")
+			dirItemInodeId, err := LookupDirItem(fs, currentInode.NodeId, fileName, superBlock)
+			if err != nil {
+				return PseudoInode{}, PseudoInode{}, err
 			}
 			parentInode = currentInode
-			currentInode, err := LoadInode(fs, directory[dirItemIndex].Inode, int64(superBlock.InodeStartAddress))
+			currentInode, err := LoadInode(fs, dirItemInodeId, superBlock.InodeStartAddress)
 			if err != nil {
 				return PseudoInode{}, PseudoInode{}, err
 			}
 			return currentInode, parentInode, nil
 		} else {
-			dirItemIndex := GetDirItemIndex(directory, directories[i])
-			if dirItemIndex == -1 {
+			dirItemInodeId, err := LookupDirItem(fs, currentInode.NodeId, directories[i], superBlock)
+			if err != nil {
 				return PseudoInode{}, PseudoInode{}, fmt.Errorf("directory does not exist")
 			}
 
 			parentInode = currentInode
-			currentInode, err = LoadInode(fs, directory[dirItemIndex].Inode, int64(superBlock.InodeStartAddress))
+			currentInode, err = LoadInode(fs, dirItemInodeId, superBlock.InodeStartAddress)
 			if err != nil {
 				return PseudoInode{}, PseudoInode{}, err
 			}
@@ -371,13 +595,18 @@ func PathToInode(fs *os.File, path string, superBlock Superblock, currentInode P
 // GetFileClusters retrieves the clusters of a file given its inode and superblock.
 // It returns two slices: dataAddrs containing the addresses of the data clusters,
 // and indirectPtrAddrs containing the addresses of extra blocks allocated for singly and doubly indirect pointer blocks.
-// The destPtr parameter is a pointer to the os.File object representing the file.
+// The destPtr parameter is the device the filesystem is stored on.
 // The inode parameter is the PseudoInode struct representing the file's inode.
 // The superblock parameter is the Superblock struct representing the file system's superblock.
 // The function returns an error if there was an issue reading the clusters.
-func GetFileClusters(destPtr *os.File, inode PseudoInode, superblock Superblock) ([]int32, []int32, error) {
+// All returned values are cluster numbers, see ClusterAddress. A file stored inline in the inode has no clusters.
+// Holes are not allocated, so they are not in dataAddrs, the data of the file are read by readFileData or readFileAt.
+func GetFileClusters(destPtr BlockDevice, inode PseudoInode, superblock Superblock) ([]int32, []int32, error) {
 	dataAddrs := make([]int32, 0)
 	indirectPtrAddrs := make([]int32, 0)
+	if isInline(inode) {
+		return dataAddrs, indirectPtrAddrs, nil
+	}
 	blocksRead := 0
 	blockSize := superblock.ClusterSize
 	dataMaxBlocks := int(math.Ceil(float64(inode.FileSize) / float64(blockSize)))
@@ -397,7 +626,7 @@ func GetFileClusters(destPtr *os.File, inode PseudoInode, superblock Superblock)
 	//indirect level one
 	if inode.Indirect[0] != 0 {
 		indirectPtrAddrs = append(indirectPtrAddrs, inode.Indirect[0])
-		indirectOneBlockData, err := readBlockInt32(destPtr, int64(inode.Indirect[0]), blockSize)
+		indirectOneBlockData, err := readBlockInt32(destPtr, ClusterAddress(superblock, inode.Indirect[0]), blockSize)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -418,7 +647,7 @@ func GetFileClusters(destPtr *os.File, inode PseudoInode, superblock Superblock)
 	//indirect level two
 	if inode.Indirect[1] != 0 {
 		indirectPtrAddrs = append(indirectPtrAddrs, inode.Indirect[1])
-		indirectTwoBlockDataFirst, err := readBlockInt32(destPtr, int64(inode.Indirect[1]), blockSize)
+		indirectTwoBlockDataFirst, err := readBlockInt32(destPtr, ClusterAddress(superblock, inode.Indirect[1]), blockSize)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -428,7 +657,7 @@ func GetFileClusters(destPtr *os.File, inode PseudoInode, superblock Superblock)
 				continue
 			}
 			indirectPtrAddrs = append(indirectPtrAddrs, addr)
-			indirectTwoBlockDataSecond, err := readBlockInt32(destPtr, int64(addr), blockSize)
+			indirectTwoBlockDataSecond, err := readBlockInt32(destPtr, ClusterAddress(superblock, addr), blockSize)
 			if err != nil {
 				return nil, nil, err
 			}
@@ -449,22 +678,31 @@ func GetFileClusters(destPtr *os.File, inode PseudoInode, superblock Superblock)
 }
 
 // ReadFileData reads the data of a file from the given destination file pointer, inode, and superblock.
+// The inode is locked for reading while its data is read.
 // It returns the file data as a byte slice and an error if any.
-func ReadFileData(destPtr *os.File, inode PseudoInode, superblock Superblock) ([]byte, error) {
-	addresses, _, err := GetFileClusters(destPtr, inode, superblock)
-	blockSize := superblock.ClusterSize
-	dataMaxBlocks := int(math.Ceil(float64(inode.FileSize) / float64(blockSize)))
-	lastBlockDataLen := (int(inode.FileSize) - int(dataMaxBlocks-1)*int(blockSize))
+func ReadFileData(destPtr BlockDevice, inode PseudoInode, superblock Superblock) ([]byte, error) {
+	defer rlockInode(destPtr, inode.NodeId)()
+	return readFileData(destPtr, inode, superblock)
+}
 
-	var data []byte
+// readFileData is ReadFileData without locking the inode. Holes read as zeros.
+func readFileData(destPtr BlockDevice, inode PseudoInode, superblock Superblock) ([]byte, error) {
+	if isInline(inode) {
+		return inlineData(inode), nil
+	}
+	clusters, err := fileClusterList(destPtr, superblock, inode)
 	if err != nil {
 		return nil, err
 	}
-	for i, addr := range addresses {
-		if i == len(addresses)-1 {
-			blockSize = int32(lastBlockDataLen)
+	clusterSize := int64(superblock.ClusterSize)
+	data := make([]byte, 0, inode.FileSize)
+	for i, cluster := range clusters {
+		length := min(clusterSize, inode.FileSize-int64(i)*clusterSize)
+		if cluster == 0 {
+			data = append(data, make([]byte, length)...)
+			continue
 		}
-		blockData, err := readBlock(destPtr, int64(addr), blockSize)
+		blockData, err := readBlock(destPtr, ClusterAddress(superblock, cluster), int32(length))
 		if err != nil {
 			return nil, err
 		}
@@ -479,14 +717,10 @@ func ReadFileData(destPtr *os.File, inode PseudoInode, superblock Superblock) ([
 // The blockAddr parameter specifies the starting address of the block.
 // The blockSize parameter specifies the size of the block in bytes.
 // If an error occurs during the read operation, it is returned along with a nil slice.
-func readBlockInt32(destPtr *os.File, blockAddr int64, blockSize int32) ([]int32, error) {
+func readBlockInt32(destPtr BlockDevice, blockAddr int64, blockSize int32) ([]int32, error) {
 	blockData := make([]int32, blockSize/AddressByteLen)
-	_, err := destPtr.Seek(blockAddr, 0)
-	if err != nil {
-		return nil, err
-	}
-
-	err = binary.Read(destPtr, binary.LittleEndian, &blockData)
+	traceIO(destPtr, "readBlockInt32", false, blockAddr, int(blockSize))
+	err := readStruct(destPtr, blockAddr, blockData)
 	if err != nil {
 		return nil, err
 	}
@@ -496,14 +730,10 @@ func readBlockInt32(destPtr *os.File, blockAddr int64, blockSize int32) ([]int32
 
 // readBlock reads a block of data from the specified file at the given block address.
 // It returns the block data as a byte slice and an error if any.
-func readBlock(destPtr *os.File, blockAddr int64, blockSize int32) ([]byte, error) {
+func readBlock(destPtr BlockDevice, blockAddr int64, blockSize int32) ([]byte, error) {
 	blockData := make([]byte, blockSize)
-	_, err := destPtr.Seek(blockAddr, 0)
-	if err != nil {
-		return nil, err
-	}
-
-	err = binary.Read(destPtr, binary.LittleEndian, &blockData)
+	traceIO(destPtr, "readBlock", false, blockAddr, int(blockSize))
+	_, err := destPtr.ReadAt(blockData, blockAddr)
 	if err != nil {
 		return nil, err
 	}
@@ -511,34 +741,55 @@ func readBlock(destPtr *os.File, blockAddr int64, blockSize int32) ([]byte, erro
 	return blockData, nil
 }
 
-func LoadSuperBlock(fs *os.File) Superblock {
-	fs.Seek(0, 0)
+func LoadSuperBlock(fs BlockDevice) Superblock {
 	superBlock := Superblock{}
-	binary.Read(fs, binary.LittleEndian, &superBlock)
+	traceIO(fs, "LoadSuperBlock", false, 0, binary.Size(superBlock))
+	readStruct(fs, 0, &superBlock)
 	return superBlock
 }
 
-func LoadInode(destPtr *os.File, inodeId int32, inodeStartAddress int64) (PseudoInode, error) {
-	inode := PseudoInode{}
-	_, err2 := destPtr.Seek(inodeStartAddress+int64(binary.Size(inode)*int(inodeId-1)), 0)
+// CheckSuperBlock returns an error if the superblock is not one of an image of this filesystem and version.
+func CheckSuperBlock(superBlock Superblock) error {
+	signature := removeNullCharsFromString(string(superBlock.Signature[:]))
+	if signature != SuperblockSignature || superBlock.Version != SuperblockVersion {
+		return msgError(MsgBadImage, signature, superBlock.Version, SuperblockSignature, SuperblockVersion)
+	}
+	return nil
+}
 
-	err := binary.Read(destPtr, binary.LittleEndian, &inode)
-	if err2 != nil || err != nil || inodeId == 0 {
+// saveSuperBlock writes the superblock at the start of the image.
+func saveSuperBlock(fs BlockDevice, superBlock Superblock) error {
+	traceIO(fs, "saveSuperBlock", true, 0, binary.Size(superBlock))
+	err := writeStruct(fs, 0, &superBlock)
+	if err != nil {
+		return fmt.Errorf("could not write superblock: %v", err)
+	}
+	return nil
+}
+
+func LoadInode(destPtr BlockDevice, inodeId int32, inodeStartAddress int64) (PseudoInode, error) {
+	inode := PseudoInode{}
+	if inodeId == 0 {
+		return PseudoInode{}, fmt.Errorf("could not read inode: invalid inode id")
+	}
+	traceIO(destPtr, "LoadInode", false, inodeStartAddress+int64(binary.Size(inode)*int(inodeId-1)), binary.Size(inode))
+	err := readStruct(destPtr, inodeStartAddress+int64(binary.Size(inode)*int(inodeId-1)), &inode)
+	if err != nil {
 		return PseudoInode{}, fmt.Errorf("could not read inode: %v", err)
 	}
 	return inode, nil
 }
 
-func saveInode(destPtr *os.File, inodeStartAddress int64, inode PseudoInode) error {
-	_, err2 := destPtr.Seek(int64(inodeStartAddress+int64(binary.Size(inode))*int64(inode.NodeId-1)), 0)
-	err := binary.Write(destPtr, binary.LittleEndian, &inode)
-	if err2 != nil || err != nil {
+func saveInode(destPtr BlockDevice, inodeStartAddress int64, inode PseudoInode) error {
+	traceIO(destPtr, "saveInode", true, inodeStartAddress+int64(binary.Size(inode))*int64(inode.NodeId-1), binary.Size(inode))
+	err := writeStruct(destPtr, inodeStartAddress+int64(binary.Size(inode))*int64(inode.NodeId-1), &inode)
+	if err != nil {
 		return fmt.Errorf("could not write inode: %v", err)
 	}
 	return nil
 }
 
-func IsInodeDirectory(destPtr *os.File, inodeId int32, inodeStartAddress int64) (bool, error) {
+func IsInodeDirectory(destPtr BlockDevice, inodeId int32, inodeStartAddress int64) (bool, error) {
 	inode, err := LoadInode(destPtr, inodeId, inodeStartAddress)
 	if err != nil {
 		return false, err
@@ -548,11 +799,21 @@ func IsInodeDirectory(destPtr *os.File, inodeId int32, inodeStartAddress int64)
 
 // CreateDirectory creates a new directory in the file system.
 // It returns the bytes written to the file system, the inode ID of the new directory, and an error if any.
-func CreateDirectory(destPtr *os.File, superBlock Superblock, inodeBitmap []uint8, dataBitmap []uint8, parentNodeId int32) (int, int, error) {
+func CreateDirectory(destPtr BlockDevice, superBlock Superblock, parentNodeId int32) (int, int, error) {
 	buf := new(bytes.Buffer)
 
+	//the allocator stays locked, so the inode id found here is the one the directory gets
+	defer lockAlloc(destPtr)()
+	inodeBitmap, dataBitmap, err := loadBitmaps(destPtr, superBlock)
+	if err != nil {
+		return 0, 0, err
+	}
+
 	//create inode (but dont save it into FS) so i can get free inode id
-	inode, _, err := CreateInode(inodeBitmap, superBlock, true, int32(binary.Size(buf.Bytes())))
+	inode, _, err := CreateInode(inodeBitmap, superBlock, true, int64(binary.Size(buf.Bytes())))
+	if err != nil {
+		return 0, 0, err
+	}
 	dir := make([]DirectoryItem, superBlock.ClusterSize/int32(binary.Size(DirectoryItem{})))
 	copy(dir[1].ItemName[:], []byte("."))
 	copy(dir[0].ItemName[:], []byte(".."))
@@ -565,28 +826,118 @@ func CreateDirectory(destPtr *os.File, superBlock Superblock, inodeBitmap []uint
 		return 0, 0, err
 	}
 
-	return WriteAndSaveData(buf.Bytes(), destPtr, superBlock, inodeBitmap, dataBitmap, true)
+	return writeAndSaveData(buf.Bytes(), destPtr, superBlock, inodeBitmap, dataBitmap, true, 0)
 }
 
 // GetDirItemIndex returns the index of a directory item with the given name in the provided directory.
 // If the item is not found, it returns -1.
 func GetDirItemIndex(dir []DirectoryItem, dirItemName string) int {
+	key, ok := dirItemKey(dirItemName)
+	if !ok {
+		return -1
+	}
 	for i, v := range dir {
-		if removeNullCharsFromString(string(v.ItemName[:])) == dirItemName {
+		if v.Inode != 0 && v.ItemName == key {
 			return i
 		}
 	}
 	return -1
 }
 
+// dirItemKey returns the name as it is stored in a directory item.
+// It returns false for names which cannot be stored (longer than the item name), they are never found.
+func dirItemKey(dirItemName string) ([12]byte, bool) {
+	var key [12]byte
+	if len(dirItemName) > len(key) {
+		return key, false
+	}
+	copy(key[:], dirItemName)
+	return key, true
+}
+
+// checkItemName returns ErrNameTooLong if the name does not fit into a directory item.
+// AddDirItem shortens such names, so they could not be found again.
+func checkItemName(name string) error {
+	if _, ok := dirItemKey(name); !ok {
+		return fmt.Errorf("%s: %w (at most %d bytes)", name, ErrNameTooLong, len(DirectoryItem{}.ItemName))
+	}
+	return nil
+}
+
+// readDirItem reads the item at the given position of the directory.
+func readDirItem(fs BlockDevice, superBlock Superblock, dirInode PseudoInode, position int64) (DirectoryItem, error) {
+	item := DirectoryItem{}
+	err := readFileStruct(fs, superBlock, dirInode, position*int64(binary.Size(item)), &item)
+	return item, err
+}
+
+// writeDirItem writes the item at the given position of the directory.
+func writeDirItem(fs BlockDevice, superBlock Superblock, dirInode PseudoInode, position int64, item DirectoryItem) error {
+	return writeFileStruct(fs, superBlock, dirInode, position*int64(binary.Size(item)), &item)
+}
+
+// dirItemPosition finds the item with the given name in the directory using the index of the directory if it has one.
+// It returns the position of the item and the item, the position is -1 if the directory does not contain the name.
+func dirItemPosition(fs BlockDevice, dirInode PseudoInode, dirItemName string, superBlock Superblock) (int64, DirectoryItem, error) {
+	key, ok := dirItemKey(dirItemName)
+	if !ok {
+		return -1, DirectoryItem{}, nil
+	}
+	if dirInode.DirIndex != 0 {
+		return dirIndexLookup(fs, superBlock, dirInode, key)
+	}
+	dir, err := loadDirectory(fs, dirInode, superBlock)
+	if err != nil {
+		return -1, DirectoryItem{}, err
+	}
+	i := GetDirItemIndex(dir, dirItemName)
+	if i == -1 {
+		return -1, DirectoryItem{}, nil
+	}
+	return int64(i), dir[i], nil
+}
+
+// LookupDirItem returns the inode id of the item with the given name in the directory with the given inode id.
+// Resolved items are remembered in the dentry cache, so repeated lookups do not read the directory.
+func LookupDirItem(fs BlockDevice, dirInodeId int32, dirItemName string, superBlock Superblock) (int32, error) {
+	defer rlockInode(fs, dirInodeId)()
+	return lookupDirItem(fs, dirInodeId, dirItemName, superBlock)
+}
+
+// lookupDirItem is LookupDirItem for a directory which is already locked.
+func lookupDirItem(fs BlockDevice, dirInodeId int32, dirItemName string, superBlock Superblock) (int32, error) {
+	if inodeId, ok := lookupDentry(fs, dirInodeId, dirItemName); ok {
+		return inodeId, nil
+	}
+	dirInode, err := LoadInode(fs, dirInodeId, superBlock.InodeStartAddress)
+	if err != nil {
+		return 0, err
+	}
+	position, item, err := dirItemPosition(fs, dirInode, dirItemName, superBlock)
+	if err != nil {
+		return 0, err
+	}
+	if position == -1 {
+		return 0, fmt.Errorf("file does not exist")
+	}
+	addDentry(fs, dirInodeId, dirItemName, item.Inode)
+	return item.Inode, nil
+}
+
 // LoadDirectory loads the directory items from the specified inode. It does not check if the inode is a directory.
 // It returns a slice of DirectoryItem and an error if any.
-func LoadDirectory(fs *os.File, dirInode PseudoInode, superBlock Superblock) ([]DirectoryItem, error) {
+func LoadDirectory(fs BlockDevice, dirInode PseudoInode, superBlock Superblock) ([]DirectoryItem, error) {
+	defer rlockInode(fs, dirInode.NodeId)()
+	return loadDirectory(fs, dirInode, superBlock)
+}
+
+// loadDirectory is LoadDirectory without locking the directory.
+func loadDirectory(fs BlockDevice, dirInode PseudoInode, superBlock Superblock) ([]DirectoryItem, error) {
 	buf := new(bytes.Buffer)
 
-	dir := make([]DirectoryItem, superBlock.ClusterSize/int32(binary.Size(DirectoryItem{})))
+	dir := make([]DirectoryItem, dirInode.FileSize/int64(binary.Size(DirectoryItem{})))
 
-	dirInBytes, err := ReadFileData(fs, dirInode, superBlock)
+	dirInBytes, err := readFileData(fs, dirInode, superBlock)
 	if err != nil {
 		return nil, err
 	}
@@ -603,94 +954,123 @@ func LoadDirectory(fs *os.File, dirInode PseudoInode, superBlock Superblock) ([]
 	return dir, nil
 }
 
-func IsDirectoryFull(fs *os.File, dirInode PseudoInode, superBlock Superblock) (bool, error) {
+// IsDirectoryFull reports whether there is no free item left in the directory.
+func IsDirectoryFull(fs BlockDevice, dirInode PseudoInode, superBlock Superblock) (bool, error) {
 	dir, err := LoadDirectory(fs, dirInode, superBlock)
 	if err != nil {
 		return false, err
 	}
+	return isDirectoryFull(dir), nil
+}
+
+// isDirectoryFull reports whether there is no free item left in the loaded directory.
+func isDirectoryFull(dir []DirectoryItem) bool {
 	for i, v := range dir {
 		if i == 0 || i == 1 {
 			continue
 		}
 		if v.Inode == 0 {
-			return false, nil
+			return false
 		}
 	}
-	return true, nil
+	return true
 }
 
 // AddDirItem adds a directory item to the specified directory.
 // It takes the directory inode ID, ID of the item to be added to the directory and its name,
 // the file system, and the superblock as parameters.
+// A name longer than an item name is shortened. A full directory grows by one cluster and a directory
+// which grows over DirIndexThreshold items gets a hashed index. If there is not enough space for that, files are
+// purged from the trash, unless the item is in the trash itself.
+// An item which is not in any directory yet (a new file or directory) is deleted if it cannot be added.
 // It returns an error if any operation fails.
-func AddDirItem(dirInodeId int32, dirItemNodeId int32, dirItemName string, fs *os.File, superBlock Superblock) error {
-	newDataBuf := new(bytes.Buffer)
+func AddDirItem(dirInodeId int32, dirItemNodeId int32, dirItemName string, fs BlockDevice, superBlock Superblock) error {
+	dirItemInode, err := LoadInode(fs, dirItemNodeId, superBlock.InodeStartAddress)
+	if err != nil {
+		return err
+	}
+	add := func() error {
+		return addDirItem(dirInodeId, dirItemNodeId, dirItemName, fs, superBlock)
+	}
+	err = add()
+	//purging the file which is being added would lose it
+	if errors.Is(err, ErrNoSpace) && !isTrashed(fs, dirItemNodeId, superBlock) {
+		err = purgeTrashOnNoSpace(fs, superBlock, add)
+	}
+	//a new file or directory which cannot be added is deleted, nothing else would ever free it
+	if err != nil && dirItemInode.References <= 0 {
+		DeleteFile(fs, dirItemInode, superBlock)
+	}
+	return err
+}
+
+// addDirItem is AddDirItem without purging the trash and deleting the item, the locks are held only inside it.
+func addDirItem(dirInodeId int32, dirItemNodeId int32, dirItemName string, fs BlockDevice, superBlock Superblock) error {
 	dirItem := DirectoryItem{}
 	dirItem.Inode = dirItemNodeId
 	copy(dirItem.ItemName[:], []byte(dirItemName))
+	dirItemName = removeNullCharsFromString(string(dirItem.ItemName[:]))
 
-	currentDirInode, err := LoadInode(fs, dirInodeId, int64(superBlock.InodeStartAddress))
-	if err != nil {
-		return err
+	defer lockInode(fs, dirInodeId)()
+	if dirItemNodeId != dirInodeId {
+		defer lockInode(fs, dirItemNodeId)()
 	}
 
-	dirItemInode, err := LoadInode(fs, dirItemNodeId, int64(superBlock.InodeStartAddress))
+	currentDirInode, err := LoadInode(fs, dirInodeId, superBlock.InodeStartAddress)
 	if err != nil {
 		return err
 	}
-	dirItemInode.References++
 
-	currentDir, err := LoadDirectory(fs, currentDirInode, superBlock)
+	dirItemInode, err := LoadInode(fs, dirItemNodeId, superBlock.InodeStartAddress)
 	if err != nil {
 		return err
 	}
+	dirItemInode.References++
 
-	usedDataBlocks, _, err := GetFileClusters(fs, currentDirInode, superBlock)
+	existing, _, err := dirItemPosition(fs, currentDirInode, dirItemName, superBlock)
 	if err != nil {
 		return err
 	}
+	if existing != -1 {
+		return ErrExist
+	}
 
-	isFull, err := IsDirectoryFull(fs, currentDirInode, superBlock)
+	position, err := freeDirItemPosition(fs, currentDirInode, superBlock)
 	if err != nil {
 		return err
 	}
-	if isFull {
-		return fmt.Errorf("directory is full")
-	}
-
-	if GetDirItemIndex(currentDir, dirItemName) > -1 {
-		dirItemInode.References--
-		if dirItemInode.References <= 0 {
-			DeleteFile(fs, dirItemInode, superBlock)
+	if position == -1 {
+		position = currentDirInode.FileSize / int64(binary.Size(DirectoryItem{}))
+		_, err = appendFileCluster(fs, superBlock, &currentDirInode)
+		if err != nil {
+			return fmt.Errorf("directory is full: %w", err)
 		}
-		return fmt.Errorf("file with same name already exists")
 	}
 
-	for i, v := range currentDir {
-		if i == 0 || i == 1 {
-			continue
-		}
-		if v.Inode == 0 {
-			currentDir[i] = dirItem
-			break
-		}
-	}
-	err = binary.Write(newDataBuf, binary.LittleEndian, currentDir)
+	err = writeDirItem(fs, superBlock, currentDirInode, position, dirItem)
 	if err != nil {
 		return err
 	}
+	forgetDentry(fs, dirInodeId, dirItemName)
 
-	_, err = saveDataBlocks(newDataBuf.Bytes(), fs, superBlock, usedDataBlocks)
+	if currentDirInode.DirIndex != 0 {
+		err = dirIndexInsert(fs, superBlock, &currentDirInode, dirItem.ItemName, position)
+	} else if currentDirInode.FileSize/int64(binary.Size(DirectoryItem{})) > DirIndexThreshold {
+		err = buildDirIndex(fs, superBlock, &currentDirInode)
+	}
 	if err != nil {
-		return err
+		//the item is taken back, a directory must not list an item its index does not know
+		writeDirItem(fs, superBlock, currentDirInode, position, DirectoryItem{})
+		forgetDentry(fs, dirInodeId, dirItemName)
+		return fmt.Errorf("could not update directory index: %w", err)
 	}
-
-	err = saveInode(fs, int64(superBlock.InodeStartAddress), currentDirInode)
+	currentDirInode.ModifyTime = timeNow().UnixNano()
+	err = saveInode(fs, superBlock.InodeStartAddress, currentDirInode)
 	if err != nil {
 		return err
 	}
 
-	err = saveInode(fs, int64(superBlock.InodeStartAddress), dirItemInode)
+	err = saveInode(fs, superBlock.InodeStartAddress, dirItemInode)
 	if err != nil {
 		return err
 	}
@@ -698,6 +1078,29 @@ func AddDirItem(dirInodeId int32, dirItemNodeId int32, dirItemName string, fs *o
 	return nil
 }
 
+// freeDirItemPosition returns the position of a free item of the directory, -1 if the directory is full.
+// The last cluster is searched first, it is where items are added when nothing was removed from the directory.
+func freeDirItemPosition(fs BlockDevice, dirInode PseudoInode, superBlock Superblock) (int64, error) {
+	itemsInCluster := int64(superBlock.ClusterSize) / int64(binary.Size(DirectoryItem{}))
+	clusterCount := dirInode.FileSize / int64(superBlock.ClusterSize)
+	cluster := make([]DirectoryItem, itemsInCluster)
+	for i := int64(0); i < clusterCount; i++ {
+		index := (i + clusterCount - 1) % clusterCount //the last cluster first, then from the start
+		err := readFileStruct(fs, superBlock, dirInode, index*int64(superBlock.ClusterSize), cluster)
+		if err != nil {
+			return -1, err
+		}
+		for j, v := range cluster {
+			position := index*itemsInCluster + int64(j)
+			//. and .. are never free
+			if v.Inode == 0 && position > 1 {
+				return position, nil
+			}
+		}
+	}
+	return -1, nil
+}
+
 // RemoveDirItem removes a directory item from a directory.
 // It takes the directory inode ID, directory item name, destination pointer, superblock,
 // and a delete flag as input parameters.
@@ -705,65 +1108,94 @@ func AddDirItem(dirInodeId int32, dirItemNodeId int32, dirItemName string, fs *o
 // the corresponding file is deleted from the file system.
 // If the delete flag is false, the item is not deleted from the file system even if its inode references reach zero.
 // Returns an error if any operation fails.
-func RemoveDirItem(dirInodeId int32, dirItemName string, destPtr *os.File, superBlock Superblock, delete bool) error {
-	oldDataBuf := new(bytes.Buffer)
-	newDataBuf := new(bytes.Buffer)
-	currentDir := make([]DirectoryItem, superBlock.ClusterSize/int32(binary.Size(DirectoryItem{})))
-	dirItemInode := PseudoInode{}
-
-	currentDirInode, err := LoadInode(destPtr, dirInodeId, int64(superBlock.InodeStartAddress))
+func RemoveDirItem(dirInodeId int32, dirItemName string, destPtr BlockDevice, superBlock Superblock, delete bool) error {
+	defer lockInode(destPtr, dirInodeId)()
+	dirItemInodeId, err := findDirItem(destPtr, dirInodeId, dirItemName, superBlock)
 	if err != nil {
 		return err
 	}
+	if dirItemInodeId != dirInodeId {
+		defer lockInode(destPtr, dirItemInodeId)()
+	}
+	return removeDirItem(dirInodeId, dirItemName, destPtr, superBlock, delete)
+}
 
-	//currentDirInode.References--
-
-	usedDataBlocks, _, err := GetFileClusters(destPtr, currentDirInode, superBlock)
+// RemoveDirectory removes the empty directory with the given name from its parent directory.
+// Both directories stay locked between the check and the removal, so nothing can be added into the removed directory.
+// It returns ErrNotDirectory or ErrDirectoryNotEmpty if the item cannot be removed.
+func RemoveDirectory(parentInodeId int32, dirName string, destPtr BlockDevice, superBlock Superblock) error {
+	defer lockInode(destPtr, parentInodeId)()
+	dirInodeId, err := findDirItem(destPtr, parentInodeId, dirName, superBlock)
 	if err != nil {
 		return err
 	}
+	if dirInodeId == parentInodeId {
+		return ErrDirectoryNotEmpty
+	}
+	defer lockInode(destPtr, dirInodeId)()
 
-	dirInBytes, err := ReadFileData(destPtr, currentDirInode, superBlock)
+	dirInode, err := LoadInode(destPtr, dirInodeId, superBlock.InodeStartAddress)
 	if err != nil {
 		return err
 	}
-
-	_, err = oldDataBuf.Write(dirInBytes)
+	if !dirInode.IsDirectory {
+		return ErrNotDirectory
+	}
+	dir, err := loadDirectory(destPtr, dirInode, superBlock)
 	if err != nil {
 		return err
 	}
-	err = binary.Read(oldDataBuf, binary.LittleEndian, currentDir)
+	dirLen := 0
+	for _, v := range dir {
+		if v.Inode != 0 {
+			dirLen++
+		}
+	}
+	//only . and .. are left in an empty directory
+	if dirLen > 2 {
+		return ErrDirectoryNotEmpty
+	}
+	return removeDirItem(parentInodeId, dirName, destPtr, superBlock, true)
+}
+
+// findDirItem returns the inode id of the item with the given name in the directory without locking the directory.
+func findDirItem(destPtr BlockDevice, dirInodeId int32, dirItemName string, superBlock Superblock) (int32, error) {
+	return lookupDirItem(destPtr, dirInodeId, dirItemName, superBlock)
+}
+
+// removeDirItem is RemoveDirItem for a directory and item which are already locked.
+func removeDirItem(dirInodeId int32, dirItemName string, destPtr BlockDevice, superBlock Superblock, delete bool) error {
+	currentDirInode, err := LoadInode(destPtr, dirInodeId, superBlock.InodeStartAddress)
 	if err != nil {
 		return err
 	}
 
-	dirItemIndex := GetDirItemIndex(currentDir, dirItemName)
-
-	if dirItemIndex == -1 {
+	position, dirItem, err := dirItemPosition(destPtr, currentDirInode, dirItemName, superBlock)
+	if err != nil {
+		return err
+	}
+	if position == -1 {
 		return fmt.Errorf("file does not exist")
-	} else {
-		dirItemInode, err = LoadInode(destPtr, currentDir[dirItemIndex].Inode, int64(superBlock.InodeStartAddress))
-		if err != nil {
-			return err
-		}
-		dirItemInode.References--
-		currentDir[dirItemIndex].Inode = 0
-		currentDir[dirItemIndex] = DirectoryItem{}
 	}
-
-	//transform data back into bytes
-	err = binary.Write(newDataBuf, binary.LittleEndian, currentDir)
+	dirItemInode, err := LoadInode(destPtr, dirItem.Inode, superBlock.InodeStartAddress)
 	if err != nil {
 		return err
 	}
+	dirItemInode.References--
 
-	//save data
-	_, err = saveDataBlocks(newDataBuf.Bytes(), destPtr, superBlock, usedDataBlocks)
+	err = writeDirItem(destPtr, superBlock, currentDirInode, position, DirectoryItem{})
 	if err != nil {
 		return err
 	}
-
-	err = saveInode(destPtr, int64(superBlock.InodeStartAddress), currentDirInode)
+	forgetDentry(destPtr, dirInodeId, dirItemName)
+	if currentDirInode.DirIndex != 0 {
+		err = dirIndexRemove(destPtr, superBlock, currentDirInode, dirItem.ItemName, position)
+		if err != nil {
+			return fmt.Errorf("could not update directory index: %v", err)
+		}
+	}
+	currentDirInode.ModifyTime = timeNow().UnixNano()
+	err = saveInode(destPtr, superBlock.InodeStartAddress, currentDirInode)
 	if err != nil {
 		return err
 	}
@@ -774,7 +1206,7 @@ func RemoveDirItem(dirInodeId int32, dirItemName string, destPtr *os.File, super
 			return err
 		}
 	} else {
-		err = saveInode(destPtr, int64(superBlock.InodeStartAddress), dirItemInode)
+		err = saveInode(destPtr, superBlock.InodeStartAddress, dirItemInode)
 		if err != nil {
 			return err
 		}
@@ -792,30 +1224,71 @@ func removeNullCharsFromString(s string) string {
 // It takes a file system object (fs), a pseudo inode (inode), and a superblock (superBlock) as parameters.
 // It first loads the inode bitmap and data bitmap from the file system.
 // Then it retrieves the addresses of clusters and extra allocated blocks for singly and indirect pointer blocks of the file.
-// It updates the inode bitmap and data bitmap to mark the clusters and indirect block addresses as free.
+// It updates the inode bitmap and data bitmap to mark the clusters, indirect blocks and the attribute cluster as free.
 // It sets the NodeId of the inode to 0 to indicate that it is no longer in use.
+// With secure delete (SuperblockFlagSecureDelete) the freed clusters and the whole inode are overwritten with zeros.
 // Finally, it saves the updated inode, inode bitmap, and data bitmap back to the file system.
 // If any error occurs during the process, it returns the error.
-func DeleteFile(fs *os.File, inode PseudoInode, superBlock Superblock) error {
-	inodeBitmap, err := LoadBitmap(fs, superBlock.BitmapiStartAddress, superBlock.BitmapiSize)
-	dataBitmap, err := LoadBitmap(fs, superBlock.BitmapStartAddress, superBlock.BitmapSize)
-	dataAddresses, indirectPtrAddresess, err := GetFileClusters(fs, inode, superBlock)
-
-	//inodeBitmap[(inode.NodeId-1)/8] = setBit(inodeBitmap[(inode.NodeId-1)/8], uint8((inode.NodeId-1)%8), true)
-	inodeBitmap = SetValueInInodeBitmap(inodeBitmap, inode, false)
-	dataBitmap = SetValuesInDataBitmap(dataBitmap, dataAddresses, superBlock.DataStartAddress, superBlock.ClusterSize, false)
-	dataBitmap = SetValuesInDataBitmap(dataBitmap, indirectPtrAddresess, superBlock.DataStartAddress, superBlock.ClusterSize, false)
-
-	inode.NodeId = 0
-	err = saveInode(fs, int64(superBlock.InodeStartAddress), inode)
+func DeleteFile(fs BlockDevice, inode PseudoInode, superBlock Superblock) error {
+	defer lockAlloc(fs)()
+	inodeBitmap, dataBitmap, err := loadBitmaps(fs, superBlock)
 	if err != nil {
 		return err
 	}
-	err = saveBitmap(fs, int64(superBlock.BitmapStartAddress), dataBitmap)
+
+	//the index of a directory is deleted with it
+	inodes := []PseudoInode{inode}
+	if inode.DirIndex != 0 {
+		index, err := LoadInode(fs, inode.DirIndex, superBlock.InodeStartAddress)
+		if err != nil {
+			return err
+		}
+		inodes = append(inodes, index)
+	}
+	if inode.IsDirectory {
+		forgetDirectory(fs, inode.NodeId)
+	}
+
+	for _, inode := range inodes {
+		dataAddresses, indirectPtrAddresess, err := GetFileClusters(fs, inode, superBlock)
+		if err != nil {
+			return err
+		}
+
+		//inodeBitmap[(inode.NodeId-1)/8] = setBit(inodeBitmap[(inode.NodeId-1)/8], uint8((inode.NodeId-1)%8), true)
+		inodeBitmap = SetValueInInodeBitmap(inodeBitmap, inode, false)
+		dataBitmap = SetValuesInDataBitmap(dataBitmap, dataAddresses, superBlock, false)
+		dataBitmap = SetValuesInDataBitmap(dataBitmap, indirectPtrAddresess, superBlock, false)
+		if inode.XattrCluster != 0 {
+			dataBitmap = SetValuesInDataBitmap(dataBitmap, []int32{inode.XattrCluster}, superBlock, false)
+		}
+
+		//the inode stays in its slot with id 0, saveInode would write it before the inode table
+		address := superBlock.InodeStartAddress + int64(binary.Size(inode))*int64(inode.NodeId-1)
+		inode.NodeId = 0
+		if SecureDeleteEnabled(superBlock) {
+			freed := append(dataAddresses, indirectPtrAddresess...)
+			if inode.XattrCluster != 0 {
+				freed = append(freed, inode.XattrCluster)
+			}
+			err = wipeClusters(fs, superBlock, freed)
+			if err != nil {
+				return err
+			}
+			//inline data and attributes are stored in the inode
+			inode = PseudoInode{}
+		}
+		traceIO(fs, "DeleteFile", true, address, binary.Size(inode))
+		err = writeStruct(fs, address, &inode)
+		if err != nil {
+			return fmt.Errorf("could not write inode: %v", err)
+		}
+	}
+	err = saveBitmap(fs, superBlock.BitmapStartAddress, dataBitmap)
 	if err != nil {
 		return err
 	}
-	err = saveBitmap(fs, int64(superBlock.BitmapiStartAddress), inodeBitmap)
+	err = saveBitmap(fs, superBlock.BitmapiStartAddress, inodeBitmap)
 	if err != nil {
 		return err
 	}
@@ -827,68 +1300,99 @@ func DeleteFile(fs *os.File, inode PseudoInode, superBlock Superblock) error {
 // It returns a copy of the inode bitmap with the value of the bit corresponding to the given inode set to the given value.
 func SetValueInInodeBitmap(inodeBitmap []uint8, inode PseudoInode, value bool) []uint8 {
 	bitmap := append([]uint8(nil), inodeBitmap...)
+	if !value {
+		stats.inodesFreed.Add(1)
+	}
 	bitmap[(inode.NodeId-1)/8] = setBit(bitmap[(inode.NodeId-1)/8], uint8((inode.NodeId-1)%8), false)
 	return bitmap
 }
 
+// loadBitmaps loads the inode bitmap and the data bitmap from the file system.
+func loadBitmaps(fs BlockDevice, superBlock Superblock) ([]uint8, []uint8, error) {
+	inodeBitmap, err := LoadBitmap(fs, superBlock.BitmapiStartAddress, superBlock.BitmapiSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataBitmap, err := LoadBitmap(fs, superBlock.BitmapStartAddress, superBlock.BitmapSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return inodeBitmap, dataBitmap, nil
+}
+
 // saveBitmap saves the given bitmap to the given address in the file system.
-func saveBitmap(destPtr *os.File, address int64, bitmap []uint8) error {
-	_, err2 := destPtr.Seek(address, 0)
-	err := binary.Write(destPtr, binary.LittleEndian, &bitmap)
-	if err2 != nil || err != nil {
+func saveBitmap(destPtr BlockDevice, address int64, bitmap []uint8) error {
+	traceIO(destPtr, "saveBitmap", true, address, len(bitmap))
+	_, err := destPtr.WriteAt(bitmap, address)
+	if err != nil {
 		return fmt.Errorf("could not write bitmap: %v", err)
 	}
 	return nil
 }
 
 // LoadBitmap loads the bitmap from the given address in the file system.
-func LoadBitmap(destPtr *os.File, bitmapStartAddress int32, bitmapSize int32) ([]uint8, error) {
+func LoadBitmap(destPtr BlockDevice, bitmapStartAddress int64, bitmapSize int32) ([]uint8, error) {
 	bitmap := make([]uint8, bitmapSize)
-	_, err2 := destPtr.Seek(int64(bitmapStartAddress), 0)
-	err := binary.Read(destPtr, binary.LittleEndian, &bitmap)
-	if err2 != nil || err != nil {
-		return nil, fmt.Errorf("could not write bitmap: %v", err)
+	traceIO(destPtr, "LoadBitmap", false, bitmapStartAddress, len(bitmap))
+	_, err := destPtr.ReadAt(bitmap, bitmapStartAddress)
+	if err != nil {
+		return nil, fmt.Errorf("could not read bitmap: %v", err)
 	}
 	return bitmap, nil
 }
 
 // SetValuesInDataBitmap sets the values of the bits corresponding to the given data blocks in the data bitmap.
-// It takes the data bitmap, data block addresses, data start address, block size, and value as input parameters.
+// It takes the data bitmap, cluster numbers of the data blocks, superblock, and value as input parameters.
 // It returns a copy of the data bitmap with the values of the bits corresponding to the given data blocks set to the given value.
-func SetValuesInDataBitmap(dataBitmap []uint8, dataBlockAddresses []int32, dataStartAddress int32, blockSize int32, value bool) []uint8 {
+func SetValuesInDataBitmap(dataBitmap []uint8, dataBlocks []int32, superBlock Superblock, value bool) []uint8 {
 	bitmap := append([]uint8(nil), dataBitmap...)
-	for _, v := range dataBlockAddresses {
-		dataBit := (v - dataStartAddress) / blockSize
+	if !value {
+		stats.clustersFreed.Add(int64(len(dataBlocks)))
+	}
+	for _, v := range dataBlocks {
+		dataBit := dataClusterBit(superBlock, v)
 		bitmap[dataBit/8] = setBit(bitmap[dataBit/8], uint8(dataBit%8), value)
 	}
 	return bitmap
 }
 
+// ClusterAddress returns the byte address of the cluster with the given number.
+func ClusterAddress(superBlock Superblock, cluster int32) int64 {
+	return int64(cluster) * int64(superBlock.ClusterSize)
+}
+
+// dataClusterBit returns the index of the bit of the given data cluster in the data bitmap.
+func dataClusterBit(superBlock Superblock, cluster int32) int64 {
+	return int64(cluster) - superBlock.DataStartAddress/int64(superBlock.ClusterSize)
+}
+
 // GetAvailableDataBlocks returns a list of available data blocks from the given bitmap and new data bitmap with updated values.
-// It takes the bitmap, dataStartAddress, dataSize, and blockSize as input parameters.
+// It takes the bitmap, superblock and dataSize as input parameters.
 // The function appends a copy of the bitmap to ensure immutability.
-// It iterates through the bitmap to find available data blocks and adds their addresses to the blockAddressList.
+// It iterates through the bitmap to find available data blocks and adds their cluster numbers to the blockList.
 // The allocatedSize keeps track of the total size of allocated data blocks.
-// If the allocatedSize exceeds the dataSize, the function sets the values in the bitmap and returns the blockAddressList and updated bitmap.
-// If there are not enough available data blocks, the function returns an error.
-func GetAvailableDataBlocks(bitmap []uint8, dataStartAddress int32, dataSize int32, blockSize int32) ([]int32, []uint8, error) {
+// If the allocatedSize exceeds the dataSize, the function sets the values in the bitmap and returns the blockList and updated bitmap.
+// If there are not enough available data blocks, the function returns ErrNoSpace.
+func GetAvailableDataBlocks(bitmap []uint8, superBlock Superblock, dataSize int64) ([]int32, []uint8, error) {
 	bitmap = append([]uint8(nil), bitmap...)
-	blockAddressList := make([]int32, 0)
-	allocatedSize := 0
-	for i := 0; i < len(bitmap); i++ {
-		for j := 0; j < 8; j++ {
-			if allocatedSize >= int(dataSize) {
-				bitmap = SetValuesInDataBitmap(bitmap, blockAddressList, dataStartAddress, blockSize, true)
-				return blockAddressList, bitmap, nil
-			}
-			blockAddress := dataStartAddress + int32(i*8*int(blockSize)) + int32(j)*blockSize
-			if getBit(bitmap[i], int32(j)) == ClusterIsFree {
-				blockAddressList = append(blockAddressList, blockAddress)
-				allocatedSize += int(blockSize)
-			}
+	blockList := make([]int32, 0)
+	firstCluster := int32(superBlock.DataStartAddress / int64(superBlock.ClusterSize))
+	var allocatedSize int64
+	for i := int32(0); i < superBlock.ClusterCount; i++ {
+		if allocatedSize >= dataSize {
+			break
 		}
+		if getBit(bitmap[i/8], i%8) == ClusterIsFree {
+			blockList = append(blockList, firstCluster+i)
+			allocatedSize += int64(superBlock.ClusterSize)
+		}
+	}
+	if allocatedSize < dataSize {
+		return nil, nil, ErrNoSpace
 	}
-	return nil, nil, fmt.Errorf("not enough available data blocks")
+	bitmap = SetValuesInDataBitmap(bitmap, blockList, superBlock, true)
+	stats.clustersAllocated.Add(int64(len(blockList)))
+	return blockList, bitmap, nil
 }
 
 // GetAvailableInodeAddress returns the address of an available inode from the given bitmap and new inode bitmap with updated values.
@@ -896,18 +1400,18 @@ func GetAvailableDataBlocks(bitmap []uint8, dataStartAddress int32, dataSize int
 // The function appends a copy of the bitmap to ensure immutability.
 // It iterates through the bitmap to find an available inode and returns its address.
 // If there are no available inodes, the function returns an error.
-func GetAvailableInodeAddress(bitmap []uint8, startAddress int32, inodeSize int32) (int32, []uint8, error) {
+func GetAvailableInodeAddress(bitmap []uint8, startAddress int64, inodeSize int32) (int64, []uint8, error) {
 	bitmap = append([]uint8(nil), bitmap...)
 	for i := 0; i < len(bitmap); i++ {
 		for j := 0; j < 8; j++ {
-			blockAddress := startAddress + int32(i*8*int(inodeSize)) + int32(j)*inodeSize
+			blockAddress := startAddress + int64(i*8+j)*int64(inodeSize)
 			if getBit(bitmap[i], int32(j)) == InodeIsFree {
 				bitmap[i] = setBit(bitmap[i], uint8(j), true)
 				return blockAddress, bitmap, nil
 			}
 		}
 	}
-	return -1, nil, fmt.Errorf("no free inodes")
+	return -1, nil, ErrNoInodes
 }
 
 // getBit returns the value of the bit at the specified position in the given number.
@@ -1,50 +1,135 @@
 package util
 
+import "errors"
+
+var (
+	// ErrDirectoryNotEmpty is returned when a directory which still contains items is removed.
+	ErrDirectoryNotEmpty = errors.New("directory not empty")
+	// ErrNotDirectory is returned when a directory operation is used on a file.
+	ErrNotDirectory = errors.New("not a directory")
+	// ErrReadOnly is returned when an image opened for reading only is written.
+	ErrReadOnly = errors.New("image is opened read-only")
+	// ErrXattrNotFound is returned when a file does not have the requested extended attribute.
+	ErrXattrNotFound = errors.New("attribute not found")
+	// ErrExist is returned when an item is added into a directory which already has an item with the same name.
+	ErrExist = errors.New("file with same name already exists")
+	// ErrNoSpace is returned when there are not enough free data clusters.
+	ErrNoSpace = errors.New("not enough available data blocks")
+	// ErrNoInodes is returned when there is no free inode.
+	ErrNoInodes = errors.New("no free inodes")
+	// ErrNameTooLong is returned for a name which does not fit into the name of a directory item.
+	ErrNameTooLong = errors.New("name is too long")
+	// ErrFileTooBig is returned for a file which needs more clusters than the doubly indirect pointer reaches.
+	ErrFileTooBig = errors.New("file is too big (not enough references available)")
+	// ErrNoData is returned when a file has no data after the offset where data are searched for.
+	ErrNoData = errors.New("no data after the offset")
+	// ErrFileChanged is returned when a file changed after it was read and is not overwritten.
+	ErrFileChanged = errors.New("file changed since it was read")
+	// ErrNotInTrash is returned when the trash does not contain the requested item.
+	ErrNotInTrash = errors.New("item is not in the trash")
+)
+
+// ImageLockedError is returned when an image is locked by another process.
+type ImageLockedError struct {
+	Path string
+	PID  int // 0 if the process is not known
+}
+
+func (e *ImageLockedError) Error() string {
+	if e.PID == 0 {
+		return Msg(MsgImageInUseUnknown, e.Path)
+	}
+	return Msg(MsgImageInUse, e.Path, e.PID)
+}
+
 const (
 	DefaultClusterSize = 512
+	MinClusterSize     = 512
+	MaxClusterSize     = 64 * 1024
 	IdItemFree         = 0
 	BytesPerInode      = 2048
+	MaxInodeCount      = 1 << 24 // limits the inode table of large images, one inode per BytesPerInode would be too many
 	ClusterIsFree      = 0
 	InodeIsFree        = 0
 	AddressByteLen     = 4
+	InlineDataSize     = 15 * AddressByteLen // files up to this size are stored in the pointers of the inode (Direct and Indirect)
+	XattrInlineSize    = 64                  // size of the extended attribute area inside the inode
+	MaxXattrNameLen    = 255                 // the length of a name is stored in one byte
+	DirIndexThreshold  = 64                  // directories with more item slots get a hashed index
 )
 
+// Cluster pointers (Direct, Indirect and the pointers in indirect blocks) are cluster numbers counted from the start
+// of the image, the cluster with number n starts at byte n*ClusterSize. The data blocks start at a cluster boundary,
+// so pointer 0 (the superblock) never points to data and means "no cluster".
+// A 32-bit cluster number addresses up to 1 TiB with 512 byte clusters and 128 TiB with 64 KiB clusters.
+
 type Superblock struct {
 	//byte represents char in GO
 	Signature           [9]byte   // author's FS login
-	VolumeDescriptor    [251]byte // description of the generated FS
+	VolumeDescriptor    [247]byte // description of the generated FS
+	Flags               uint32    // SuperblockFlag... bits, zero in images formatted before the flags existed
+	Version             uint32    // version of the layout of the image, SuperblockVersion
 	DiskSize            int64     // total VFS size
 	ClusterSize         int32     // cluster size
-	ClusterCount        int32     // number of clusters
+	ClusterCount        int32     // number of data clusters
 	InodeCount          int32     // inode size is the size of struct pseudo_inode
-	BitmapiStartAddress int32     // start address of the inode bitmap
+	BitmapiStartAddress int64     // start address of the inode bitmap
 	BitmapiSize         int32     // size of bitmap for inodes in bytes
 	BitmapSize          int32     // size of bitmap for data in bytes
-	BitmapStartAddress  int32     // start address of the data block bitmap
-	InodeStartAddress   int32     // start address of the inodes
-	DataStartAddress    int32     // start address of the data blocks
+	BitmapStartAddress  int64     // start address of the data block bitmap
+	InodeStartAddress   int64     // start address of the inodes
+	DataStartAddress    int64     // start address of the data blocks, aligned to ClusterSize
 }
 
+// Signature and layout version of the images of this filesystem, images with others are refused (see CheckSuperBlock).
+const (
+	SuperblockSignature        = "nuva"
+	SuperblockVersion   uint32 = 1
+)
+
+// Flags of the filesystem (Superblock.Flags).
+const (
+	// SuperblockFlagTrash means removed files are moved into the trash instead of being deleted (see trash.go).
+	SuperblockFlagTrash uint32 = 1 << iota
+	// SuperblockFlagSecureDelete means freed clusters and inodes are overwritten with zeros (see secure_delete.go).
+	SuperblockFlagSecureDelete
+)
+
+// Flags of an inode (PseudoInode.Flags).
+const (
+	// InodeFlagInline means the data of the file are stored in place of the Direct and Indirect pointers.
+	InodeFlagInline uint8 = 1 << iota
+	// InodeFlagDirIndex marks the hashed index of a directory, it is not an item of any directory (see dir_index.go).
+	InodeFlagDirIndex
+)
+
 type PseudoInode struct {
 	NodeId      int32     // ID of the inode, if ID = IdItemFree, the item is free
 	IsDirectory bool      // file or directory
 	References  int8      // number of references to the inode, used for hard links
-	FileSize    int32     // file size in bytes
-	Direct      [12]int32 // direct links to data blocks
+	Flags       uint8     // InodeFlag... bits
+	FileSize    int64     // file size in bytes
+	AccessTime  int64     // time of the last touch, unix nanoseconds (reading does not change it)
+	ModifyTime  int64     // time the content (or the items of a directory) last changed, unix nanoseconds
+	Direct      [12]int32 // direct links to data blocks (cluster numbers)
 	//Example: with a 512-byte block size, and 4-byte block pointers, each indirect block can consist of 128 (512 / 4) pointers.
 	//as many pointers as opssible within 1 block (cluster)
 	Indirect [3]int32 // indirect links (link - data blocks)
+	DirIndex int32    // inode id of the hashed index of a large directory, 0 if the directory has none
+	//extended attributes which fit are stored in the inode, the others in one extra cluster (see xattr.go)
+	XattrCluster int32                 // cluster number of the attribute cluster, 0 if the inode has none
+	Xattrs       [XattrInlineSize]byte // inline attributes
 }
 
 // SinglyIndirectBlock is a block containing pointers to data blocks
 type SinglyIndirectBlock struct {
-	Address  int32   //address of the block
+	Address  int32   //cluster number of the block
 	Pointers []int32 //array of pointers to data blocks
 }
 
 // DoublyIndirectBlock represents a block in the file system that contains an array of singly indirect blocks.
 type DoublyIndirectBlock struct {
-	Address  int32                 //address of the block
+	Address  int32                 //cluster number of the block
 	Pointers []SinglyIndirectBlock //array of singly indirect blocks
 }
 
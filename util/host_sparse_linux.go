@@ -0,0 +1,33 @@
+//go:build linux
+
+package util
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lseek whence values which find the data and the holes of a sparse file.
+const (
+	hostSeekData = 3
+	hostSeekHole = 4
+)
+
+// hostNextData returns the next range of data at or after the offset in a file of the host with the given size,
+// found by lseek with SEEK_DATA and SEEK_HOLE. ok is false if the file has no more data.
+// If the filesystem of the host cannot find holes, the rest of the file is one range.
+func hostNextData(f *os.File, offset int64, size int64) (start int64, end int64, ok bool) {
+	start, err := f.Seek(offset, hostSeekData)
+	if errors.Is(err, syscall.ENXIO) {
+		return 0, 0, false
+	}
+	if err != nil {
+		return offset, size, offset < size
+	}
+	end, err = f.Seek(start, hostSeekHole)
+	if err != nil {
+		end = size
+	}
+	return start, min(end, size), start < size
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package util
+
+import "os"
+
+// hostNextData returns the rest of the file as one range of data, finding holes in files of the host
+// is only supported on Linux. ok is false if the offset is at the end of the file.
+func hostNextData(f *os.File, offset int64, size int64) (start int64, end int64, ok bool) {
+	return offset, size, offset < size
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package util
+
+import "os"
+
+// LockImage does nothing, locking of images is only supported on unix systems.
+func LockImage(fp *os.File, exclusive bool) error {
+	return nil
+}
@@ -0,0 +1,65 @@
+//go:build unix
+
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// LockImage takes an advisory flock lock of the image file, exclusive for read-write sessions
+// and shared for read-only ones. The lock is released when the file is closed.
+// If another process holds a conflicting lock, an *ImageLockedError is returned.
+func LockImage(fp *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(fp.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return &ImageLockedError{Path: fp.Name(), PID: lockOwner(fp)}
+	}
+	if err != nil {
+		return fmt.Errorf("could not lock image: %v", err)
+	}
+	return nil
+}
+
+// lockOwner finds the process holding a flock lock of the file in /proc/locks.
+// It returns 0 if the owner cannot be found (for example on systems without /proc).
+func lockOwner(fp *os.File) int {
+	info, err := fp.Stat()
+	if err != nil {
+		return 0
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	locks, err := os.Open("/proc/locks")
+	if err != nil {
+		return 0
+	}
+	defer locks.Close()
+
+	//lines look like "1: FLOCK  ADVISORY  WRITE 1234 08:01:5678 0 EOF", the device is major:minor:inode
+	major := (uint64(stat.Dev) >> 8) & 0xfff
+	minor := (uint64(stat.Dev) & 0xff) | ((uint64(stat.Dev) >> 12) & 0xfff00)
+	file := fmt.Sprintf("%02x:%02x:%d", major, minor, stat.Ino)
+	scanner := bufio.NewScanner(locks)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[1] != "FLOCK" || fields[5] != file {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[4])
+		if err == nil && pid != os.Getpid() {
+			return pid
+		}
+	}
+	return 0
+}
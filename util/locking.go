@@ -0,0 +1,89 @@
+package util
+
+import (
+	"sync"
+)
+
+// Locking of a filesystem shared between goroutines.
+//
+// Every device has its own set of locks. They have to be taken in this order:
+//
+//  1. rename lock (only Mv, so directories do not change their place in the tree while they are locked)
+//  2. inode locks, a parent directory is always locked before its items
+//  3. allocator lock (data and inode bitmaps)
+//
+// Public functions in fs_commands.go take the locks they need, the unexported variants expect them to be held already.
+
+// fsLocks holds the locks of one filesystem image.
+type fsLocks struct {
+	alloc  sync.Mutex
+	rename sync.Mutex
+	mu     sync.Mutex //guards inodes
+	inodes map[int32]*sync.RWMutex
+}
+
+var (
+	locksMu  sync.Mutex
+	fsLockOf = map[BlockDevice]*fsLocks{}
+)
+
+// locksFor returns the locks of the given device, creating them on first use.
+func locksFor(dev BlockDevice) *fsLocks {
+	dev = baseDevice(dev)
+	locksMu.Lock()
+	defer locksMu.Unlock()
+	l, ok := fsLockOf[dev]
+	if !ok {
+		l = &fsLocks{inodes: map[int32]*sync.RWMutex{}}
+		fsLockOf[dev] = l
+	}
+	return l
+}
+
+// releaseLocks forgets the locks of a device which is no longer used.
+func releaseLocks(dev BlockDevice) {
+	dev = baseDevice(dev)
+	locksMu.Lock()
+	defer locksMu.Unlock()
+	delete(fsLockOf, dev)
+}
+
+// inode returns the reader/writer lock of the inode with the given id.
+func (l *fsLocks) inode(inodeId int32) *sync.RWMutex {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock, ok := l.inodes[inodeId]
+	if !ok {
+		lock = &sync.RWMutex{}
+		l.inodes[inodeId] = lock
+	}
+	return lock
+}
+
+// lockAlloc locks the data and inode bitmaps of the device and returns the function which unlocks them.
+func lockAlloc(dev BlockDevice) func() {
+	l := locksFor(dev)
+	l.alloc.Lock()
+	return l.alloc.Unlock
+}
+
+// lockRename serializes operations which move items between directories.
+func lockRename(dev BlockDevice) func() {
+	l := locksFor(dev)
+	l.rename.Lock()
+	return l.rename.Unlock
+}
+
+// lockInode locks the inode for writing and returns the function which unlocks it.
+func lockInode(dev BlockDevice, inodeId int32) func() {
+	lock := locksFor(dev).inode(inodeId)
+	lock.Lock()
+	return lock.Unlock
+}
+
+// rlockInode locks the inode for reading and returns the function which unlocks it.
+func rlockInode(dev BlockDevice, inodeId int32) func() {
+	lock := locksFor(dev).inode(inodeId)
+	lock.RLock()
+	return lock.RUnlock
+}
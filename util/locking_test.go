@@ -0,0 +1,263 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The stress test runs sessions of one shared filesystem in parallel, run it with go test -race.
+// Every worker creates, writes, copies, moves and removes its own files, moves files through a directory shared
+// by all workers and appends to a file shared by all workers. At the end the content of the files is checked and
+// every cluster set in the data bitmap must belong to exactly one inode.
+
+const (
+	stressWorkers    = 8
+	stressIterations = 24
+	stressRecordSize = 16
+)
+
+// newStressFilesystem formats a filesystem on the memory backend.
+func newStressFilesystem(t *testing.T) (BlockDevice, Superblock) {
+	dev := NewMemDevice(nil)
+	t.Cleanup(func() { dev.Close() })
+	superBlock, _, _, err := Format(16*1024*1024, DefaultClusterSize, 0, dev)
+	if err != nil {
+		t.Fatalf("format: %v", err)
+	}
+	return dev, superBlock
+}
+
+// stressPayload returns the content of a file of the worker, the sizes go from inline files to doubly indirect ones.
+func stressPayload(worker int, iteration int) []byte {
+	size := []int{0, 40, 700, 7000, 90000}[(worker+iteration)%5]
+	payload := make([]byte, size)
+	for n := range payload {
+		payload[n] = byte(worker*31 + iteration*7 + n)
+	}
+	return payload
+}
+
+// run executes one command in the session like the command loop does.
+func run(session *Interpreter, command ...string) error {
+	if err := session.LoadInterpreter(); err != nil {
+		return err
+	}
+	return session.ExecCommand(command)
+}
+
+// writeWhole replaces the content of the file at the path.
+func writeWhole(session *Interpreter, filePath string, data []byte) error {
+	if err := session.LoadInterpreter(); err != nil {
+		return err
+	}
+	inodeId, err := session.createFile(filePath)
+	if err != nil {
+		return err
+	}
+	file, err := OpenFile(session.fs, inodeId, OpenTruncate, session.superBlock)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	return err
+}
+
+// readWhole returns the content of the file at the path.
+func readWhole(session *Interpreter, filePath string) ([]byte, error) {
+	if err := session.LoadInterpreter(); err != nil {
+		return nil, err
+	}
+	inode, _, err := PathToInode(session.fs, filePath, session.superBlock, session.currentDirInode)
+	if err != nil {
+		return nil, err
+	}
+	file, err := OpenFile(session.fs, inode.NodeId, 0, session.superBlock)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// stressWorker runs the operations of one worker, the first error ends it.
+func stressWorker(dev BlockDevice, worker int) error {
+	session := NewSession(dev, strings.NewReader(""), io.Discard, true)
+	dir := fmt.Sprintf("w%d", worker)
+	if err := run(session, "mkdir", dir); err != nil {
+		return err
+	}
+	for k := 0; k < stressIterations; k++ {
+		payload := stressPayload(worker, k)
+		original := fmt.Sprintf("%s/f%d", dir, k)
+		copied := fmt.Sprintf("%s/g%d", dir, k)
+		shared := fmt.Sprintf("s/m%d_%d", worker, k)
+		if err := writeWhole(session, original, payload); err != nil {
+			return fmt.Errorf("write %s: %v", original, err)
+		}
+		if err := run(session, "cp", original, copied); err != nil {
+			return fmt.Errorf("cp %s: %v", original, err)
+		}
+		//the copy goes through the shared directory and back
+		if err := run(session, "mv", copied, shared); err != nil {
+			return fmt.Errorf("mv %s: %v", copied, err)
+		}
+		if k%3 != 0 {
+			if err := run(session, "mv", shared, copied); err != nil {
+				return fmt.Errorf("mv %s: %v", shared, err)
+			}
+			if err := run(session, "rm", copied); err != nil {
+				return fmt.Errorf("rm %s: %v", copied, err)
+			}
+		}
+		content, err := readWhole(session, original)
+		if err != nil {
+			return fmt.Errorf("read %s: %v", original, err)
+		}
+		if !bytes.Equal(content, payload) {
+			return fmt.Errorf("%s has %d bytes which differ from the %d written", original, len(content), len(payload))
+		}
+
+		log, err := OpenFile(dev, lookupId(session, "log"), OpenAppend, session.superBlock)
+		if err != nil {
+			return fmt.Errorf("open log: %v", err)
+		}
+		record := fmt.Sprintf("%-*s", stressRecordSize, fmt.Sprintf("%d/%d", worker, k))
+		_, err = log.Write([]byte(record))
+		log.Close()
+		if err != nil {
+			return fmt.Errorf("append to log: %v", err)
+		}
+		if k%2 == 1 {
+			if err := run(session, "rm", original); err != nil {
+				return fmt.Errorf("rm %s: %v", original, err)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupId returns the inode id of the file at the path, 0 if it cannot be found.
+func lookupId(session *Interpreter, filePath string) int32 {
+	if err := session.LoadInterpreter(); err != nil {
+		return 0
+	}
+	inode, _, err := PathToInode(session.fs, filePath, session.superBlock, session.currentDirInode)
+	if err != nil {
+		return 0
+	}
+	return inode.NodeId
+}
+
+// checkClusterOwners checks that every cluster of every used inode is set in the data bitmap, no cluster belongs
+// to two inodes and no cluster is set in the bitmap without an owner.
+func checkClusterOwners(t *testing.T, dev BlockDevice, superBlock Superblock) {
+	t.Helper()
+	inodeBitmap, dataBitmap, err := loadBitmaps(dev, superBlock)
+	if err != nil {
+		t.Fatalf("load bitmaps: %v", err)
+	}
+	firstCluster := int32(superBlock.DataStartAddress / int64(superBlock.ClusterSize))
+	owners := map[int32]int32{}
+	for id := int32(1); id <= superBlock.InodeCount; id++ {
+		if getBit(inodeBitmap[(id-1)/8], (id-1)%8) == 0 {
+			continue
+		}
+		inode, err := LoadInode(dev, id, superBlock.InodeStartAddress)
+		if err != nil {
+			t.Fatalf("load inode %d: %v", id, err)
+		}
+		if inode.NodeId != id {
+			t.Errorf("inode %d is set in the bitmap but not stored", id)
+			continue
+		}
+		owned, err := inodeClusterRoles(dev, inode, superBlock)
+		if err != nil {
+			t.Fatalf("clusters of inode %d: %v", id, err)
+		}
+		for _, c := range owned {
+			if owner, ok := owners[c.cluster]; ok {
+				t.Errorf("cluster %d belongs to inodes %d and %d", c.cluster, owner, id)
+			}
+			owners[c.cluster] = id
+			n := c.cluster - firstCluster
+			if getBit(dataBitmap[n/8], n%8) == 0 {
+				t.Errorf("cluster %d of inode %d is free in the bitmap", c.cluster, id)
+			}
+		}
+	}
+	if used := countSetBits(dataBitmap, superBlock.ClusterCount); int(used) != len(owners) {
+		t.Errorf("%d clusters are used in the bitmap, inodes own %d", used, len(owners))
+	}
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	dev, superBlock := newStressFilesystem(t)
+	setup := NewSession(dev, strings.NewReader(""), io.Discard, true)
+	for _, command := range [][]string{{"mkdir", "s"}, {"touch", "log"}} {
+		if err := run(setup, command...); err != nil {
+			t.Fatalf("%s: %v", command[0], err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, stressWorkers)
+	for worker := 0; worker < stressWorkers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			errs[worker] = stressWorker(dev, worker)
+		}(worker)
+	}
+	wg.Wait()
+	for worker, err := range errs {
+		if err != nil {
+			t.Errorf("worker %d: %v", worker, err)
+		}
+	}
+	if t.Failed() {
+		return
+	}
+
+	//every append landed at its own place
+	log, err := readWhole(setup, "log")
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	if len(log) != stressWorkers*stressIterations*stressRecordSize {
+		t.Fatalf("log has %d bytes, want %d", len(log), stressWorkers*stressIterations*stressRecordSize)
+	}
+	records := map[string]bool{}
+	for n := 0; n < len(log); n += stressRecordSize {
+		records[strings.TrimSpace(string(log[n:n+stressRecordSize]))] = true
+	}
+	if len(records) != stressWorkers*stressIterations {
+		t.Errorf("log has %d different records, want %d", len(records), stressWorkers*stressIterations)
+	}
+
+	//the files kept by the workers
+	for worker := 0; worker < stressWorkers; worker++ {
+		for k := 0; k < stressIterations; k++ {
+			names := []string{}
+			if k%2 == 0 {
+				names = append(names, fmt.Sprintf("w%d/f%d", worker, k))
+			}
+			if k%3 == 0 {
+				names = append(names, fmt.Sprintf("s/m%d_%d", worker, k))
+			}
+			for _, name := range names {
+				content, err := readWhole(setup, name)
+				if err != nil {
+					t.Errorf("read %s: %v", name, err)
+				} else if !bytes.Equal(content, stressPayload(worker, k)) {
+					t.Errorf("%s has wrong content", name)
+				}
+			}
+		}
+	}
+	checkClusterOwners(t, dev, superBlock)
+}
@@ -0,0 +1,481 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// MessageKey identifies a user-facing message in the message catalog.
+type MessageKey string
+
+const (
+	LangEnglish = "en"
+	LangCzech   = "cs"
+	// LangStrict prints only the canonical strings from the assignment (OK, FILE NOT FOUND, ...),
+	// so the output can be compared by automated graders. Keys without a canonical string fall back to English.
+	LangStrict = "strict"
+)
+
+const (
+	MsgOK                 MessageKey = "ok"
+	MsgUsage              MessageKey = "usage"
+	MsgFsDoesNotExist     MessageKey = "fs_does_not_exist"
+	MsgBadImage           MessageKey = "bad_image"
+	MsgNoFilesystem       MessageKey = "no_filesystem"
+	MsgUnknownCommand     MessageKey = "unknown_command"
+	MsgCannotCreateFile   MessageKey = "cannot_create_file"
+	MsgCannotFormat       MessageKey = "cannot_format"
+	MsgFileNotFound       MessageKey = "file_not_found"
+	MsgSourceNotFound     MessageKey = "source_not_found"
+	MsgDirNotFound        MessageKey = "dir_not_found"
+	MsgPathNotFound       MessageKey = "path_not_found"
+	MsgDestPathNotFound   MessageKey = "dest_path_not_found"
+	MsgGivenPathNotFound  MessageKey = "given_path_not_found"
+	MsgListPathNotFound   MessageKey = "list_path_not_found"
+	MsgExist              MessageKey = "exist"
+	MsgNotEmpty           MessageKey = "not_empty"
+	MsgNotADirectory      MessageKey = "not_a_directory"
+	MsgCannotCatDir       MessageKey = "cannot_cat_dir"
+	MsgCannotRmDir        MessageKey = "cannot_rm_dir"
+	MsgCannotCopyDir      MessageKey = "cannot_copy_dir"
+	MsgCannotShortenDir   MessageKey = "cannot_shorten_dir"
+	MsgOverwritingFile    MessageKey = "overwriting_file"
+	MsgOverwritingSame    MessageKey = "overwriting_same"
+	MsgArgsIncp           MessageKey = "args_incp"
+	MsgArgsFile           MessageKey = "args_file"
+	MsgArgsLs             MessageKey = "args_ls"
+	MsgArgsDir            MessageKey = "args_dir"
+	MsgArgsFileOrDir      MessageKey = "args_file_or_dir"
+	MsgArgsSrcDest        MessageKey = "args_src_dest"
+	MsgArgsXcp            MessageKey = "args_xcp"
+	MsgArgsLoad           MessageKey = "args_load"
+	MsgArgsShort          MessageKey = "args_short"
+	MsgArgsSetxattr       MessageKey = "args_setxattr"
+	MsgArgsXattr          MessageKey = "args_xattr"
+	MsgArgsTrash          MessageKey = "args_trash"
+	MsgArgsUndelete       MessageKey = "args_undelete"
+	MsgArgsWrite          MessageKey = "args_write"
+	MsgArgsAppend         MessageKey = "args_append"
+	MsgArgsRedirect       MessageKey = "args_redirect"
+	MsgArgsHeadTail       MessageKey = "args_head_tail"
+	MsgArgsFiles          MessageKey = "args_files"
+	MsgArgsGrep           MessageKey = "args_grep"
+	MsgArgsDump           MessageKey = "args_dump"
+	MsgArgsCompare        MessageKey = "args_compare"
+	MsgArgsManifest       MessageKey = "args_manifest"
+	MsgArgsVerify         MessageKey = "args_verify"
+	MsgArgsBitmap         MessageKey = "args_bitmap"
+	MsgArgsIstat          MessageKey = "args_istat"
+	MsgArgsDblock         MessageKey = "args_dblock"
+	MsgArgsExportMap      MessageKey = "args_export_map"
+	MsgArgsTrace          MessageKey = "args_trace"
+	MsgArgsStats          MessageKey = "args_stats"
+	MsgArgsTarin          MessageKey = "args_tarin"
+	MsgArgsTarout         MessageKey = "args_tarout"
+	MsgArgsIncpRecursive  MessageKey = "args_incp_recursive"
+	MsgArgsOutcpRecursive MessageKey = "args_outcp_recursive"
+	MsgErrLoadDir         MessageKey = "err_load_dir"
+	MsgErrLoadInode       MessageKey = "err_load_inode"
+	MsgErrWriteData       MessageKey = "err_write_data"
+	MsgErrReadData        MessageKey = "err_read_data"
+	MsgErrAddDirItem      MessageKey = "err_add_dir_item"
+	MsgErrRemoveDirItem   MessageKey = "err_remove_dir_item"
+	MsgErrCreateDir       MessageKey = "err_create_dir"
+	MsgErrRemoveDir       MessageKey = "err_remove_dir"
+	MsgErrRemoveFile      MessageKey = "err_remove_file"
+	MsgErrFindSource      MessageKey = "err_find_source"
+	MsgErrFindDest        MessageKey = "err_find_dest"
+	MsgErrParseCommand    MessageKey = "err_parse_command"
+	MsgErrExecCommand     MessageKey = "err_exec_command"
+	MsgErrUnknownLanguage MessageKey = "err_unknown_language"
+	MsgErrSync            MessageKey = "err_sync"
+	MsgErrReadXattr       MessageKey = "err_read_xattr"
+	MsgErrWriteXattr      MessageKey = "err_write_xattr"
+	MsgXattrNotFound      MessageKey = "xattr_not_found"
+	MsgErrTrash           MessageKey = "err_trash"
+	MsgErrUndelete        MessageKey = "err_undelete"
+	MsgTrashEmptied       MessageKey = "trash_emptied"
+	MsgErrWipe            MessageKey = "err_wipe"
+	MsgEditShared         MessageKey = "edit_shared"
+	MsgHostShared         MessageKey = "host_shared"
+	MsgCannotEditDir      MessageKey = "cannot_edit_dir"
+	MsgErrEditor          MessageKey = "err_editor"
+	MsgErrEditSave        MessageKey = "err_edit_save"
+	MsgEditConflict       MessageKey = "edit_conflict"
+	MsgNotChanged         MessageKey = "not_changed"
+	MsgIsADirectory       MessageKey = "is_a_directory"
+	MsgErrPattern         MessageKey = "err_pattern"
+	MsgFilesIdentical     MessageKey = "files_identical"
+	MsgCmpDiffer          MessageKey = "cmp_differ"
+	MsgCmpEOF             MessageKey = "cmp_eof"
+	MsgErrManifest        MessageKey = "err_manifest"
+	MsgVerifyMissing      MessageKey = "verify_missing"
+	MsgVerifyModified     MessageKey = "verify_modified"
+	MsgVerifyExtra        MessageKey = "verify_extra"
+	MsgVerified           MessageKey = "verified"
+	MsgErrRange           MessageKey = "err_range"
+	MsgErrExportMap       MessageKey = "err_export_map"
+	MsgErrTar             MessageKey = "err_tar"
+	MsgSkipped            MessageKey = "skipped"
+	MsgTarDone            MessageKey = "tar_done"
+	MsgCopyPlanned        MessageKey = "copy_planned"
+	MsgCopyFailed         MessageKey = "copy_failed"
+	MsgCopySummary        MessageKey = "copy_summary"
+	MsgErrCopyFailed      MessageKey = "err_copy_failed"
+	MsgWiped              MessageKey = "wiped"
+	MsgFormatShared       MessageKey = "format_shared"
+	MsgImageInUse         MessageKey = "image_in_use"
+	MsgImageInUseUnknown  MessageKey = "image_in_use_unknown"
+	MsgLockIgnored        MessageKey = "lock_ignored"
+	MsgArgsMkimage        MessageKey = "args_mkimage"
+	MsgImageBuilt         MessageKey = "image_built"
+	MsgInfoSizes          MessageKey = "info_sizes"
+	MsgInfoInline         MessageKey = "info_inline"
+	MsgUnknownOption      MessageKey = "unknown_option"
+	MsgPatternMissing     MessageKey = "pattern_missing"
+	MsgBadPattern         MessageKey = "bad_pattern"
+	MsgFormatSizeMissing  MessageKey = "format_size_missing"
+	MsgSizeTooBig         MessageKey = "size_too_big"
+	MsgSizeSuffixMissing  MessageKey = "size_suffix_missing"
+	MsgSizeSuffixInvalid  MessageKey = "size_suffix_invalid"
+	MsgSizeInvalid        MessageKey = "size_invalid"
+)
+
+var catalogs = map[string]map[MessageKey]string{
+	LangEnglish: {
+		MsgOK:                 "OK",
+		MsgUsage:              "Wrong amount of arguments. The argument should be the name of the filesystem.",
+		MsgFsDoesNotExist:     "Filesystem does not exist. Please format it first.",
+		MsgBadImage:           "not an image of this filesystem (signature %q, version %d, expected %q, version %d)",
+		MsgNoFilesystem:       "no filesystem loaded",
+		MsgUnknownCommand:     "unknown command",
+		MsgCannotCreateFile:   "CANNOT CREATE FILE",
+		MsgCannotFormat:       "CANNOT CREATE FILE (%v)",
+		MsgFileNotFound:       "FILE NOT FOUND",
+		MsgSourceNotFound:     "FILE NOT FOUND (source does not exist)",
+		MsgDirNotFound:        "FILE NOT FOUND (directory does not exist)",
+		MsgPathNotFound:       "PATH NOT FOUND (path does not exist)",
+		MsgDestPathNotFound:   "PATH NOT FOUND (destination path does not exist)",
+		MsgGivenPathNotFound:  "PATH NOT FOUND (given path does not exist)",
+		MsgListPathNotFound:   "PATH NOT FOUND (directory does not exist)",
+		MsgExist:              "EXIST (cannot create, already exists)",
+		MsgNotEmpty:           "NOT EMPTY (directory contains subdirectories or files)",
+		MsgNotADirectory:      "not a directory",
+		MsgCannotCatDir:       "cannot cat a directory",
+		MsgCannotRmDir:        "cannot remove a directory with rm",
+		MsgCannotCopyDir:      "cannot copy a directory",
+		MsgCannotShortenDir:   "cannot shorten a directory",
+		MsgOverwritingFile:    "%s is a file, overwriting",
+		MsgOverwritingSame:    "overwriting file with same name...",
+		MsgArgsIncp:           "Wrong amount of arguments. The arguments should be the name of the path to the file and the name of the file in the filesystem.",
+		MsgArgsFile:           "Wrong amount of arguments. The argument should be the name of the file in the filesystem.",
+		MsgArgsLs:             "Wrong amount of arguments.",
+		MsgArgsDir:            "Wrong amount of arguments. The argument should be the name of the directory.",
+		MsgArgsFileOrDir:      "Wrong amount of arguments. The argument should be the name of the file or directory.",
+		MsgArgsSrcDest:        "Wrong amount of arguments. The arguments should be the name of the source and destination.",
+		MsgArgsXcp:            "Wrong amount of arguments. The arguments should be the names of the two sources and the destination.",
+		MsgArgsLoad:           "Wrong amount of arguments. The argument should be the name of the file with commands.",
+		MsgArgsShort:          "Wrong amount of arguments. The argument should be the name of the file.",
+		MsgArgsSetxattr:       "Wrong amount of arguments. The arguments should be the file, the name of the attribute and its value.",
+		MsgArgsXattr:          "Wrong amount of arguments. The arguments should be the file and the name of the attribute.",
+		MsgArgsTrash:          "Wrong arguments. Use trash [list|empty|on|off].",
+		MsgArgsUndelete:       "Wrong amount of arguments. The argument should be the name of the file in the trash (see trash list).",
+		MsgArgsWrite:          "Wrong amount of arguments. The arguments should be the file and optionally the line which ends the text (. by default).",
+		MsgArgsAppend:         "Wrong amount of arguments. The arguments should be the file and the text.",
+		MsgArgsRedirect:       "Wrong redirection. Use command > file or command >> file at the end of the command.",
+		MsgArgsHeadTail:       "Wrong arguments. The arguments should be optionally -n and the number of lines, and the file.",
+		MsgArgsFiles:          "Wrong amount of arguments. The arguments should be the names of the files.",
+		MsgArgsGrep:           "Wrong arguments. Use grep [-r] [-i] [-n] <pattern> <files...>.",
+		MsgArgsDump:           "Wrong arguments. The arguments should be optionally -s and the offset, -n and the length, and the file.",
+		MsgArgsCompare:        "Wrong amount of arguments. The arguments should be the two files (host:path for a file of the host).",
+		MsgArgsManifest:       "Wrong amount of arguments. The argument should be the directory.",
+		MsgArgsVerify:         "Wrong amount of arguments. The arguments should be the manifest (host:path for a file of the host) and optionally the directory.",
+		MsgArgsBitmap:         "Wrong arguments. Use bitmap data|inode [first-last].",
+		MsgArgsIstat:          "Wrong amount of arguments. The argument should be the inode id.",
+		MsgArgsDblock:         "Wrong arguments. Use dblock <cluster> [hex|dir|ptr].",
+		MsgArgsExportMap:      "Wrong amount of arguments. The argument should be the HTML file on the host.",
+		MsgArgsTrace:          "Wrong arguments. Use trace on [file] or trace off.",
+		MsgArgsStats:          "Wrong arguments. Use stats or stats reset.",
+		MsgArgsTarin:          "Wrong arguments. Use tarin <archive.tar[.gz]> <dir>.",
+		MsgArgsTarout:         "Wrong arguments. Use tarout <dir> <archive.tar[.gz]>.",
+		MsgArgsIncpRecursive:  "Wrong arguments. Use incp -r [-n] [--include pattern] [--exclude pattern] <hostdir> <dir>.",
+		MsgArgsOutcpRecursive: "Wrong arguments. Use outcp -r [-n] [--include pattern] [--exclude pattern] <dir> <hostdir>.",
+		MsgErrLoadDir:         "could not load directory: %v",
+		MsgErrLoadInode:       "could not load inode: %v",
+		MsgErrWriteData:       "could not write data to the filesystem: %v",
+		MsgErrReadData:        "could not read data: %v",
+		MsgErrAddDirItem:      "could not add directory item: %v",
+		MsgErrRemoveDirItem:   "could not remove directory item: %v",
+		MsgErrCreateDir:       "could not create directory: %v",
+		MsgErrRemoveDir:       "could not remove directory: %v",
+		MsgErrRemoveFile:      "could not remove file: %v",
+		MsgErrFindSource:      "could not find source: %v",
+		MsgErrFindDest:        "could not find destination: %v",
+		MsgErrParseCommand:    "error parsing command: %v",
+		MsgErrExecCommand:     "error executing command: %v",
+		MsgErrUnknownLanguage: "unknown language %q (available: %s)",
+		MsgErrSync:            "could not write cached changes into the image: %v",
+		MsgErrReadXattr:       "could not read extended attributes: %v",
+		MsgErrWriteXattr:      "could not change extended attributes: %v",
+		MsgXattrNotFound:      "ATTRIBUTE NOT FOUND (%s)",
+		MsgErrTrash:           "could not use the trash: %v",
+		MsgErrUndelete:        "could not restore the file: %v",
+		MsgTrashEmptied:       "%d files deleted from the trash",
+		MsgErrWipe:            "could not wipe free space: %v",
+		MsgEditShared:         "edit is not available in a shared session, the editor would run on the terminal of the server",
+		MsgHostShared:         "%s is not available in a shared session, it would use the files of the server",
+		MsgCannotEditDir:      "cannot edit a directory",
+		MsgErrEditor:          "could not edit the file: %v",
+		MsgErrEditSave:        "could not save the edited file: %v (the edited version is kept in %s)",
+		MsgEditConflict:       "%s changed in the image while it was being edited, it was not overwritten (the edited version is kept in %s)",
+		MsgNotChanged:         "file not changed",
+		MsgIsADirectory:       "%s is a directory",
+		MsgErrPattern:         "invalid pattern: %v",
+		MsgFilesIdentical:     "files are identical",
+		MsgCmpDiffer:          "%s %s differ: byte %d, line %d",
+		MsgCmpEOF:             "EOF on %s after byte %d",
+		MsgErrManifest:        "could not read the manifest: %v",
+		MsgVerifyMissing:      "MISSING %s",
+		MsgVerifyModified:     "MODIFIED %s",
+		MsgVerifyExtra:        "EXTRA %s",
+		MsgVerified:           "%d files OK, %d missing, %d modified, %d extra",
+		MsgErrRange:           "invalid range: %v",
+		MsgErrExportMap:       "could not write the map: %v",
+		MsgErrTar:             "tar archive error: %v",
+		MsgSkipped:            "skipped %s (unsupported type of entry)",
+		MsgTarDone:            "%d files, %d directories, %d hard links",
+		MsgCopyPlanned:        "%s -> %s",
+		MsgCopyFailed:         "failed %s: %v",
+		MsgCopySummary:        "%d files (%d bytes), %d directories, %d failed",
+		MsgErrCopyFailed:      "%d items could not be copied",
+		MsgWiped:              "%d free clusters and %d free inodes overwritten",
+		MsgFormatShared:       "format is not allowed while the filesystem is shared with other sessions",
+		MsgImageInUse:         "image %s is in use by PID %d (use --force to open it anyway)",
+		MsgImageInUseUnknown:  "image %s is in use by another process (use --force to open it anyway)",
+		MsgLockIgnored:        "warning: %v, opening it anyway",
+		MsgArgsMkimage:        "Wrong arguments. Use mkimage --from <hostdir> [--size auto|<size>] [--cluster-size <size>] <image>.",
+		MsgImageBuilt:         "%s: %d files (%d bytes), %d directories, image of %d bytes",
+		MsgInfoSizes:          "size %d, allocated %d",
+		MsgInfoInline:         "inline",
+		MsgUnknownOption:      "unknown option %s",
+		MsgPatternMissing:     "%s needs a pattern",
+		MsgBadPattern:         "bad pattern %s: %v",
+		MsgFormatSizeMissing:  "the size of the filesystem is missing",
+		MsgSizeTooBig:         "size %s is too big",
+		MsgSizeSuffixMissing:  "unspecified suffix (B, K, M, G, T)",
+		MsgSizeSuffixInvalid:  "invalid size suffix",
+		MsgSizeInvalid:        "invalid size %s",
+	},
+	LangCzech: {
+		MsgOK:                 "OK",
+		MsgUsage:              "Špatný počet argumentů. Argumentem má být název souborového systému.",
+		MsgFsDoesNotExist:     "Souborový systém neexistuje. Nejprve ho naformátujte.",
+		MsgBadImage:           "není obraz tohoto souborového systému (podpis %q, verze %d, očekáván %q, verze %d)",
+		MsgNoFilesystem:       "není načten žádný souborový systém",
+		MsgUnknownCommand:     "neznámý příkaz",
+		MsgCannotCreateFile:   "CANNOT CREATE FILE",
+		MsgCannotFormat:       "CANNOT CREATE FILE (%v)",
+		MsgFileNotFound:       "FILE NOT FOUND",
+		MsgSourceNotFound:     "FILE NOT FOUND (není zdroj)",
+		MsgDirNotFound:        "FILE NOT FOUND (neexistující adresář)",
+		MsgPathNotFound:       "PATH NOT FOUND (neexistující cesta)",
+		MsgDestPathNotFound:   "PATH NOT FOUND (neexistuje cílová cesta)",
+		MsgGivenPathNotFound:  "PATH NOT FOUND (neexistuje zadaná cesta)",
+		MsgListPathNotFound:   "PATH NOT FOUND (neexistující adresář)",
+		MsgExist:              "EXIST (nelze založit, již existuje)",
+		MsgNotEmpty:           "NOT EMPTY (adresář obsahuje podadresáře, nebo soubory)",
+		MsgNotADirectory:      "není adresář",
+		MsgCannotCatDir:       "adresář nelze vypsat příkazem cat",
+		MsgCannotRmDir:        "adresář nelze smazat příkazem rm",
+		MsgCannotCopyDir:      "adresář nelze kopírovat",
+		MsgCannotShortenDir:   "adresář nelze zkrátit",
+		MsgOverwritingFile:    "%s je soubor, přepisuji",
+		MsgOverwritingSame:    "přepisuji soubor se stejným názvem...",
+		MsgArgsIncp:           "Špatný počet argumentů. Argumenty mají být cesta k souboru a název souboru v souborovém systému.",
+		MsgArgsFile:           "Špatný počet argumentů. Argumentem má být název souboru v souborovém systému.",
+		MsgArgsLs:             "Špatný počet argumentů.",
+		MsgArgsDir:            "Špatný počet argumentů. Argumentem má být název adresáře.",
+		MsgArgsFileOrDir:      "Špatný počet argumentů. Argumentem má být název souboru nebo adresáře.",
+		MsgArgsSrcDest:        "Špatný počet argumentů. Argumenty mají být zdroj a cíl.",
+		MsgArgsXcp:            "Špatný počet argumentů. Argumenty mají být dva zdroje a cíl.",
+		MsgArgsLoad:           "Špatný počet argumentů. Argumentem má být název souboru s příkazy.",
+		MsgArgsShort:          "Špatný počet argumentů. Argumentem má být název souboru.",
+		MsgArgsSetxattr:       "Špatný počet argumentů. Argumenty mají být soubor, název atributu a jeho hodnota.",
+		MsgArgsXattr:          "Špatný počet argumentů. Argumenty mají být soubor a název atributu.",
+		MsgArgsTrash:          "Špatné argumenty. Použijte trash [list|empty|on|off].",
+		MsgArgsUndelete:       "Špatný počet argumentů. Argumentem má být název souboru v koši (viz trash list).",
+		MsgArgsWrite:          "Špatný počet argumentů. Argumenty mají být soubor a volitelně řádek, který ukončí text (výchozí je .).",
+		MsgArgsAppend:         "Špatný počet argumentů. Argumenty mají být soubor a text.",
+		MsgArgsRedirect:       "Špatné přesměrování. Použijte příkaz > soubor nebo příkaz >> soubor na konci příkazu.",
+		MsgArgsHeadTail:       "Špatné argumenty. Argumenty mají být volitelně -n a počet řádků, a soubor.",
+		MsgArgsFiles:          "Špatný počet argumentů. Argumenty mají být názvy souborů.",
+		MsgArgsGrep:           "Špatné argumenty. Použijte grep [-r] [-i] [-n] <vzor> <soubory...>.",
+		MsgArgsDump:           "Špatné argumenty. Argumenty mají být volitelně -s a posun, -n a délka, a soubor.",
+		MsgArgsCompare:        "Špatný počet argumentů. Argumenty mají být dva soubory (host:cesta pro soubor hostitele).",
+		MsgArgsManifest:       "Špatný počet argumentů. Argumentem má být adresář.",
+		MsgArgsVerify:         "Špatný počet argumentů. Argumenty mají být manifest (host:cesta pro soubor hostitele) a volitelně adresář.",
+		MsgArgsBitmap:         "Špatné argumenty. Použijte bitmap data|inode [první-poslední].",
+		MsgArgsIstat:          "Špatný počet argumentů. Argumentem má být id inode.",
+		MsgArgsDblock:         "Špatné argumenty. Použijte dblock <cluster> [hex|dir|ptr].",
+		MsgArgsExportMap:      "Špatný počet argumentů. Argumentem má být HTML soubor hostitele.",
+		MsgArgsTrace:          "Špatné argumenty. Použijte trace on [soubor] nebo trace off.",
+		MsgArgsStats:          "Špatné argumenty. Použijte stats nebo stats reset.",
+		MsgArgsTarin:          "Špatné argumenty. Použijte tarin <archiv.tar[.gz]> <adresář>.",
+		MsgArgsTarout:         "Špatné argumenty. Použijte tarout <adresář> <archiv.tar[.gz]>.",
+		MsgArgsIncpRecursive:  "Špatné argumenty. Použijte incp -r [-n] [--include vzor] [--exclude vzor] <adresář_hostitele> <adresář>.",
+		MsgArgsOutcpRecursive: "Špatné argumenty. Použijte outcp -r [-n] [--include vzor] [--exclude vzor] <adresář> <adresář_hostitele>.",
+		MsgErrLoadDir:         "nelze načíst adresář: %v",
+		MsgErrLoadInode:       "nelze načíst i-uzel: %v",
+		MsgErrWriteData:       "nelze zapsat data do souborového systému: %v",
+		MsgErrReadData:        "nelze přečíst data: %v",
+		MsgErrAddDirItem:      "nelze přidat položku adresáře: %v",
+		MsgErrRemoveDirItem:   "nelze odebrat položku adresáře: %v",
+		MsgErrCreateDir:       "nelze vytvořit adresář: %v",
+		MsgErrRemoveDir:       "nelze smazat adresář: %v",
+		MsgErrRemoveFile:      "nelze smazat soubor: %v",
+		MsgErrFindSource:      "nelze najít zdroj: %v",
+		MsgErrFindDest:        "nelze najít cíl: %v",
+		MsgErrParseCommand:    "chyba při zpracování příkazu: %v",
+		MsgErrExecCommand:     "chyba při vykonávání příkazu: %v",
+		MsgErrUnknownLanguage: "neznámý jazyk %q (dostupné: %s)",
+		MsgErrSync:            "nelze zapsat změny z mezipaměti do obrazu: %v",
+		MsgErrReadXattr:       "nelze načíst rozšířené atributy: %v",
+		MsgErrWriteXattr:      "nelze změnit rozšířené atributy: %v",
+		MsgXattrNotFound:      "ATTRIBUTE NOT FOUND (atribut %s neexistuje)",
+		MsgErrTrash:           "nelze použít koš: %v",
+		MsgErrUndelete:        "nelze obnovit soubor: %v",
+		MsgTrashEmptied:       "z koše smazáno souborů: %d",
+		MsgErrWipe:            "nelze přepsat volné místo: %v",
+		MsgEditShared:         "edit není ve sdílené relaci dostupný, editor by běžel na terminálu serveru",
+		MsgHostShared:         "%s není ve sdílené relaci dostupné, použily by se soubory serveru",
+		MsgCannotEditDir:      "adresář nelze editovat",
+		MsgErrEditor:          "soubor nelze editovat: %v",
+		MsgErrEditSave:        "upravený soubor nelze uložit: %v (upravená verze je v %s)",
+		MsgEditConflict:       "%s se během editace v obrazu změnil, nebyl přepsán (upravená verze je v %s)",
+		MsgNotChanged:         "soubor nebyl změněn",
+		MsgIsADirectory:       "%s je adresář",
+		MsgErrPattern:         "neplatný vzor: %v",
+		MsgFilesIdentical:     "soubory jsou shodné",
+		MsgCmpDiffer:          "%s %s se liší: bajt %d, řádek %d",
+		MsgCmpEOF:             "konec souboru %s po bajtu %d",
+		MsgErrManifest:        "nelze přečíst manifest: %v",
+		MsgVerifyMissing:      "CHYBÍ %s",
+		MsgVerifyModified:     "ZMĚNĚN %s",
+		MsgVerifyExtra:        "NAVÍC %s",
+		MsgVerified:           "%d souborů v pořádku, %d chybí, %d změněno, %d navíc",
+		MsgErrRange:           "neplatný rozsah: %v",
+		MsgErrExportMap:       "nelze zapsat mapu: %v",
+		MsgErrTar:             "chyba archivu tar: %v",
+		MsgSkipped:            "přeskočeno %s (nepodporovaný typ položky)",
+		MsgTarDone:            "souborů: %d, adresářů: %d, pevných odkazů: %d",
+		MsgCopyPlanned:        "%s -> %s",
+		MsgCopyFailed:         "chyba %s: %v",
+		MsgCopySummary:        "souborů: %d (%d bajtů), adresářů: %d, chyb: %d",
+		MsgErrCopyFailed:      "nepodařilo se zkopírovat položek: %d",
+		MsgWiped:              "přepsáno volných clusterů: %d, volných i-uzlů: %d",
+		MsgFormatShared:       "formátování není povoleno, souborový systém používají i jiné relace",
+		MsgImageInUse:         "obraz %s používá proces PID %d (pro otevření i tak použijte --force)",
+		MsgImageInUseUnknown:  "obraz %s používá jiný proces (pro otevření i tak použijte --force)",
+		MsgLockIgnored:        "varování: %v, přesto ho otevírám",
+		MsgArgsMkimage:        "Špatné argumenty. Použijte mkimage --from <adresář_hostitele> [--size auto|<velikost>] [--cluster-size <velikost>] <obraz>.",
+		MsgImageBuilt:         "%s: souborů %d (%d bajtů), adresářů %d, obraz o %d bajtech",
+		MsgInfoSizes:          "velikost %d, alokováno %d",
+		MsgInfoInline:         "v i-uzlu",
+		MsgUnknownOption:      "neznámý přepínač %s",
+		MsgPatternMissing:     "%s potřebuje vzor",
+		MsgBadPattern:         "špatný vzor %s: %v",
+		MsgFormatSizeMissing:  "chybí velikost souborového systému",
+		MsgSizeTooBig:         "velikost %s je příliš velká",
+		MsgSizeSuffixMissing:  "chybí jednotka (B, K, M, G, T)",
+		MsgSizeSuffixInvalid:  "neplatná jednotka velikosti",
+		MsgSizeInvalid:        "neplatná velikost %s",
+	},
+	LangStrict: {
+		MsgOK:                "OK",
+		MsgCannotCreateFile:  "CANNOT CREATE FILE",
+		MsgCannotFormat:      "CANNOT CREATE FILE",
+		MsgFileNotFound:      "FILE NOT FOUND",
+		MsgSourceNotFound:    "FILE NOT FOUND",
+		MsgDirNotFound:       "FILE NOT FOUND",
+		MsgPathNotFound:      "PATH NOT FOUND",
+		MsgDestPathNotFound:  "PATH NOT FOUND",
+		MsgGivenPathNotFound: "PATH NOT FOUND",
+		MsgListPathNotFound:  "PATH NOT FOUND",
+		MsgExist:             "EXIST",
+		MsgNotEmpty:          "NOT EMPTY",
+	},
+}
+
+// activeLanguage is the catalog used by Msg. It is English unless changed by SetLanguage.
+var activeLanguage = LangEnglish
+
+// SetLanguage selects the message catalog used for all interpreter output.
+// It returns an error if there is no catalog for the given language.
+func SetLanguage(lang string) error {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if _, ok := catalogs[lang]; !ok {
+		return msgError(MsgErrUnknownLanguage, lang, strings.Join(Languages(), ", "))
+	}
+	activeLanguage = lang
+	return nil
+}
+
+// Languages returns the sorted names of all available message catalogs.
+func Languages() []string {
+	langs := make([]string, 0, len(catalogs))
+	for lang := range catalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// DetectLanguage picks a catalog based on the LC_ALL, LC_MESSAGES and LANG environment variables (in this order).
+// For example "cs_CZ.UTF-8" selects Czech. If nothing matches, English is returned.
+func DetectLanguage() string {
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		//locale has form language_TERRITORY.codeset@modifier, only the language is needed
+		parts := strings.FieldsFunc(value, func(r rune) bool {
+			return r == '_' || r == '.' || r == '@' || r == '-'
+		})
+		if len(parts) == 0 {
+			continue
+		}
+		if lang := strings.ToLower(parts[0]); lang != LangStrict {
+			if _, ok := catalogs[lang]; ok {
+				return lang
+			}
+		}
+		return LangEnglish
+	}
+	return LangEnglish
+}
+
+// Msg returns the message for the given key in the active language, formatted with the given arguments.
+// If the active catalog does not contain the key, the English message is used.
+func Msg(key MessageKey, args ...any) string {
+	format, ok := catalogs[activeLanguage][key]
+	if !ok {
+		format, ok = catalogs[LangEnglish][key]
+		if !ok {
+			format = string(key)
+		}
+	}
+	//messages without verbs (the strict ones) leave the details out
+	if len(args) == 0 || !strings.Contains(format, "%") {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// msgError returns an error whose text is the message for the given key in the active language.
+func msgError(key MessageKey, args ...any) error {
+	return errors.New(Msg(key, args...))
+}
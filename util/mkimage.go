@@ -0,0 +1,265 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Building an image from a directory of the host (mkimage).
+//
+// The tree is measured first, so an image of the right size can be formatted: enough data clusters for the files,
+// their pointer clusters and the directories, and enough inodes. The image is then populated in one pass like by
+// incp -r. If the estimate turns out too small the image is formatted again a bit larger.
+// Images are reproducible: the directories are walked in the order of names, the allocation does not depend on
+// anything but the content, and all timestamps are set to one given time at the end.
+
+// ImageOptions are the parameters of an image built from a tree.
+type ImageOptions struct {
+	Size        int64     // size of the image in bytes, 0 computes the smallest size the tree fits into
+	ClusterSize int32     // 0 means DefaultClusterSize
+	Flags       uint32    // SuperblockFlag... bits of the new filesystem
+	ModTime     time.Time // time stored into all timestamps
+}
+
+// TreeUsage describes a tree of the host and the space it needs in a filesystem.
+type TreeUsage struct {
+	Files    int
+	Dirs     int
+	Bytes    int64
+	Clusters int64    // data clusters needed for the files and the directories (an estimate)
+	Inodes   int64    // inodes needed, including the root directory
+	Skipped  []string // symbolic links and special files, which are not copied
+}
+
+// indirectLevels is the number of indirect pointers of an inode files use, the singly and the doubly indirect one.
+// Indirect[2] only holds inline data.
+const indirectLevels = 2
+
+// maxFileClusters returns the number of data clusters of the largest file, the direct clusters and the clusters
+// behind the singly and the doubly indirect pointer.
+func maxFileClusters(clusterSize int32) int64 {
+	perCluster := int64(clusterSize / AddressByteLen)
+	return int64(len(PseudoInode{}.Direct)) + perCluster + perCluster*perCluster
+}
+
+// fileClusters returns the number of data and pointer clusters of a file of the given size.
+func fileClusters(size int64, clusterSize int32) int64 {
+	if size <= InlineDataSize {
+		return 0
+	}
+	data := (size + int64(clusterSize) - 1) / int64(clusterSize)
+	perCluster := int64(clusterSize / AddressByteLen)
+	clusters := data
+	rest := data - int64(len(PseudoInode{}.Direct))
+	//the singly and the doubly indirect pointer: n clusters behind the pointer of depth d take
+	//ceil(n/perCluster) + ... + ceil(n/perCluster^d) pointer clusters
+	covered := int64(1)
+	for depth := 1; rest > 0 && depth <= indirectLevels; depth++ {
+		covered *= perCluster
+		n := min(rest, covered)
+		for level, divisor := 0, perCluster; level < depth; level, divisor = level+1, divisor*perCluster {
+			clusters += (n + divisor - 1) / divisor
+		}
+		rest -= n
+	}
+	return clusters
+}
+
+// dirClusters returns the number of clusters and extra inodes of a directory with the given number of items
+// besides . and .., including its hashed index.
+func dirClusters(items int, clusterSize int32) (int64, int64) {
+	slots := int64(items + 2)
+	perCluster := int64(clusterSize) / int64(binary.Size(DirectoryItem{}))
+	clusters := (slots + perCluster - 1) / perCluster
+	if clusters*perCluster <= DirIndexThreshold {
+		return clusters, 0
+	}
+	//the index takes about as much space as the items, plus its own inode
+	return 2*clusters + 1, 1
+}
+
+// MeasureTree walks a tree of the host and returns the space it needs in a filesystem with the given cluster size.
+// It returns ErrNameTooLong for a name which does not fit into a directory item and ErrFileTooBig for a file larger
+// than a file of the filesystem can be, so nothing is built from such a tree.
+func MeasureTree(hostDir string, clusterSize int32) (TreeUsage, error) {
+	usage := TreeUsage{Inodes: 1}
+	items := map[string]int{} //numbers of the items of the directories
+	err := filepath.WalkDir(hostDir, func(hostPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if hostPath == hostDir {
+			return nil
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			usage.Skipped = append(usage.Skipped, hostPath)
+			return nil
+		}
+		if err := checkItemName(entry.Name()); err != nil {
+			return fmt.Errorf("%s: %w", hostPath, ErrNameTooLong)
+		}
+		items[filepath.Dir(hostPath)]++
+		usage.Inodes++
+		if entry.IsDir() {
+			usage.Dirs++
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if (info.Size()+int64(clusterSize)-1)/int64(clusterSize) > maxFileClusters(clusterSize) {
+			return fmt.Errorf("%s: %w", hostPath, ErrFileTooBig)
+		}
+		usage.Files++
+		usage.Bytes += info.Size()
+		usage.Clusters += fileClusters(info.Size(), clusterSize)
+		return nil
+	})
+	if err != nil {
+		return TreeUsage{}, err
+	}
+	//the root and every directory found by the walk
+	dirs := []string{hostDir}
+	for dir := range items {
+		if dir != hostDir {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		clusters, inodes := dirClusters(items[dir], clusterSize)
+		usage.Clusters += clusters
+		usage.Inodes += inodes
+	}
+	//empty directories are not in items, they take one cluster
+	usage.Clusters += int64(usage.Dirs + 1 - len(dirs))
+	return usage, nil
+}
+
+// ImageSize returns the smallest size of an image with at least the given numbers of data clusters and inodes.
+func ImageSize(clusters int64, inodes int64, clusterSize int32) (int64, error) {
+	if err := checkClusterSize(clusterSize); err != nil {
+		return 0, err
+	}
+	size := max(inodes*BytesPerInode, int64(clusterSize)*(clusters+1))
+	for {
+		superBlock, err := createSuperBlock(size, clusterSize)
+		if err == nil && int64(superBlock.ClusterCount) >= clusters && int64(superBlock.InodeCount) >= inodes {
+			return size, nil
+		}
+		//the metadata of a tiny image do not fit, which a bigger size fixes
+		missing := int64(clusterSize)
+		if err == nil {
+			missing = max(missing, (clusters-int64(superBlock.ClusterCount))*int64(clusterSize),
+				(inodes-int64(superBlock.InodeCount))*BytesPerInode)
+		} else if size > int64(MaxClusterSize)*4 {
+			return 0, err
+		}
+		size += missing
+	}
+}
+
+// BuildImage formats the device and copies the tree of the host into its root directory.
+// With an automatic size the image is formatted again larger until the tree fits.
+// It returns the superblock of the new filesystem and the measured tree.
+func BuildImage(dev BlockDevice, hostDir string, opts ImageOptions) (Superblock, TreeUsage, error) {
+	clusterSize := opts.ClusterSize
+	if clusterSize == 0 {
+		clusterSize = DefaultClusterSize
+	}
+	hostDir = filepath.Clean(hostDir)
+	usage, err := MeasureTree(hostDir, clusterSize)
+	if err != nil {
+		return Superblock{}, TreeUsage{}, err
+	}
+	size := opts.Size
+	if size == 0 {
+		size, err = ImageSize(usage.Clusters, usage.Inodes, clusterSize)
+		if err != nil {
+			return Superblock{}, usage, err
+		}
+	}
+	for {
+		superBlock, _, _, err := Format(size, clusterSize, opts.Flags, dev)
+		if err != nil {
+			return Superblock{}, usage, err
+		}
+		err = populateImage(dev, hostDir)
+		if opts.Size == 0 && (errors.Is(err, ErrNoSpace) || errors.Is(err, ErrNoInodes)) {
+			size += max(size/8, int64(clusterSize))
+			continue
+		}
+		if err == nil {
+			err = stampImage(dev, superBlock, opts.ModTime)
+		}
+		return superBlock, usage, err
+	}
+}
+
+// populateImage copies the tree of the host into the root directory of a new filesystem.
+func populateImage(dev BlockDevice, hostDir string) error {
+	i := NewSession(dev, strings.NewReader(""), io.Discard, false)
+	if err := i.LoadInterpreter(); err != nil {
+		return err
+	}
+	dirIds := map[string]int32{".": 1} //inode ids of the copied directories by their relative paths
+	return filepath.WalkDir(hostDir, func(hostPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(hostDir, hostPath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if relPath == "." || !entry.IsDir() && !entry.Type().IsRegular() {
+			return nil
+		}
+		parentId := dirIds[path.Dir(relPath)]
+		if entry.IsDir() {
+			dirId, err := i.childDirectory(parentId, entry.Name())
+			if err != nil {
+				return fmt.Errorf("%s: %w", hostPath, err)
+			}
+			dirIds[relPath] = dirId
+			return nil
+		}
+		if _, err := i.copyFileIn(hostPath, parentId, entry.Name()); err != nil {
+			return fmt.Errorf("%s: %w", hostPath, err)
+		}
+		return nil
+	})
+}
+
+// stampImage sets the timestamps of all used inodes to the given time.
+func stampImage(dev BlockDevice, superBlock Superblock, t time.Time) error {
+	inodeBitmap, err := LoadBitmap(dev, superBlock.BitmapiStartAddress, superBlock.BitmapiSize)
+	if err != nil {
+		return err
+	}
+	for id := int32(1); id <= superBlock.InodeCount; id++ {
+		if getBit(inodeBitmap[(id-1)/8], (id-1)%8) == 0 {
+			continue
+		}
+		if err := Touch(dev, id, t, superBlock); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenImageOutput creates the file an image is built into, an existing file is replaced.
+func OpenImageOutput(path string) (BlockDevice, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return OpenDevice(path, OpenOptions{Backend: BackendFile, Create: true})
+}
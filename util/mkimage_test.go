@@ -0,0 +1,103 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeHostTree creates a tree of the host with files of all sizes up to a doubly indirect one, a sparse file,
+// a directory large enough for a hashed index and an empty directory.
+func writeHostTree(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	files := map[string]int{
+		"small":          10,
+		"a/direct":       3000,
+		"a/b/singly":     40000,
+		"a/b/doubly":     200000,
+		"a/b/c/inline":   60,
+		"a/b/c/empty":    0,
+		"a/b/c/cluster":  512,
+		"a/b/c/clusters": 1025,
+	}
+	for n := 0; n < 80; n++ {
+		files[fmt.Sprintf("many/f%02d", n)] = n * 37
+	}
+	for name, size := range files {
+		hostPath := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(hostPath), 0777); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		for n := range data {
+			data[n] = byte(n*7 + len(name))
+		}
+		if err := os.WriteFile(hostPath, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//data at the start and the end with a hole between them
+	sparse, err := os.Create(filepath.Join(root, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sparse.Close()
+	if _, err := sparse.Write([]byte("start")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sparse.WriteAt([]byte("end"), 3000000); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "nothing"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestBuildImageReproducible(t *testing.T) {
+	root := writeHostTree(t)
+	opts := ImageOptions{ModTime: time.Unix(0, 0)}
+	images := make([][]byte, 2)
+	for n := range images {
+		dev := NewMemDevice(nil)
+		if _, _, err := BuildImage(dev, root, opts); err != nil {
+			t.Fatalf("build %d: %v", n, err)
+		}
+		images[n] = dev.Bytes()
+	}
+	if len(images[0]) == 0 {
+		t.Fatal("the image is empty")
+	}
+	if !bytes.Equal(images[0], images[1]) {
+		t.Fatal("two images of the same tree differ")
+	}
+}
+
+func TestMeasureTreeFileTooBig(t *testing.T) {
+	root := t.TempDir()
+	big, err := os.Create(filepath.Join(root, "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//one cluster more than the doubly indirect pointer reaches, the file is sparse on the host
+	size := (maxFileClusters(DefaultClusterSize) + 1) * int64(DefaultClusterSize)
+	err = big.Truncate(size)
+	big.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MeasureTree(root, DefaultClusterSize); !errors.Is(err, ErrFileTooBig) {
+		t.Fatalf("MeasureTree returned %v, want ErrFileTooBig", err)
+	}
+	if err := os.Truncate(filepath.Join(root, "big"), size-int64(DefaultClusterSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MeasureTree(root, DefaultClusterSize); err != nil {
+		t.Fatalf("MeasureTree of the largest file: %v", err)
+	}
+}
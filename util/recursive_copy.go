@@ -0,0 +1,381 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Recursive copying between the host and the filesystem: incp -r and outcp -r.
+//
+// The content of the source directory is copied into the destination directory, which is created if it does not
+// exist. Existing files are overwritten. --include patterns select the files which are copied (all when there is
+// none), --exclude patterns leave out files and whole directories. A pattern is matched by path.Match against both
+// the path relative to the source directory and the name. With -n nothing is copied, only listed.
+// An item which cannot be copied is reported and counted, the copying goes on with the next one. Names of the host
+// longer than a directory item allows cannot be copied in, they are not shortened.
+
+// copyOptions are the options of a recursive copy.
+type copyOptions struct {
+	dryRun   bool
+	includes []string
+	excludes []string
+}
+
+// copySummary counts what a recursive copy did.
+type copySummary struct {
+	files, dirs, failed int
+	bytes               int64
+}
+
+// isCopyOption reports whether the argument is an option of incp -r and outcp -r.
+// Other arguments starting with "-" are names of files.
+func isCopyOption(arg string) bool {
+	switch arg {
+	case "-r", "-n", "--include", "--exclude":
+		return true
+	}
+	return false
+}
+
+// parseCopyOptions parses the options of incp -r and outcp -r, it returns the options and the remaining arguments.
+// Wrong arguments are reported with the usage message of the command.
+func parseCopyOptions(arr []string, usage MessageKey) (copyOptions, []string, error) {
+	options := copyOptions{}
+	recursive := false
+	args := arr[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-r":
+			recursive = true
+		case "-n":
+			options.dryRun = true
+		case "--include", "--exclude":
+			if len(args) < 2 {
+				return options, nil, msgError(MsgPatternMissing, args[0])
+			}
+			if _, err := path.Match(args[1], ""); err != nil {
+				return options, nil, msgError(MsgBadPattern, args[1], err)
+			}
+			if args[0] == "--include" {
+				options.includes = append(options.includes, args[1])
+			} else {
+				options.excludes = append(options.excludes, args[1])
+			}
+			args = args[1:]
+		default:
+			return options, nil, msgError(MsgUnknownOption, args[0])
+		}
+		args = args[1:]
+	}
+	if !recursive || len(args) != 2 {
+		return options, nil, msgError(usage)
+	}
+	return options, args, nil
+}
+
+// matchesAny reports whether the relative path or its last element matches one of the patterns.
+func matchesAny(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, relPath); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(relPath)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether a file or a directory is left out of the copy.
+func (o copyOptions) excluded(relPath string, isDir bool) bool {
+	if matchesAny(o.excludes, relPath) {
+		return true
+	}
+	return !isDir && len(o.includes) > 0 && !matchesAny(o.includes, relPath)
+}
+
+// finishCopy prints the summary of a recursive copy, it returns an error if anything failed.
+func (i *Interpreter) finishCopy(summary copySummary) error {
+	fmt.Fprintln(i.out, Msg(MsgCopySummary, summary.files, summary.bytes, summary.dirs, summary.failed))
+	if summary.failed > 0 {
+		return msgError(MsgErrCopyFailed, summary.failed)
+	}
+	return nil
+}
+
+// storedName returns the name as AddDirItem stores it in a directory item.
+func storedName(name string) string {
+	var item DirectoryItem
+	copy(item.ItemName[:], name)
+	return removeNullCharsFromString(string(item.ItemName[:]))
+}
+
+// childDirectory returns the inode id of the directory with the given name in the parent directory,
+// the directory is created if it does not exist. A name which does not fit into a directory item is refused,
+// shortened it could be the name of another item.
+func (i *Interpreter) childDirectory(parentId int32, name string) (int32, error) {
+	if err := checkItemName(name); err != nil {
+		return 0, err
+	}
+	if inodeId, err := LookupDirItem(i.fs, parentId, name, i.superBlock); err == nil {
+		inode, err := LoadInode(i.fs, inodeId, i.superBlock.InodeStartAddress)
+		if err != nil {
+			return 0, err
+		}
+		if !inode.IsDirectory {
+			return 0, ErrExist
+		}
+		return inodeId, nil
+	}
+	_, dirId, err := CreateDirectory(i.fs, i.superBlock, parentId)
+	if err != nil {
+		return 0, err
+	}
+	return int32(dirId), AddDirItem(parentId, int32(dirId), name, i.fs, i.superBlock)
+}
+
+// childFile returns the inode id of the file with the given name in the parent directory,
+// an empty file is created if it does not exist. Names are checked like by childDirectory.
+func (i *Interpreter) childFile(parentId int32, name string) (int32, error) {
+	if err := checkItemName(name); err != nil {
+		return 0, err
+	}
+	if inodeId, err := LookupDirItem(i.fs, parentId, name, i.superBlock); err == nil {
+		inode, err := LoadInode(i.fs, inodeId, i.superBlock.InodeStartAddress)
+		if err != nil {
+			return 0, err
+		}
+		if inode.IsDirectory {
+			return 0, ErrExist
+		}
+		return inodeId, nil
+	}
+	_, inodeId, err := WriteAndSaveData(nil, i.fs, i.superBlock, false)
+	if err != nil {
+		return 0, err
+	}
+	return int32(inodeId), AddDirItem(parentId, int32(inodeId), name, i.fs, i.superBlock)
+}
+
+// incpRecursive copies a directory of the host into the filesystem:
+// incp -r [-n] [--include pattern] [--exclude pattern] <hostdir> <dir>.
+func (i *Interpreter) incpRecursive(arr []string) error {
+	options, args, err := parseCopyOptions(arr, MsgArgsIncpRecursive)
+	if err != nil {
+		return err
+	}
+	hostDir, vfsDir := args[0], args[1]
+	if info, err := os.Stat(hostDir); err != nil || !info.IsDir() {
+		return msgError(MsgSourceNotFound)
+	}
+	var rootId int32
+	if !options.dryRun {
+		rootId, err = i.mkdirAll(vfsDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	summary := copySummary{}
+	dirIds := map[string]int32{".": rootId} //inode ids of the copied directories by their relative paths
+	filepath.WalkDir(hostDir, func(hostPath string, entry fs.DirEntry, err error) error {
+		relPath, _ := filepath.Rel(hostDir, hostPath)
+		relPath = filepath.ToSlash(relPath)
+		if err != nil {
+			fmt.Fprintln(i.out, Msg(MsgCopyFailed, hostPath, err))
+			summary.failed++
+			return nil
+		}
+		if relPath == "." {
+			return nil
+		}
+		if options.excluded(relPath, entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			fmt.Fprintln(i.out, Msg(MsgSkipped, hostPath))
+			return nil
+		}
+		vfsPath := path.Join(vfsDir, relPath)
+		//also a dry run reports the names which cannot be copied
+		if err := checkItemName(entry.Name()); err != nil {
+			fmt.Fprintln(i.out, Msg(MsgCopyFailed, vfsPath, err))
+			summary.failed++
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if options.dryRun {
+			fmt.Fprintln(i.out, Msg(MsgCopyPlanned, hostPath, vfsPath))
+			if entry.IsDir() {
+				summary.dirs++
+			} else if info, err := entry.Info(); err == nil {
+				summary.files++
+				summary.bytes += info.Size()
+			}
+			return nil
+		}
+
+		parentId := dirIds[path.Dir(relPath)]
+		if entry.IsDir() {
+			dirId, err := i.childDirectory(parentId, entry.Name())
+			if err != nil {
+				fmt.Fprintln(i.out, Msg(MsgCopyFailed, vfsPath, err))
+				summary.failed++
+				return filepath.SkipDir
+			}
+			dirIds[relPath] = dirId
+			summary.dirs++
+			return nil
+		}
+		written, err := i.copyFileIn(hostPath, parentId, entry.Name())
+		if err != nil {
+			fmt.Fprintln(i.out, Msg(MsgCopyFailed, vfsPath, err))
+			summary.failed++
+			return nil
+		}
+		summary.files++
+		summary.bytes += written
+		return nil
+	})
+	return i.finishCopy(summary)
+}
+
+// copyFileIn copies a file of the host into the directory of the filesystem keeping its holes (see sparse.go),
+// it returns the size of the file.
+func (i *Interpreter) copyFileIn(hostPath string, parentId int32, name string) (int64, error) {
+	src, err := os.Open(hostPath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	inodeId, err := i.childFile(parentId, name)
+	if err != nil {
+		return 0, err
+	}
+	dst, err := OpenFile(i.fs, inodeId, OpenTruncate, i.superBlock)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	return copyIntoFile(dst, src, int64(i.superBlock.ClusterSize))
+}
+
+// outcpRecursive copies a directory of the filesystem to the host:
+// outcp -r [-n] [--include pattern] [--exclude pattern] <dir> <hostdir>.
+func (i *Interpreter) outcpRecursive(arr []string) error {
+	options, args, err := parseCopyOptions(arr, MsgArgsOutcpRecursive)
+	if err != nil {
+		return err
+	}
+	vfsDir, hostDir := args[0], args[1]
+	dirInode, _, err := PathToInode(i.fs, vfsDir, i.superBlock, i.currentDirInode)
+	if err != nil {
+		return msgError(MsgSourceNotFound)
+	}
+	if !dirInode.IsDirectory {
+		return msgError(MsgNotADirectory)
+	}
+	if !options.dryRun {
+		if err := os.MkdirAll(hostDir, 0777); err != nil {
+			return msgError(MsgDestPathNotFound)
+		}
+	}
+
+	summary := copySummary{}
+	err = i.copyTreeOut(dirInode, vfsDir, hostDir, "", options, &summary)
+	if err != nil {
+		return msgError(MsgErrLoadDir, err)
+	}
+	return i.finishCopy(summary)
+}
+
+// copyTreeOut copies the items of a directory of the filesystem into the directory of the host,
+// relDir is the path of the directory relative to the copied one.
+func (i *Interpreter) copyTreeOut(dirInode PseudoInode, vfsDir string, hostDir string, relDir string, options copyOptions, summary *copySummary) error {
+	dir, err := LoadDirectory(i.fs, dirInode, i.superBlock)
+	if err != nil {
+		return err
+	}
+	for n, item := range dir {
+		//. and ..
+		if n < 2 || item.Inode == 0 {
+			continue
+		}
+		name := removeNullCharsFromString(string(item.ItemName[:]))
+		if dirInode.NodeId == 1 && name == TrashDirName {
+			continue
+		}
+		relPath := path.Join(relDir, name)
+		vfsPath := path.Join(vfsDir, relPath)
+		hostPath := filepath.Join(hostDir, filepath.FromSlash(relPath))
+		inode, err := LoadInode(i.fs, item.Inode, i.superBlock.InodeStartAddress)
+		if err != nil {
+			fmt.Fprintln(i.out, Msg(MsgCopyFailed, vfsPath, err))
+			summary.failed++
+			continue
+		}
+		if options.excluded(relPath, inode.IsDirectory) {
+			continue
+		}
+		if options.dryRun {
+			fmt.Fprintln(i.out, Msg(MsgCopyPlanned, vfsPath, hostPath))
+		}
+
+		if inode.IsDirectory {
+			if !options.dryRun {
+				if err := os.Mkdir(hostPath, 0777); err != nil && !errors.Is(err, fs.ErrExist) {
+					fmt.Fprintln(i.out, Msg(MsgCopyFailed, hostPath, err))
+					summary.failed++
+					continue
+				}
+			}
+			summary.dirs++
+			if err := i.copyTreeOut(inode, vfsDir, hostDir, relPath, options, summary); err != nil {
+				fmt.Fprintln(i.out, Msg(MsgCopyFailed, vfsPath, err))
+				summary.failed++
+			}
+			continue
+		}
+		written := inode.FileSize
+		if !options.dryRun {
+			written, err = i.copyFileOut(inode.NodeId, hostPath)
+			if err != nil {
+				fmt.Fprintln(i.out, Msg(MsgCopyFailed, hostPath, err))
+				summary.failed++
+				continue
+			}
+		}
+		summary.files++
+		summary.bytes += written
+	}
+	return nil
+}
+
+// copyFileOut copies a file of the filesystem to the host keeping its holes (see sparse.go),
+// it returns the size of the file.
+func (i *Interpreter) copyFileOut(inodeId int32, hostPath string) (int64, error) {
+	src, err := OpenFile(i.fs, inodeId, 0, i.superBlock)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := os.Create(hostPath)
+	if err != nil {
+		return 0, err
+	}
+	written, err := copyOutOfFile(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
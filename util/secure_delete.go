@@ -0,0 +1,104 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Secure deletion.
+//
+// Freeing a cluster or an inode only clears its bit in a bitmap, so the old content stays readable in the image.
+// With SuperblockFlagSecureDelete (format --secure-delete) every freed cluster and the record of every deleted
+// inode is overwritten with zeros. shred deletes one file this way on any image and wipefree overwrites
+// everything which is already free, for example before an image is shipped.
+
+// SecureDeleteEnabled reports whether freed clusters and inodes of the filesystem are overwritten with zeros.
+func SecureDeleteEnabled(superBlock Superblock) bool {
+	return superBlock.Flags&SuperblockFlagSecureDelete != 0
+}
+
+// wipeClusters overwrites the given data clusters with zeros.
+func wipeClusters(fs BlockDevice, superBlock Superblock, clusters []int32) error {
+	zeros := make([]byte, superBlock.ClusterSize)
+	for _, cluster := range clusters {
+		traceIO(fs, "wipeClusters", true, ClusterAddress(superBlock, cluster), len(zeros))
+		_, err := fs.WriteAt(zeros, ClusterAddress(superBlock, cluster))
+		if err != nil {
+			return fmt.Errorf("could not wipe cluster %d: %v", cluster, err)
+		}
+	}
+	return nil
+}
+
+// ShredDirItem removes the item with the given name from the directory like RemoveDirItem with delete set.
+// If it was the last link of the file, the data, indirect and attribute clusters of the file and its inode are
+// overwritten with zeros before they are freed, even if secure delete is not enabled for the filesystem.
+// Files with other links keep their data.
+func ShredDirItem(dirInodeId int32, dirItemName string, fs BlockDevice, superBlock Superblock) error {
+	//DeleteFile only looks at the flag of the superblock it is given
+	superBlock.Flags |= SuperblockFlagSecureDelete
+	return RemoveDirItem(dirInodeId, dirItemName, fs, superBlock, true)
+}
+
+// WipeFree overwrites all free data clusters and free inode records with zeros.
+// Clusters and records which already contain only zeros are not written, so unused parts of a sparse image
+// stay unallocated on the host. It returns the number of clusters and inodes which were overwritten.
+func WipeFree(fs BlockDevice, superBlock Superblock) (int64, int64, error) {
+	defer lockAlloc(fs)()
+	inodeBitmap, dataBitmap, err := loadBitmaps(fs, superBlock)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var wipedClusters int64
+	firstCluster := int32(superBlock.DataStartAddress / int64(superBlock.ClusterSize))
+	block := make([]byte, superBlock.ClusterSize)
+	zeros := make([]byte, superBlock.ClusterSize)
+	for i := int32(0); i < superBlock.ClusterCount; i++ {
+		if getBit(dataBitmap[i/8], i%8) != ClusterIsFree {
+			continue
+		}
+		address := ClusterAddress(superBlock, firstCluster+i)
+		traceIO(fs, "WipeFree", false, address, len(block))
+		_, err = fs.ReadAt(block, address)
+		if err != nil {
+			return wipedClusters, 0, fmt.Errorf("could not read cluster %d: %v", firstCluster+i, err)
+		}
+		if bytes.Equal(block, zeros) {
+			continue
+		}
+		traceIO(fs, "WipeFree", true, address, len(zeros))
+		_, err = fs.WriteAt(zeros, address)
+		if err != nil {
+			return wipedClusters, 0, fmt.Errorf("could not wipe cluster %d: %v", firstCluster+i, err)
+		}
+		wipedClusters++
+	}
+
+	var wipedInodes int64
+	inodeSize := binary.Size(PseudoInode{})
+	record := make([]byte, inodeSize)
+	emptyRecord := make([]byte, inodeSize)
+	for i := int32(0); i < superBlock.InodeCount; i++ {
+		if getBit(inodeBitmap[i/8], i%8) != InodeIsFree {
+			continue
+		}
+		address := superBlock.InodeStartAddress + int64(i)*int64(inodeSize)
+		traceIO(fs, "WipeFree", false, address, len(record))
+		_, err = fs.ReadAt(record, address)
+		if err != nil {
+			return wipedClusters, wipedInodes, fmt.Errorf("could not read inode: %v", err)
+		}
+		if bytes.Equal(record, emptyRecord) {
+			continue
+		}
+		traceIO(fs, "WipeFree", true, address, len(emptyRecord))
+		_, err = fs.WriteAt(emptyRecord, address)
+		if err != nil {
+			return wipedClusters, wipedInodes, fmt.Errorf("could not write inode: %v", err)
+		}
+		wipedInodes++
+	}
+	return wipedClusters, wipedInodes, nil
+}
@@ -0,0 +1,176 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// splitAddress splits an address of the shell server into the network and the address itself.
+// "unix:/path/to/socket" and paths are unix sockets, "tcp:127.0.0.1:port" and "host:port" are TCP addresses.
+// TCP is only allowed on the loopback interface.
+func splitAddress(address string) (string, string, error) {
+	if rest, ok := strings.CutPrefix(address, "unix:"); ok {
+		return "unix", rest, nil
+	}
+	network := "unix"
+	if rest, ok := strings.CutPrefix(address, "tcp:"); ok {
+		network = "tcp"
+		address = rest
+	} else if !strings.Contains(address, string(os.PathSeparator)) && strings.Contains(address, ":") {
+		network = "tcp"
+	}
+	if network == "unix" {
+		return network, address, nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", "", err
+	}
+	if host == "localhost" {
+		return network, address, nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return "", "", fmt.Errorf("only loopback addresses (127.0.0.1, ::1, localhost) are allowed, got %q", host)
+	}
+	return network, address, nil
+}
+
+// Listen starts listening on a unix socket or a loopback TCP address (see splitAddress).
+// A unix socket left behind by a server which is no longer running is removed.
+func Listen(address string) (net.Listener, error) {
+	network, addr, err := splitAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil && network == "unix" {
+		if conn, dialErr := net.Dial(network, addr); dialErr == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is used by a running server", addr)
+		}
+		os.Remove(addr)
+		listener, err = net.Listen(network, addr)
+	}
+	return listener, err
+}
+
+// Server runs an interpreter session for every connection, all sessions share one filesystem.
+type Server struct {
+	fs       BlockDevice
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	sessions int //number of sessions opened so far, used to identify them in the log
+	wg       sync.WaitGroup
+}
+
+// NewServer creates a server which serves the filesystem on the given device to connections accepted by the listener.
+func NewServer(listener net.Listener, fs BlockDevice) *Server {
+	return &Server{
+		fs:       fs,
+		listener: listener,
+		conns:    map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts connections until the server is closed. It returns nil after Close.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			s.wg.Wait()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.sessions++
+		id := s.sessions
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serveSession(conn, id)
+	}
+}
+
+// Close stops accepting connections and ends all sessions.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// serveSession runs the commands of one connection, each connection has its own current directory.
+func (s *Server) serveSession(conn net.Conn, id int) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	log.Printf("session %d opened", id)
+	defer log.Printf("session %d closed", id)
+
+	session := NewSession(s.fs, conn, conn, true)
+	for {
+		//a session which cannot load the image reports it and goes on, the other sessions are not affected
+		if err := session.LoadInterpreter(); err != nil {
+			fmt.Fprintln(conn, err)
+		}
+		arr, err := session.ReadCommand()
+		var netErr net.Error
+		if err == io.EOF || errors.Is(err, net.ErrClosed) || errors.As(err, &netErr) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(conn, err)
+			continue
+		}
+		err = session.ExecCommand(arr)
+		if err != nil {
+			fmt.Fprintln(conn, err)
+		}
+	}
+}
+
+// Connect connects to a running server, sends it commands read from in and copies its output into out.
+// It returns after the input ends and the server has answered all commands.
+func Connect(address string, in io.Reader, out io.Writer) error {
+	network, addr, err := splitAddress(address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	received := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(out, conn)
+		received <- err
+	}()
+
+	if _, err := io.Copy(conn, in); err != nil {
+		return err
+	}
+	//tell the server there are no more commands, it closes the connection after answering them
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		halfCloser.CloseWrite()
+	}
+	return <-received
+}
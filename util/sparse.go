@@ -0,0 +1,153 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Copying of sparse files between the host and the filesystem (incp, outcp).
+//
+// Only the data ranges of a file of the host are read (SEEK_DATA and SEEK_HOLE on Linux), and clusters which
+// contain only zeros are not written, so they stay holes in the filesystem. The other way, the holes of a file
+// of the filesystem are skipped and the file of the host gets its size by Truncate, so they become holes there too.
+
+// copyBufferClusters is the number of clusters read from the host at once.
+const copyBufferClusters = 64
+
+// copyIntoFile copies a file of the host into an empty file of the filesystem, leaving holes where the file of
+// the host has holes or clusters of zeros. It returns the size of the file.
+func copyIntoFile(dst *File, src *os.File, clusterSize int64) (int64, error) {
+	info, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	buf := make([]byte, copyBufferClusters*clusterSize)
+	for offset := int64(0); offset < size; {
+		start, end, ok := hostNextData(src, offset, size)
+		if !ok {
+			break
+		}
+		for pos := start; pos < end; {
+			//pieces end at cluster boundaries, so whole clusters of zeros are found
+			n := min(int64(len(buf))-pos%clusterSize, end-pos)
+			if _, err := src.ReadAt(buf[:n], pos); err != nil {
+				return 0, err
+			}
+			if err := writeNonZero(dst, buf[:n], pos, clusterSize); err != nil {
+				return 0, err
+			}
+			pos += n
+		}
+		offset = end
+	}
+	//a hole at the end, writes only reach the last data
+	if err := dst.Truncate(size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// writeNonZero writes the parts of the buffer which lie in clusters with some non-zero byte into the file
+// at the offset, runs of such clusters are written at once.
+func writeNonZero(dst *File, buf []byte, offset int64, clusterSize int64) error {
+	runStart := -1
+	flush := func(runEnd int) error {
+		if runStart == -1 {
+			return nil
+		}
+		if _, err := dst.Seek(offset+int64(runStart), io.SeekStart); err != nil {
+			return err
+		}
+		_, err := dst.Write(buf[runStart:runEnd])
+		runStart = -1
+		return err
+	}
+	for pos := 0; pos < len(buf); {
+		next := pos + int(clusterSize-(offset+int64(pos))%clusterSize)
+		next = min(next, len(buf))
+		if isZero(buf[pos:next]) {
+			if err := flush(pos); err != nil {
+				return err
+			}
+		} else if runStart == -1 {
+			runStart = pos
+		}
+		pos = next
+	}
+	return flush(len(buf))
+}
+
+// copyOutOfFile copies a file of the filesystem into an empty file of the host, the holes of the file are
+// skipped, so the file of the host gets holes where the filesystem of the host supports them.
+// It returns the size of the file.
+func copyOutOfFile(dst *os.File, src *File) (int64, error) {
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	for offset := int64(0); offset < size; {
+		start, err := src.Seek(offset, SeekData)
+		if errors.Is(err, ErrNoData) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		end, err := src.Seek(start, SeekHole)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := src.Seek(start, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := dst.Seek(start, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(dst, src, end-start); err != nil {
+			return 0, err
+		}
+		offset = end
+	}
+	return size, dst.Truncate(size)
+}
+
+// copyBetweenFiles copies a file of the filesystem into another one at the offset. The holes of the source are
+// skipped and clusters of zeros are not written, so they stay holes in the destination.
+// It returns the size of the source, the caller extends the destination to it.
+func copyBetweenFiles(dst *File, src *File, offset int64, clusterSize int64) (int64, error) {
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, copyBufferClusters*clusterSize)
+	for pos := int64(0); pos < size; {
+		start, err := src.Seek(pos, SeekData)
+		if errors.Is(err, ErrNoData) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		end, err := src.Seek(start, SeekHole)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := src.Seek(start, io.SeekStart); err != nil {
+			return 0, err
+		}
+		for pos = start; pos < end; {
+			//pieces end at cluster boundaries of the destination, so whole clusters of zeros are found
+			n := min(int64(len(buf))-(offset+pos)%clusterSize, end-pos)
+			if _, err := io.ReadFull(src, buf[:n]); err != nil {
+				return 0, err
+			}
+			if err := writeNonZero(dst, buf[:n], offset+pos, clusterSize); err != nil {
+				return 0, err
+			}
+			pos += n
+		}
+	}
+	return size, nil
+}
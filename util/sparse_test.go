@@ -0,0 +1,166 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The sparse file of the tests has data in its first cluster, a hole reaching into the clusters behind the doubly
+// indirect pointer, data in two clusters there and a hole at its end.
+
+const (
+	sparseTailCluster = 200
+	sparseClusters    = 300
+)
+
+// sparseContent returns the content of the sparse file for the cluster size.
+func sparseContent(clusterSize int64) []byte {
+	content := make([]byte, sparseClusters*clusterSize)
+	copy(content, "head")
+	tail := content[sparseTailCluster*clusterSize+10 : sparseTailCluster*clusterSize+610]
+	for n := range tail {
+		tail[n] = byte(n%250 + 1)
+	}
+	return content
+}
+
+// newEmptyFile creates a file in no directory and opens it.
+func newEmptyFile(t *testing.T, dev BlockDevice, superBlock Superblock) *File {
+	t.Helper()
+	_, inodeId, err := WriteAndSaveData(nil, dev, superBlock, false)
+	if err != nil {
+		t.Fatalf("create file: %v", err)
+	}
+	file, err := OpenFile(dev, int32(inodeId), 0, superBlock)
+	if err != nil {
+		t.Fatalf("open file: %v", err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+// writeSparseFile writes the data of the sparse file at their offsets and extends it to its size.
+func writeSparseFile(t *testing.T, file *File, clusterSize int64) {
+	t.Helper()
+	content := sparseContent(clusterSize)
+	tail := sparseTailCluster * clusterSize
+	for _, data := range [][2]int64{{0, 4}, {tail + 10, tail + 610}} {
+		if _, err := file.Seek(data[0], io.SeekStart); err != nil {
+			t.Fatalf("seek: %v", err)
+		}
+		if _, err := file.Write(content[data[0]:data[1]]); err != nil {
+			t.Fatalf("write at %d: %v", data[0], err)
+		}
+	}
+	if err := file.Truncate(int64(len(content))); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+}
+
+// checkSparseFile checks the content and the clusters of a copy of the sparse file.
+func checkSparseFile(t *testing.T, dev BlockDevice, superBlock Superblock, file *File) {
+	t.Helper()
+	clusterSize := int64(superBlock.ClusterSize)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(content, sparseContent(clusterSize)) {
+		t.Fatalf("the file has %d bytes which differ from the %d written", len(content), len(sparseContent(clusterSize)))
+	}
+	inode, err := LoadInode(dev, file.inodeId, superBlock.InodeStartAddress)
+	if err != nil {
+		t.Fatalf("load inode: %v", err)
+	}
+	data, pointers, err := GetFileClusters(dev, inode, superBlock)
+	if err != nil {
+		t.Fatalf("clusters: %v", err)
+	}
+	//the first cluster and the two of the tail, the doubly indirect block and one block of pointers under it
+	if len(data) != 3 || len(pointers) != 2 {
+		t.Errorf("the file has %d data and %d pointer clusters, want 3 and 2", len(data), len(pointers))
+	}
+}
+
+func TestSparseFile(t *testing.T) {
+	dev, superBlock := newStressFilesystem(t)
+	clusterSize := int64(superBlock.ClusterSize)
+	file := newEmptyFile(t, dev, superBlock)
+	writeSparseFile(t, file, clusterSize)
+	checkSparseFile(t, dev, superBlock, file)
+
+	tail := sparseTailCluster * clusterSize
+	seeks := []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{0, SeekData, 0},
+		{3, SeekData, 3},
+		{0, SeekHole, clusterSize},
+		{clusterSize, SeekData, tail},
+		{tail - 1, SeekHole, tail - 1},
+		{tail + 20, SeekData, tail + 20},
+		{tail, SeekHole, tail + 2*clusterSize},
+		{tail + 2*clusterSize, SeekHole, tail + 2*clusterSize},
+		{sparseClusters * clusterSize, SeekHole, sparseClusters * clusterSize},
+	}
+	for _, seek := range seeks {
+		got, err := file.Seek(seek.offset, seek.whence)
+		if err != nil || got != seek.want {
+			t.Errorf("seek %d with whence %d: %d, %v, want %d", seek.offset, seek.whence, got, err, seek.want)
+		}
+	}
+	for _, offset := range []int64{tail + 2*clusterSize, sparseClusters * clusterSize} {
+		if _, err := file.Seek(offset, SeekData); !errors.Is(err, ErrNoData) {
+			t.Errorf("seek data at %d: %v, want ErrNoData", offset, err)
+		}
+	}
+}
+
+func TestSparseRoundTrip(t *testing.T) {
+	dev, superBlock := newStressFilesystem(t)
+	clusterSize := int64(superBlock.ClusterSize)
+	original := newEmptyFile(t, dev, superBlock)
+	writeSparseFile(t, original, clusterSize)
+
+	//out to the host and back in
+	host, err := os.Create(filepath.Join(t.TempDir(), "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	if _, err := copyOutOfFile(host, original); err != nil {
+		t.Fatalf("copy out: %v", err)
+	}
+	hostContent, err := os.ReadFile(host.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hostContent, sparseContent(clusterSize)) {
+		t.Fatal("the file of the host differs")
+	}
+	copiedIn := newEmptyFile(t, dev, superBlock)
+	if _, err := copyIntoFile(copiedIn, host, clusterSize); err != nil {
+		t.Fatalf("copy in: %v", err)
+	}
+	checkSparseFile(t, dev, superBlock, copiedIn)
+
+	//inside the filesystem like cp
+	copied := newEmptyFile(t, dev, superBlock)
+	size, err := copyBetweenFiles(copied, original, 0, clusterSize)
+	if err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if err := copied.Truncate(size); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	checkSparseFile(t, dev, superBlock, copied)
+}
@@ -0,0 +1,229 @@
+package util
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Runtime statistics (stats, --metrics).
+//
+// The core counts the accesses to the images (see traceIO), allocated and freed clusters and inodes and seeks of
+// open files, the interpreter counts the commands and how long they take. The counters belong to the process,
+// so a server adds up all its sessions. They are printed by stats and can be served on a loopback address as
+// expvar JSON (/debug/vars) and in the Prometheus text format (/metrics).
+
+// CommandTime is the number and the duration of the executions of one command.
+type CommandTime struct {
+	Count  int64
+	Failed int64
+	Total  time.Duration
+	Max    time.Duration
+}
+
+// Statistics is a snapshot of the counters.
+type Statistics struct {
+	Commands          int64
+	CommandsFailed    int64
+	Reads             int64
+	BytesRead         int64
+	Writes            int64
+	BytesWritten      int64
+	ClustersAllocated int64
+	ClustersFreed     int64
+	InodesAllocated   int64
+	InodesFreed       int64
+	Seeks             int64
+	CommandTimes      map[string]CommandTime
+}
+
+var stats struct {
+	reads             atomic.Int64
+	bytesRead         atomic.Int64
+	writes            atomic.Int64
+	bytesWritten      atomic.Int64
+	clustersAllocated atomic.Int64
+	clustersFreed     atomic.Int64
+	inodesAllocated   atomic.Int64
+	inodesFreed       atomic.Int64
+	seeks             atomic.Int64
+
+	mu           sync.Mutex //guards commandTimes
+	commandTimes map[string]*CommandTime
+}
+
+// countIO counts one access to an image.
+func countIO(write bool, length int) {
+	if write {
+		stats.writes.Add(1)
+		stats.bytesWritten.Add(int64(length))
+	} else {
+		stats.reads.Add(1)
+		stats.bytesRead.Add(int64(length))
+	}
+}
+
+// countCommand records an execution of the command which took the given time.
+func countCommand(command string, duration time.Duration, failed bool) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.commandTimes == nil {
+		stats.commandTimes = make(map[string]*CommandTime)
+	}
+	t, ok := stats.commandTimes[command]
+	if !ok {
+		t = &CommandTime{}
+		stats.commandTimes[command] = t
+	}
+	t.Count++
+	if failed {
+		t.Failed++
+	}
+	t.Total += duration
+	t.Max = max(t.Max, duration)
+}
+
+// ReadStats returns the current values of the counters.
+func ReadStats() Statistics {
+	s := Statistics{
+		Reads:             stats.reads.Load(),
+		BytesRead:         stats.bytesRead.Load(),
+		Writes:            stats.writes.Load(),
+		BytesWritten:      stats.bytesWritten.Load(),
+		ClustersAllocated: stats.clustersAllocated.Load(),
+		ClustersFreed:     stats.clustersFreed.Load(),
+		InodesAllocated:   stats.inodesAllocated.Load(),
+		InodesFreed:       stats.inodesFreed.Load(),
+		Seeks:             stats.seeks.Load(),
+		CommandTimes:      make(map[string]CommandTime),
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	for command, t := range stats.commandTimes {
+		s.CommandTimes[command] = *t
+		s.Commands += t.Count
+		s.CommandsFailed += t.Failed
+	}
+	return s
+}
+
+// ResetStats sets all counters to zero.
+func ResetStats() {
+	for _, counter := range []*atomic.Int64{&stats.reads, &stats.bytesRead, &stats.writes, &stats.bytesWritten,
+		&stats.clustersAllocated, &stats.clustersFreed, &stats.inodesAllocated, &stats.inodesFreed, &stats.seeks} {
+		counter.Store(0)
+	}
+	stats.mu.Lock()
+	stats.commandTimes = nil
+	stats.mu.Unlock()
+}
+
+// sortedCommands returns the names of the commands in the statistics in alphabetical order.
+func (s Statistics) sortedCommands() []string {
+	commands := make([]string, 0, len(s.CommandTimes))
+	for command := range s.CommandTimes {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// WriteText writes the statistics in a form readable by people.
+func (s Statistics) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "%-20s %d (%d failed)\n", "commands", s.Commands, s.CommandsFailed)
+	fmt.Fprintf(w, "%-20s %d (%d bytes)\n", "reads", s.Reads, s.BytesRead)
+	fmt.Fprintf(w, "%-20s %d (%d bytes)\n", "writes", s.Writes, s.BytesWritten)
+	fmt.Fprintf(w, "%-20s %d\n", "clusters allocated", s.ClustersAllocated)
+	fmt.Fprintf(w, "%-20s %d\n", "clusters freed", s.ClustersFreed)
+	fmt.Fprintf(w, "%-20s %d\n", "inodes allocated", s.InodesAllocated)
+	fmt.Fprintf(w, "%-20s %d\n", "inodes freed", s.InodesFreed)
+	fmt.Fprintf(w, "%-20s %d\n", "seeks", s.Seeks)
+	if len(s.CommandTimes) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n%-12s %8s %8s %12s %12s %12s\n", "command", "count", "failed", "total", "average", "max")
+	for _, command := range s.sortedCommands() {
+		t := s.CommandTimes[command]
+		fmt.Fprintf(w, "%-12s %8d %8d %12s %12s %12s\n", command, t.Count, t.Failed,
+			t.Total.Round(time.Microsecond), (t.Total / time.Duration(t.Count)).Round(time.Microsecond),
+			t.Max.Round(time.Microsecond))
+	}
+}
+
+// WritePrometheus writes the statistics in the Prometheus text exposition format.
+func (s Statistics) WritePrometheus(w io.Writer) {
+	counters := []struct {
+		name, help string
+		value      int64
+	}{
+		{"vfs_commands_total", "Number of executed commands.", s.Commands},
+		{"vfs_commands_failed_total", "Number of commands which failed.", s.CommandsFailed},
+		{"vfs_reads_total", "Number of reads from images.", s.Reads},
+		{"vfs_read_bytes_total", "Number of bytes read from images.", s.BytesRead},
+		{"vfs_writes_total", "Number of writes into images.", s.Writes},
+		{"vfs_written_bytes_total", "Number of bytes written into images.", s.BytesWritten},
+		{"vfs_clusters_allocated_total", "Number of allocated data clusters.", s.ClustersAllocated},
+		{"vfs_clusters_freed_total", "Number of freed data clusters.", s.ClustersFreed},
+		{"vfs_inodes_allocated_total", "Number of allocated inodes.", s.InodesAllocated},
+		{"vfs_inodes_freed_total", "Number of freed inodes.", s.InodesFreed},
+		{"vfs_seeks_total", "Number of seeks of open files.", s.Seeks},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+	}
+	fmt.Fprintln(w, "# HELP vfs_command_duration_seconds Time spent executing commands.")
+	fmt.Fprintln(w, "# TYPE vfs_command_duration_seconds summary")
+	for _, command := range s.sortedCommands() {
+		t := s.CommandTimes[command]
+		fmt.Fprintf(w, "vfs_command_duration_seconds_sum{command=%q} %g\n", command, t.Total.Seconds())
+		fmt.Fprintf(w, "vfs_command_duration_seconds_count{command=%q} %d\n", command, t.Count)
+	}
+}
+
+// Stats prints the statistics of the process: stats [reset].
+func (i *Interpreter) Stats(arr []string) error {
+	switch {
+	case len(arr) == 1:
+		ReadStats().WriteText(i.out)
+	case len(arr) == 2 && arr[1] == "reset":
+		ResetStats()
+		fmt.Fprintln(i.out, Msg(MsgOK))
+	default:
+		return msgError(MsgArgsStats)
+	}
+	return nil
+}
+
+var publishStats sync.Once
+
+// StartMetricsServer serves the statistics over HTTP on a loopback TCP address (for example 127.0.0.1:9100):
+// expvar JSON on /debug/vars and the Prometheus text format on /metrics. Close the returned server to stop it.
+func StartMetricsServer(address string) (*http.Server, error) {
+	network, addr, err := splitAddress("tcp:" + address)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	publishStats.Do(func() {
+		expvar.Publish("vfs", expvar.Func(func() any { return ReadStats() }))
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		ReadStats().WritePrometheus(w)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	return server, nil
+}
@@ -0,0 +1,374 @@
+package util
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Import and export of tar archives: tarin and tarout.
+//
+// Directories, regular files and hard links are stored in the image with their names and modification times.
+// The filesystem has no permissions, so a mode other than the default one (0644 for files, 0755 for directories)
+// is kept in the extended attribute unix.mode and written back by tarout. Symbolic links and special files are
+// skipped. Archives whose name ends with .gz or .tgz are compressed by gzip, tarin recognizes them by content.
+
+const (
+	xattrUnixMode   = "unix.mode"
+	defaultFileMode = 0644
+	defaultDirMode  = 0755
+)
+
+// isGzipName reports whether an archive with the given name is compressed by gzip.
+func isGzipName(name string) bool {
+	return strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// cleanArchiveName returns the name of an archive entry relative to the directory it is extracted into.
+// Names which would leave the directory are refused.
+func cleanArchiveName(name string) (string, error) {
+	cleaned := path.Clean("/" + name)[1:]
+	for _, part := range strings.Split(path.Clean(name), "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%s points outside of the directory", name)
+		}
+	}
+	return cleaned, nil
+}
+
+// newArchiveReader reads the archive from the start of the file, gzip is recognized by its magic bytes.
+// The returned function closes the decompressor, the file stays open.
+func newArchiveReader(file *os.File) (*tar.Reader, func(), error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	buffered := bufio.NewReader(file)
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(gz), func() { gz.Close() }, nil
+	}
+	return tar.NewReader(buffered), func() {}, nil
+}
+
+// checkArchiveNames reads all entries of the archive and returns an error listing the names which cannot be
+// extracted: names leaving the directory and names with an element which does not fit into a directory item.
+func checkArchiveNames(tr *tar.Reader) error {
+	var bad []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		names := []string{header.Name}
+		if header.Typeflag == tar.TypeLink {
+			names = append(names, header.Linkname)
+		}
+		for _, name := range names {
+			cleaned, err := cleanArchiveName(name)
+			if err == nil && cleaned != "" {
+				for _, part := range strings.Split(cleaned, "/") {
+					if err = checkItemName(part); err != nil {
+						break
+					}
+				}
+			}
+			if err != nil && !slices.Contains(bad, err.Error()) {
+				bad = append(bad, err.Error())
+			}
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%s", strings.Join(bad, "; "))
+	}
+	return nil
+}
+
+// Tarin extracts a tar archive of the host into a directory of the filesystem: tarin <archive.tar[.gz]> <dir>.
+// The directory is created if it does not exist, existing files are overwritten. Nothing is extracted from an archive
+// with a name which would leave the directory or which has an element longer than a directory item allows.
+func (i *Interpreter) Tarin(arr []string) error {
+	if len(arr) != 3 {
+		return msgError(MsgArgsTarin)
+	}
+	file, err := os.Open(arr[1])
+	if err != nil {
+		return msgError(MsgSourceNotFound)
+	}
+	defer file.Close()
+	//the names are checked first, so a bad archive does not leave a half extracted tree
+	tr, closeArchive, err := newArchiveReader(file)
+	if err == nil {
+		err = checkArchiveNames(tr)
+		closeArchive()
+	}
+	if err != nil {
+		return msgError(MsgErrTar, err)
+	}
+	tr, closeArchive, err = newArchiveReader(file)
+	if err != nil {
+		return msgError(MsgErrTar, err)
+	}
+	defer closeArchive()
+	if _, err := i.mkdirAll(arr[2]); err != nil {
+		return err
+	}
+
+	var files, dirs, links int
+	imported := make(map[string]int32) //inode ids of the extracted entries by their names, for hard links
+	dirTimes := make(map[int32]time.Time)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return msgError(MsgErrTar, err)
+		}
+		name, err := cleanArchiveName(header.Name)
+		if err != nil {
+			return msgError(MsgErrTar, err)
+		}
+		vfsPath := path.Join(arr[2], name)
+
+		var inodeId int32
+		defaultMode := int64(defaultFileMode)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			inodeId, err = i.mkdirAll(vfsPath)
+			defaultMode = defaultDirMode
+			//"./" is the directory the archive is extracted into
+			if name != "" {
+				dirs++
+			}
+		case tar.TypeReg:
+			inodeId, err = i.extractFile(vfsPath, tr)
+			files++
+		case tar.TypeLink:
+			inodeId, err = i.extractLink(vfsPath, header.Linkname, imported)
+			links++
+		default:
+			fmt.Fprintln(i.out, Msg(MsgSkipped, header.Name))
+			continue
+		}
+		if err != nil {
+			return msgError(MsgErrTar, fmt.Errorf("%s: %v", header.Name, err))
+		}
+		imported[name] = inodeId
+		if header.Typeflag == tar.TypeLink {
+			//a link shares the inode, its header does not carry the times or mode of the file
+			continue
+		}
+		if header.Mode&0777 != defaultMode {
+			err = SetXattr(i.fs, inodeId, xattrUnixMode, []byte(strconv.FormatInt(header.Mode&07777, 8)), i.superBlock)
+			if err != nil {
+				return msgError(MsgErrWriteXattr, err)
+			}
+		}
+		if header.Typeflag == tar.TypeDir {
+			//adding items changes the time of a directory, so it is set at the end
+			dirTimes[inodeId] = header.ModTime
+		} else if err = Touch(i.fs, inodeId, header.ModTime, i.superBlock); err != nil {
+			return msgError(MsgErrWriteData, err)
+		}
+	}
+	for inodeId, modTime := range dirTimes {
+		if err := Touch(i.fs, inodeId, modTime, i.superBlock); err != nil {
+			return msgError(MsgErrWriteData, err)
+		}
+	}
+	fmt.Fprintln(i.out, Msg(MsgTarDone, files, dirs, links))
+	return nil
+}
+
+// extractFile writes the content of a regular file of the archive into the filesystem.
+func (i *Interpreter) extractFile(vfsPath string, content io.Reader) (int32, error) {
+	if _, err := i.mkdirAll(getPathDir(vfsPath)); err != nil {
+		return 0, err
+	}
+	inodeId, err := i.createFile(vfsPath)
+	if err != nil {
+		return 0, err
+	}
+	file, err := OpenFile(i.fs, inodeId, OpenTruncate, i.superBlock)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, content)
+	return inodeId, err
+}
+
+// extractLink adds a hard link to a file extracted from the archive before.
+func (i *Interpreter) extractLink(vfsPath string, linkName string, imported map[string]int32) (int32, error) {
+	target, err := cleanArchiveName(linkName)
+	if err != nil {
+		return 0, err
+	}
+	inodeId, ok := imported[target]
+	if !ok {
+		return 0, fmt.Errorf("link target %s is not in the archive", linkName)
+	}
+	parentId, err := i.mkdirAll(getPathDir(vfsPath))
+	if err != nil {
+		return 0, err
+	}
+	//an existing file of the same name is replaced like by tar
+	if _, err := LookupDirItem(i.fs, parentId, path.Base(vfsPath), i.superBlock); err == nil {
+		if err := RemoveDirItem(parentId, path.Base(vfsPath), i.fs, i.superBlock, true); err != nil {
+			return 0, err
+		}
+	}
+	return inodeId, AddDirItem(parentId, inodeId, path.Base(vfsPath), i.fs, i.superBlock)
+}
+
+// Tarout writes a directory of the filesystem with everything in it into a tar archive of the host:
+// tarout <dir> <archive.tar[.gz]>. The names in the archive are relative to the directory.
+func (i *Interpreter) Tarout(arr []string) error {
+	if len(arr) != 3 {
+		return msgError(MsgArgsTarout)
+	}
+	dirInode, _, err := PathToInode(i.fs, arr[1], i.superBlock, i.currentDirInode)
+	if err != nil {
+		return msgError(MsgSourceNotFound)
+	}
+	if !dirInode.IsDirectory {
+		return msgError(MsgNotADirectory)
+	}
+	file, err := os.Create(arr[2])
+	if err != nil {
+		return msgError(MsgDestPathNotFound)
+	}
+	defer file.Close()
+
+	buffered := bufio.NewWriter(file)
+	var archive io.Writer = buffered
+	var gz *gzip.Writer
+	if isGzipName(arr[2]) {
+		gz = gzip.NewWriter(buffered)
+		archive = gz
+	}
+	tw := tar.NewWriter(archive)
+	counts := &tarCounts{written: make(map[int32]string)}
+	err = i.writeTarDir(tw, dirInode, "", counts)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		os.Remove(arr[2])
+		return msgError(MsgErrTar, err)
+	}
+	fmt.Fprintln(i.out, Msg(MsgTarDone, counts.files, counts.dirs, counts.links))
+	return nil
+}
+
+// tarCounts counts the entries written by Tarout.
+type tarCounts struct {
+	files, dirs, links int
+	written            map[int32]string //names of the files written so far by their inode ids, for hard links
+}
+
+// writeTarDir writes the items of a directory into the archive, name is the name of the directory in the archive.
+func (i *Interpreter) writeTarDir(tw *tar.Writer, dirInode PseudoInode, name string, counts *tarCounts) error {
+	dir, err := LoadDirectory(i.fs, dirInode, i.superBlock)
+	if err != nil {
+		return err
+	}
+	for n, item := range dir {
+		//. and ..
+		if n < 2 || item.Inode == 0 {
+			continue
+		}
+		itemName := removeNullCharsFromString(string(item.ItemName[:]))
+		if dirInode.NodeId == 1 && itemName == TrashDirName {
+			continue
+		}
+		inode, err := LoadInode(i.fs, item.Inode, i.superBlock.InodeStartAddress)
+		if err != nil {
+			return err
+		}
+		header, err := i.tarHeader(inode, path.Join(name, itemName))
+		if err != nil {
+			return err
+		}
+		if linkName, ok := counts.written[inode.NodeId]; ok {
+			header.Typeflag, header.Linkname, header.Size = tar.TypeLink, linkName, 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			counts.dirs++
+			if err := i.writeTarDir(tw, inode, path.Join(name, itemName), counts); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			counts.links++
+		default:
+			counts.files++
+			counts.written[inode.NodeId] = header.Name
+			file, err := OpenFile(i.fs, inode.NodeId, 0, i.superBlock)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, file)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tarHeader returns the header of a file or a directory of the filesystem.
+func (i *Interpreter) tarHeader(inode PseudoInode, name string) (*tar.Header, error) {
+	header := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     defaultFileMode,
+		Size:     inode.FileSize,
+		ModTime:  time.Unix(0, inode.ModifyTime),
+	}
+	if inode.IsDirectory {
+		header.Name += "/"
+		header.Typeflag = tar.TypeDir
+		header.Mode = defaultDirMode
+		header.Size = 0
+	}
+	mode, err := GetXattr(i.fs, inode.NodeId, xattrUnixMode, i.superBlock)
+	if err != nil && !errors.Is(err, ErrXattrNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		if parsed, err := strconv.ParseInt(string(mode), 8, 64); err == nil {
+			header.Mode = parsed
+		}
+	}
+	return header, nil
+}
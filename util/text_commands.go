@@ -0,0 +1,431 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Commands which inspect the content of files: head, tail, wc, grep, hexdump and xxd.
+// They read the files through a File, so only the part of a file which is needed is read from the image.
+
+// defaultLineCount is the number of lines printed by head and tail without -n.
+const defaultLineCount = 10
+
+// openForReading opens the regular file at the given path for reading.
+func (i *Interpreter) openForReading(filePath string) (*File, error) {
+	inode, _, err := PathToInode(i.fs, filePath, i.superBlock, i.currentDirInode)
+	if err != nil {
+		return nil, msgError(MsgFileNotFound)
+	}
+	if inode.IsDirectory {
+		return nil, msgError(MsgIsADirectory, filePath)
+	}
+	file, err := OpenFile(i.fs, inode.NodeId, 0, i.superBlock)
+	if err != nil {
+		return nil, msgError(MsgErrReadData, err)
+	}
+	return file, nil
+}
+
+// parseNumberOption removes the option (for example -n 5 or -n5) from the arguments and returns its value.
+// If the option is not given, the default value is returned.
+func parseNumberOption(arr []string, option string, defaultValue int64) ([]string, int64, error) {
+	rest := make([]string, 0, len(arr))
+	value := defaultValue
+	for n := 0; n < len(arr); n++ {
+		arg := arr[n]
+		if !strings.HasPrefix(arg, option) {
+			rest = append(rest, arg)
+			continue
+		}
+		number := strings.TrimPrefix(arg, option)
+		if number == "" {
+			if n+1 == len(arr) {
+				return nil, 0, fmt.Errorf("%s needs a number", option)
+			}
+			n++
+			number = arr[n]
+		}
+		parsed, err := strconv.ParseInt(number, 0, 64)
+		if err != nil || parsed < 0 {
+			return nil, 0, fmt.Errorf("invalid number %s", number)
+		}
+		value = parsed
+	}
+	return rest, value, nil
+}
+
+// Head prints the first lines of a file: head [-n lines] <file>.
+func (i *Interpreter) Head(arr []string) error {
+	arr, count, err := parseNumberOption(arr, "-n", defaultLineCount)
+	if err != nil || len(arr) != 2 {
+		return msgError(MsgArgsHeadTail)
+	}
+	file, err := i.openForReading(arr[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for n := int64(0); n < count; n++ {
+		line, err := reader.ReadBytes('\n')
+		i.out.Write(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return msgError(MsgErrReadData, err)
+		}
+	}
+	return nil
+}
+
+// Tail prints the last lines of a file: tail [-n lines] <file>.
+func (i *Interpreter) Tail(arr []string) error {
+	arr, count, err := parseNumberOption(arr, "-n", defaultLineCount)
+	if err != nil || len(arr) != 2 {
+		return msgError(MsgArgsHeadTail)
+	}
+	file, err := i.openForReading(arr[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	//only the last count lines are kept
+	lines := make([][]byte, 0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && count > 0 {
+			if int64(len(lines)) == count {
+				lines = lines[1:]
+			}
+			lines = append(lines, line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return msgError(MsgErrReadData, err)
+		}
+	}
+	for _, line := range lines {
+		i.out.Write(line)
+	}
+	return nil
+}
+
+// Wc prints the number of lines, words and bytes of the files: wc <files...>.
+// A total is printed for more than one file.
+func (i *Interpreter) Wc(arr []string) error {
+	if len(arr) < 2 {
+		return msgError(MsgArgsFiles)
+	}
+	var totalLines, totalWords, totalBytes int64
+	for _, filePath := range arr[1:] {
+		file, err := i.openForReading(filePath)
+		if err != nil {
+			return err
+		}
+		var lines, words, size int64
+		inWord := false
+		reader := bufio.NewReader(file)
+		for {
+			b, err := reader.ReadByte()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return msgError(MsgErrReadData, err)
+			}
+			size++
+			if b == '\n' {
+				lines++
+			}
+			isSpace := b == ' ' || b == '\n' || b == '\t' || b == '\r' || b == '\v' || b == '\f'
+			if !isSpace && !inWord {
+				words++
+			}
+			inWord = !isSpace
+		}
+		file.Close()
+		fmt.Fprintf(i.out, "%d %d %d %s\n", lines, words, size, filePath)
+		totalLines, totalWords, totalBytes = totalLines+lines, totalWords+words, totalBytes+size
+	}
+	if len(arr) > 2 {
+		fmt.Fprintf(i.out, "%d %d %d total\n", totalLines, totalWords, totalBytes)
+	}
+	return nil
+}
+
+// Grep prints the lines of the files which match the regular expression (Go syntax):
+// grep [-r] [-i] [-n] <pattern> <files...>. With -r directories are searched recursively, -i ignores
+// the case of letters and -n prints line numbers. The lines are prefixed with the path of the file
+// when more than one file is searched.
+func (i *Interpreter) Grep(arr []string) error {
+	recursive, ignoreCase, lineNumbers := false, false, false
+	args := arr[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		for _, option := range args[0][1:] {
+			switch option {
+			case 'r':
+				recursive = true
+			case 'i':
+				ignoreCase = true
+			case 'n':
+				lineNumbers = true
+			default:
+				return msgError(MsgArgsGrep)
+			}
+		}
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return msgError(MsgArgsGrep)
+	}
+	pattern := args[0]
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return msgError(MsgErrPattern, err)
+	}
+
+	files := make([]string, 0)
+	for _, filePath := range args[1:] {
+		inode, _, err := PathToInode(i.fs, filePath, i.superBlock, i.currentDirInode)
+		if err != nil {
+			return msgError(MsgFileNotFound)
+		}
+		if !inode.IsDirectory {
+			files = append(files, filePath)
+			continue
+		}
+		if !recursive {
+			return msgError(MsgIsADirectory, filePath)
+		}
+		files, err = i.collectFiles(filePath, inode, files)
+		if err != nil {
+			return msgError(MsgErrLoadDir, err)
+		}
+	}
+
+	withNames := len(files) > 1 || recursive
+	for _, filePath := range files {
+		file, err := i.openForReading(filePath)
+		if err != nil {
+			return err
+		}
+		reader := bufio.NewReader(file)
+		for number := 1; ; number++ {
+			line, err := reader.ReadBytes('\n')
+			if len(line) > 0 && re.Match(bytes.TrimSuffix(line, []byte("\n"))) {
+				if withNames {
+					fmt.Fprintf(i.out, "%s:", filePath)
+				}
+				if lineNumbers {
+					fmt.Fprintf(i.out, "%d:", number)
+				}
+				i.out.Write(line)
+				if !bytes.HasSuffix(line, []byte("\n")) {
+					fmt.Fprintln(i.out)
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return msgError(MsgErrReadData, err)
+			}
+		}
+		file.Close()
+	}
+	return nil
+}
+
+// collectFiles appends the paths of all regular files in the directory and its subdirectories to files.
+// The trash in the root directory is skipped like in ls.
+func (i *Interpreter) collectFiles(dirPath string, dirInode PseudoInode, files []string) ([]string, error) {
+	dir, err := LoadDirectory(i.fs, dirInode, i.superBlock)
+	if err != nil {
+		return nil, err
+	}
+	for n, item := range dir {
+		//. and ..
+		if n < 2 || item.Inode == 0 {
+			continue
+		}
+		name := removeNullCharsFromString(string(item.ItemName[:]))
+		if dirInode.NodeId == 1 && name == TrashDirName {
+			continue
+		}
+		itemPath := path.Join(dirPath, name)
+		inode, err := LoadInode(i.fs, item.Inode, i.superBlock.InodeStartAddress)
+		if err != nil {
+			return nil, err
+		}
+		if !inode.IsDirectory {
+			files = append(files, itemPath)
+			continue
+		}
+		files, err = i.collectFiles(itemPath, inode, files)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Hexdump prints the content of a file in hexadecimal and as text like hexdump -C:
+// hexdump [-s offset] [-n length] <file>.
+func (i *Interpreter) Hexdump(arr []string) error {
+	return i.dump(arr, func(w io.Writer, offset int64) io.WriteCloser {
+		return &dumpWriter{w: w, offset: offset, formatLine: hexdumpLine, end: true}
+	})
+}
+
+// Xxd prints the content of a file in hexadecimal and as text like xxd: xxd [-s offset] [-n length] <file>.
+func (i *Interpreter) Xxd(arr []string) error {
+	return i.dump(arr, func(w io.Writer, offset int64) io.WriteCloser {
+		return &dumpWriter{w: w, offset: offset, formatLine: xxdLine}
+	})
+}
+
+// dump streams the part of a file selected by -s and -n into the writer created by newDumper.
+func (i *Interpreter) dump(arr []string, newDumper func(w io.Writer, offset int64) io.WriteCloser) error {
+	arr, offset, err := parseNumberOption(arr, "-s", 0)
+	if err != nil {
+		return msgError(MsgArgsDump)
+	}
+	arr, length, err := parseNumberOption(arr, "-n", -1)
+	if err != nil || len(arr) != 2 {
+		return msgError(MsgArgsDump)
+	}
+	file, err := i.openForReading(arr[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return msgError(MsgErrReadData, err)
+	}
+	var reader io.Reader = file
+	if length >= 0 {
+		reader = io.LimitReader(file, length)
+	}
+	dumper := newDumper(i.out, offset)
+	_, err = io.Copy(dumper, reader)
+	if closeErr := dumper.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return msgError(MsgErrReadData, err)
+	}
+	return nil
+}
+
+// dumpBytesPerLine is the number of bytes printed on one line by hexdump and xxd.
+const dumpBytesPerLine = 16
+
+// dumpWriter collects the bytes written into it into lines and prints them formatted by formatLine.
+type dumpWriter struct {
+	w          io.Writer
+	offset     int64 // offset of the first byte of line in the file
+	line       []byte
+	formatLine func(sb *strings.Builder, offset int64, line []byte)
+	end        bool // print the offset of the end of the data after the last line
+}
+
+func (d *dumpWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		d.line = append(d.line, b)
+		if len(d.line) == dumpBytesPerLine {
+			if err := d.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Close prints the last incomplete line.
+func (d *dumpWriter) Close() error {
+	if len(d.line) > 0 {
+		if err := d.flush(); err != nil {
+			return err
+		}
+	}
+	if d.end {
+		_, err := fmt.Fprintf(d.w, "%08x\n", d.offset)
+		return err
+	}
+	return nil
+}
+
+// flush prints the collected bytes as one line.
+func (d *dumpWriter) flush() error {
+	var sb strings.Builder
+	d.formatLine(&sb, d.offset, d.line)
+	d.offset += int64(len(d.line))
+	d.line = d.line[:0]
+	_, err := io.WriteString(d.w, sb.String())
+	return err
+}
+
+// printableByte returns the byte if it is a printable ASCII character and a dot otherwise.
+func printableByte(b byte) byte {
+	if b < 32 || b > 126 {
+		return '.'
+	}
+	return b
+}
+
+// hexdumpLine formats a line like hexdump -C: "00000010  48 65 6c 6c 6f 0a ... |Hello.|".
+func hexdumpLine(sb *strings.Builder, offset int64, line []byte) {
+	fmt.Fprintf(sb, "%08x  ", offset)
+	for n := 0; n < dumpBytesPerLine; n++ {
+		if n < len(line) {
+			fmt.Fprintf(sb, "%02x ", line[n])
+		} else {
+			sb.WriteString("   ")
+		}
+		if n == dumpBytesPerLine/2-1 {
+			sb.WriteByte(' ')
+		}
+	}
+	sb.WriteString(" |")
+	for _, b := range line {
+		sb.WriteByte(printableByte(b))
+	}
+	sb.WriteString("|\n")
+}
+
+// xxdLine formats a line like xxd: "00000010: 4865 6c6c 6f0a  Hello.".
+func xxdLine(sb *strings.Builder, offset int64, line []byte) {
+	fmt.Fprintf(sb, "%08x: ", offset)
+	for n := 0; n < dumpBytesPerLine; n++ {
+		if n < len(line) {
+			fmt.Fprintf(sb, "%02x", line[n])
+		} else {
+			sb.WriteString("  ")
+		}
+		if n%2 == 1 {
+			sb.WriteByte(' ')
+		}
+	}
+	sb.WriteByte(' ')
+	for _, b := range line {
+		sb.WriteByte(printableByte(b))
+	}
+	sb.WriteByte('\n')
+}
@@ -0,0 +1,229 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Tracing of disk accesses (trace on|off, --trace).
+//
+// The low-level functions which read and write the structures of the image (LoadInode, saveInode, readBlock,
+// saveDataBlocks, saveBitmap, LoadBitmap and a few more) report every access by traceIO. While tracing is on for
+// the device, each access is logged with its offset, length, the region of the image and the function which
+// called the low-level one, and a summary of the accesses is written after every command.
+// Tracing is kept per device like the locks, so all sessions of a shared filesystem are traced together.
+
+// tracer logs the accesses to one device.
+type tracer struct {
+	mu         sync.Mutex
+	w          io.Writer
+	superBlock Superblock // for the names of the regions
+}
+
+// commandTrace counts the accesses made by one command. Commands of the sessions of a shared filesystem run at
+// the same time, so every command has its own counters.
+type commandTrace struct {
+	command    string
+	reads      int64
+	readBytes  int64
+	writes     int64
+	writeBytes int64
+}
+
+// tracedDevice is the device a traced command runs on, it carries the counters of the command down to traceIO.
+// Locks, caches and tracers belong to the device under it (see baseDevice).
+type tracedDevice struct {
+	BlockDevice
+	call *commandTrace
+}
+
+// baseDevice returns the device under a tracedDevice, other devices are returned as they are.
+func baseDevice(dev BlockDevice) BlockDevice {
+	if traced, ok := dev.(*tracedDevice); ok {
+		return traced.BlockDevice
+	}
+	return dev
+}
+
+var (
+	tracersMu sync.Mutex
+	tracerOf  = map[BlockDevice]*tracer{}
+	//number of traced devices, so traceIO returns at once when nothing is traced
+	tracedDevices atomic.Int32
+)
+
+// StartTrace starts logging the accesses to the device into w. The superblock is used to name the regions.
+func StartTrace(dev BlockDevice, w io.Writer, superBlock Superblock) {
+	dev = baseDevice(dev)
+	tracersMu.Lock()
+	defer tracersMu.Unlock()
+	if _, ok := tracerOf[dev]; !ok {
+		tracedDevices.Add(1)
+	}
+	tracerOf[dev] = &tracer{w: w, superBlock: superBlock}
+}
+
+// StopTrace stops logging the accesses to the device. It returns false if the device was not traced.
+func StopTrace(dev BlockDevice) bool {
+	dev = baseDevice(dev)
+	tracersMu.Lock()
+	defer tracersMu.Unlock()
+	if _, ok := tracerOf[dev]; !ok {
+		return false
+	}
+	delete(tracerOf, dev)
+	tracedDevices.Add(-1)
+	return true
+}
+
+// tracerFor returns the tracer of the device, nil if the device is not traced.
+func tracerFor(dev BlockDevice) *tracer {
+	if tracedDevices.Load() == 0 {
+		return nil
+	}
+	tracersMu.Lock()
+	defer tracersMu.Unlock()
+	return tracerOf[baseDevice(dev)]
+}
+
+// traceCommand marks the start of a command on the device. It returns the device the command has to run on,
+// which counts its accesses, and a function which writes the summary of them.
+// If the device is not traced, the device itself and a function which does nothing are returned.
+func traceCommand(dev BlockDevice, command string, superBlock Superblock) (BlockDevice, func()) {
+	dev = baseDevice(dev)
+	t := tracerFor(dev)
+	if t == nil {
+		return dev, func() {}
+	}
+	t.mu.Lock()
+	t.superBlock = superBlock
+	t.mu.Unlock()
+	call := &commandTrace{command: command}
+	return &tracedDevice{BlockDevice: dev, call: call}, func() {
+		//the command stopped the trace
+		if tracerFor(dev) != t {
+			return
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		fmt.Fprintf(t.w, "%s: %d reads (%d bytes), %d writes (%d bytes)\n",
+			call.command, call.reads, call.readBytes, call.writes, call.writeBytes)
+	}
+}
+
+// traceIO counts an access of the low-level function op to the device (see stats.go) and logs it if the device
+// is traced. The access is added to the counters of the command if the device is the one of a traced command.
+func traceIO(dev BlockDevice, op string, write bool, offset int64, length int) {
+	countIO(write, length)
+	t := tracerFor(dev)
+	if t == nil {
+		return
+	}
+	//0 is traceIO, 1 the low-level function and 2 the function which called it
+	caller := "?"
+	if pc, _, _, ok := runtime.Caller(2); ok {
+		caller = shortFuncName(runtime.FuncForPC(pc).Name())
+	}
+	call := &commandTrace{command: "-"}
+	if traced, ok := dev.(*tracedDevice); ok {
+		call = traced.call
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	kind := "read"
+	if write {
+		kind = "write"
+		call.writes++
+		call.writeBytes += int64(length)
+	} else {
+		call.reads++
+		call.readBytes += int64(length)
+	}
+	fmt.Fprintf(t.w, "%s: %-5s %-15s offset %d length %d %s <- %s\n",
+		call.command, kind, op, offset, length, regionName(t.superBlock, offset), caller)
+}
+
+// shortFuncName removes the package path from a function name returned by runtime.FuncForPC.
+func shortFuncName(name string) string {
+	name = name[strings.LastIndex(name, "/")+1:]
+	return strings.TrimPrefix(name, "util.")
+}
+
+// regionName returns the name of the region of the image containing the offset,
+// with the inode id in the inode table and the cluster number in the data area.
+func regionName(superBlock Superblock, offset int64) string {
+	if superBlock.ClusterSize == 0 {
+		return "(unformatted)"
+	}
+	switch {
+	case offset >= superBlock.DataStartAddress:
+		return fmt.Sprintf("(data, cluster %d)", offset/int64(superBlock.ClusterSize))
+	case offset >= superBlock.InodeStartAddress:
+		return fmt.Sprintf("(inode table, inode %d)", (offset-superBlock.InodeStartAddress)/int64(binary.Size(PseudoInode{}))+1)
+	case offset >= superBlock.BitmapiStartAddress && offset < superBlock.BitmapiStartAddress+int64(superBlock.BitmapiSize):
+		return "(inode bitmap)"
+	case offset >= superBlock.BitmapStartAddress && offset < superBlock.BitmapStartAddress+int64(superBlock.BitmapSize):
+		return "(data bitmap)"
+	default:
+		return "(superblock)"
+	}
+}
+
+// OpenTraceOutput opens the file the trace is appended to, "" or "-" means stderr.
+// The returned function closes the file.
+func OpenTraceOutput(path string) (io.Writer, func() error, error) {
+	if path == "" || path == "-" {
+		return os.Stderr, func() error { return nil }, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, file.Close, nil
+}
+
+// Trace turns the tracing of the filesystem on or off: trace on [file] | trace off.
+// The trace is written to stderr or appended to a file of the host.
+func (i *Interpreter) Trace(arr []string) error {
+	if len(arr) < 2 || (arr[1] == "on" && len(arr) > 3) || (arr[1] == "off" && len(arr) != 2) {
+		return msgError(MsgArgsTrace)
+	}
+	switch arr[1] {
+	case "on":
+		path := ""
+		if len(arr) == 3 {
+			path = arr[2]
+		}
+		if i.shared && path != "" && path != "-" {
+			return msgError(MsgHostShared, "trace on <file>")
+		}
+		w, closeOutput, err := OpenTraceOutput(path)
+		if err != nil {
+			return msgError(MsgDestPathNotFound)
+		}
+		i.stopTrace()
+		StartTrace(i.fs, w, i.superBlock)
+		i.closeTrace = closeOutput
+	case "off":
+		StopTrace(i.fs)
+		i.stopTrace()
+	default:
+		return msgError(MsgArgsTrace)
+	}
+	return nil
+}
+
+// stopTrace closes the output of the trace started by the session.
+func (i *Interpreter) stopTrace() {
+	if i.closeTrace != nil {
+		i.closeTrace()
+		i.closeTrace = nil
+	}
+}
@@ -0,0 +1,320 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Trash of removed files.
+//
+// When SuperblockFlagTrash is set, rm, mv and xcp move the last link of a file they remove or overwrite into the
+// hidden directory /.trash instead of deleting it. The item in the trash keeps the name of the file, a file whose
+// name is already in the trash gets ~1, ~2, ... at its end. The file carries its original path and the time it was
+// removed in extended attributes. undelete moves it back, trash empty deletes everything in the trash. When there
+// is not enough space for new data, the files removed first are purged from the trash until the data fit.
+
+const (
+	// TrashDirName is the name of the trash directory in the root directory.
+	TrashDirName = ".trash"
+
+	xattrTrashPath = "trash.path" // original absolute path of a file in the trash
+	xattrTrashTime = "trash.time" // unix time the file was moved into the trash
+)
+
+// TrashItem describes a file in the trash.
+type TrashItem struct {
+	Name    string    // name of the item in the trash directory
+	Path    string    // original path of the file
+	Removed time.Time // time the file was moved into the trash
+	Size    int64
+}
+
+// TrashEnabled reports whether removed files are moved into the trash.
+func TrashEnabled(superBlock Superblock) bool {
+	return superBlock.Flags&SuperblockFlagTrash != 0
+}
+
+// SetTrashEnabled turns the trash of the filesystem on or off and saves the superblock.
+// Files already in the trash stay there when it is turned off. It returns the updated superblock.
+func SetTrashEnabled(fs BlockDevice, enabled bool) (Superblock, error) {
+	defer lockAlloc(fs)()
+	superBlock := LoadSuperBlock(fs)
+	if enabled {
+		superBlock.Flags |= SuperblockFlagTrash
+	} else {
+		superBlock.Flags &^= SuperblockFlagTrash
+	}
+	err := saveSuperBlock(fs, superBlock)
+	if err != nil {
+		return Superblock{}, err
+	}
+	return superBlock, nil
+}
+
+// trashDirId returns the inode id of the trash directory, 0 if there is none yet.
+func trashDirId(fs BlockDevice, superBlock Superblock) (int32, error) {
+	rootDir, err := LoadInode(fs, 1, superBlock.InodeStartAddress)
+	if err != nil {
+		return 0, err
+	}
+	position, item, err := func() (int64, DirectoryItem, error) {
+		defer rlockInode(fs, 1)()
+		return dirItemPosition(fs, rootDir, TrashDirName, superBlock)
+	}()
+	if err != nil || position == -1 {
+		return 0, err
+	}
+	return item.Inode, nil
+}
+
+// createTrashDir returns the inode id of the trash directory and creates it if it does not exist.
+// The caller must hold the rename lock, so the directory is not created twice.
+func createTrashDir(fs BlockDevice, superBlock Superblock) (int32, error) {
+	trashId, err := trashDirId(fs, superBlock)
+	if err != nil || trashId != 0 {
+		return trashId, err
+	}
+	_, dirId, err := CreateDirectory(fs, superBlock, 1)
+	if err != nil {
+		return 0, err
+	}
+	err = AddDirItem(1, int32(dirId), TrashDirName, fs, superBlock)
+	if err != nil {
+		return 0, err
+	}
+	return int32(dirId), nil
+}
+
+// MoveToTrash removes the item with the given name from the directory like RemoveDirItem, but the last link of
+// a file is moved into the trash together with its original path instead of being deleted.
+// Items removed from the trash itself are deleted.
+func MoveToTrash(fs BlockDevice, dirInodeId int32, dirItemName string, originalPath string, superBlock Superblock) error {
+	defer lockRename(fs)()
+	return moveToTrash(fs, dirInodeId, dirItemName, originalPath, superBlock)
+}
+
+// moveToTrash is MoveToTrash for callers which hold the rename lock.
+func moveToTrash(fs BlockDevice, dirInodeId int32, dirItemName string, originalPath string, superBlock Superblock) error {
+	itemId, err := LookupDirItem(fs, dirInodeId, dirItemName, superBlock)
+	if err != nil {
+		return err
+	}
+	item, err := LoadInode(fs, itemId, superBlock.InodeStartAddress)
+	if err != nil {
+		return err
+	}
+	trashId, err := createTrashDir(fs, superBlock)
+	if err != nil {
+		return fmt.Errorf("could not create the trash: %v", err)
+	}
+	//other links keep the data of the file
+	if item.References > 1 || dirInodeId == trashId {
+		return RemoveDirItem(dirInodeId, dirItemName, fs, superBlock, true)
+	}
+	trashName, err := trashItemName(fs, trashId, path.Base(originalPath), superBlock)
+	if err != nil {
+		return err
+	}
+
+	//the file is added into the trash first, so it never loses its last reference
+	err = AddDirItem(trashId, itemId, trashName, fs, superBlock)
+	if err != nil {
+		return err
+	}
+	err = SetXattr(fs, itemId, xattrTrashPath, []byte(originalPath), superBlock)
+	if err == nil {
+		err = SetXattr(fs, itemId, xattrTrashTime, []byte(strconv.FormatInt(time.Now().Unix(), 10)), superBlock)
+	}
+	if err != nil {
+		RemoveDirItem(trashId, trashName, fs, superBlock, false)
+		return err
+	}
+	return RemoveDirItem(dirInodeId, dirItemName, fs, superBlock, false)
+}
+
+// RemoveOrTrash removes the item like RemoveDirItem with delete set, or moves it into the trash when the trash is on.
+func RemoveOrTrash(fs BlockDevice, dirInodeId int32, dirItemName string, originalPath string, superBlock Superblock) error {
+	defer lockRename(fs)()
+	return removeOrTrash(fs, dirInodeId, dirItemName, originalPath, superBlock)
+}
+
+// removeOrTrash is RemoveOrTrash for callers which hold the rename lock.
+func removeOrTrash(fs BlockDevice, dirInodeId int32, dirItemName string, originalPath string, superBlock Superblock) error {
+	if TrashEnabled(superBlock) {
+		return moveToTrash(fs, dirInodeId, dirItemName, originalPath, superBlock)
+	}
+	return RemoveDirItem(dirInodeId, dirItemName, fs, superBlock, true)
+}
+
+// trashItemName returns the name of a file with the given name in the trash: the name itself, or the name with
+// ~1, ~2, ... at its end (shortened to fit into an item name) if the trash has an item of that name already.
+// The caller must hold the rename lock, so no other file gets the name first.
+func trashItemName(fs BlockDevice, trashId int32, name string, superBlock Superblock) (string, error) {
+	defer rlockInode(fs, trashId)()
+	trashDir, err := LoadInode(fs, trashId, superBlock.InodeStartAddress)
+	if err != nil {
+		return "", err
+	}
+	name = storedName(name)
+	candidate := name
+	for n := 1; ; n++ {
+		position, _, err := dirItemPosition(fs, trashDir, candidate, superBlock)
+		if err != nil || position == -1 {
+			return candidate, err
+		}
+		suffix := "~" + strconv.Itoa(n)
+		candidate = name[:min(len(name), len(DirectoryItem{}.ItemName)-len(suffix))] + suffix
+	}
+}
+
+// isTrashed reports whether the file with the given inode id is in the trash.
+func isTrashed(fs BlockDevice, inodeId int32, superBlock Superblock) bool {
+	_, err := GetXattr(fs, inodeId, xattrTrashPath, superBlock)
+	return err == nil
+}
+
+// ListTrash returns the files in the trash, the ones removed first come first.
+func ListTrash(fs BlockDevice, superBlock Superblock) ([]TrashItem, error) {
+	trashId, err := trashDirId(fs, superBlock)
+	if err != nil || trashId == 0 {
+		return nil, err
+	}
+	trashDir, err := LoadInode(fs, trashId, superBlock.InodeStartAddress)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := LoadDirectory(fs, trashDir, superBlock)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]TrashItem, 0)
+	for i, v := range dir {
+		//. and ..
+		if i < 2 || v.Inode == 0 {
+			continue
+		}
+		inode, err := LoadInode(fs, v.Inode, superBlock.InodeStartAddress)
+		if err != nil {
+			return nil, err
+		}
+		attrs, err := LoadXattrs(fs, v.Inode, superBlock)
+		if err != nil {
+			return nil, err
+		}
+		removed, _ := strconv.ParseInt(string(attrs[xattrTrashTime]), 10, 64)
+		items = append(items, TrashItem{
+			Name:    removeNullCharsFromString(string(v.ItemName[:])),
+			Path:    string(attrs[xattrTrashPath]),
+			Removed: time.Unix(removed, 0),
+			Size:    inode.FileSize,
+		})
+	}
+	sort.SliceStable(items, func(a, b int) bool {
+		return items[a].Removed.Before(items[b].Removed)
+	})
+	return items, nil
+}
+
+// Undelete moves the item with the given name from the trash back to its original path and returns the path.
+// It returns ErrNotInTrash if there is no such item and ErrExist if the original path is taken by another file.
+func Undelete(fs BlockDevice, name string, superBlock Superblock) (string, error) {
+	defer lockRename(fs)()
+	trashId, err := trashDirId(fs, superBlock)
+	if err != nil {
+		return "", err
+	}
+	if trashId == 0 {
+		return "", ErrNotInTrash
+	}
+	itemId, err := LookupDirItem(fs, trashId, name, superBlock)
+	if err != nil {
+		return "", ErrNotInTrash
+	}
+	originalPath, err := GetXattr(fs, itemId, xattrTrashPath, superBlock)
+	if err != nil {
+		return "", fmt.Errorf("original path of %s is not known: %v", name, err)
+	}
+	restoredPath := string(originalPath)
+
+	rootDir, err := LoadInode(fs, 1, superBlock.InodeStartAddress)
+	if err != nil {
+		return "", err
+	}
+	parentDir, _, err := PathToInode(fs, filepath.FromSlash(path.Dir(restoredPath)), superBlock, rootDir)
+	if err != nil || !parentDir.IsDirectory {
+		return "", fmt.Errorf("directory %s does not exist", path.Dir(restoredPath))
+	}
+	err = AddDirItem(parentDir.NodeId, itemId, path.Base(restoredPath), fs, superBlock)
+	if err != nil {
+		return "", err
+	}
+	err = RemoveDirItem(trashId, name, fs, superBlock, false)
+	if err != nil {
+		return "", err
+	}
+	for _, attr := range []string{xattrTrashPath, xattrTrashTime} {
+		err = RemoveXattr(fs, itemId, attr, superBlock)
+		if err != nil && !errors.Is(err, ErrXattrNotFound) {
+			return "", err
+		}
+	}
+	return restoredPath, nil
+}
+
+// EmptyTrash deletes all files in the trash and returns how many there were.
+func EmptyTrash(fs BlockDevice, superBlock Superblock) (int, error) {
+	items, err := ListTrash(fs, superBlock)
+	if err != nil {
+		return 0, err
+	}
+	for n, item := range items {
+		err = deleteFromTrash(fs, item.Name, superBlock)
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(items), nil
+}
+
+// deleteFromTrash deletes the item with the given name from the trash.
+func deleteFromTrash(fs BlockDevice, name string, superBlock Superblock) error {
+	trashId, err := trashDirId(fs, superBlock)
+	if err != nil {
+		return err
+	}
+	if trashId == 0 {
+		return ErrNotInTrash
+	}
+	return RemoveDirItem(trashId, name, fs, superBlock, true)
+}
+
+// purgeTrash deletes the file which was moved into the trash first.
+// It returns false if the trash is empty.
+func purgeTrash(fs BlockDevice, superBlock Superblock) (bool, error) {
+	items, err := ListTrash(fs, superBlock)
+	if err != nil || len(items) == 0 {
+		return false, err
+	}
+	err = deleteFromTrash(fs, items[0].Name, superBlock)
+	return err == nil, err
+}
+
+// purgeTrashOnNoSpace calls write and, while it fails with ErrNoSpace, purges the oldest file from the trash and
+// calls it again. write has to take and release all the locks it needs, because purging locks the trash.
+func purgeTrashOnNoSpace(fs BlockDevice, superBlock Superblock, write func() error) error {
+	for {
+		err := write()
+		if !errors.Is(err, ErrNoSpace) {
+			return err
+		}
+		purged, purgeErr := purgeTrash(fs, superBlock)
+		if purgeErr != nil || !purged {
+			return err
+		}
+	}
+}
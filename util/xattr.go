@@ -0,0 +1,267 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Extended attributes are name-value pairs stored with an inode.
+//
+// Every attribute is stored as an entry: name length (1 byte), value length (2 bytes, little endian), name and value.
+// Small entries are stored in the inline area of the inode (PseudoInode.Xattrs), the rest in the attribute cluster
+// (PseudoInode.XattrCluster), which is allocated when the first attribute does not fit inline and freed when it is
+// no longer needed. A list of entries ends with a zero name length or at the end of its area.
+
+// xattrEntryHeaderSize is the size of the lengths stored before the name and value of an entry.
+const xattrEntryHeaderSize = 3
+
+// decodeXattrs adds the entries stored in the area into attrs.
+func decodeXattrs(area []byte, attrs map[string][]byte) error {
+	pos := 0
+	for pos+xattrEntryHeaderSize <= len(area) && area[pos] != 0 {
+		nameLen := int(area[pos])
+		valueLen := int(binary.LittleEndian.Uint16(area[pos+1:]))
+		pos += xattrEntryHeaderSize
+		if pos+nameLen+valueLen > len(area) {
+			return fmt.Errorf("corrupted extended attributes")
+		}
+		name := string(area[pos : pos+nameLen])
+		attrs[name] = append([]byte(nil), area[pos+nameLen:pos+nameLen+valueLen]...)
+		pos += nameLen + valueLen
+	}
+	return nil
+}
+
+// appendXattr appends the entry of one attribute to the area.
+func appendXattr(area []byte, name string, value []byte) []byte {
+	area = append(area, uint8(len(name)))
+	area = binary.LittleEndian.AppendUint16(area, uint16(len(value)))
+	area = append(area, name...)
+	return append(area, value...)
+}
+
+// layoutXattrs splits the attributes between the inline area and the attribute cluster.
+// The smallest entries are stored inline, so large values do not take the inline space.
+// It returns the content of both areas and an error if the attributes do not fit into them.
+func layoutXattrs(attrs map[string][]byte, clusterSize int32) ([]byte, []byte, error) {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	entrySize := func(name string) int {
+		return xattrEntryHeaderSize + len(name) + len(attrs[name])
+	}
+	sort.Slice(names, func(a, b int) bool {
+		if entrySize(names[a]) != entrySize(names[b]) {
+			return entrySize(names[a]) < entrySize(names[b])
+		}
+		return names[a] < names[b]
+	})
+
+	inline := make([]byte, 0, XattrInlineSize)
+	cluster := make([]byte, 0)
+	for _, name := range names {
+		size := entrySize(name)
+		if len(inline)+size <= XattrInlineSize {
+			inline = appendXattr(inline, name, attrs[name])
+		} else if len(cluster)+size <= int(clusterSize) {
+			cluster = appendXattr(cluster, name, attrs[name])
+		} else {
+			return nil, nil, fmt.Errorf("extended attributes do not fit into one cluster")
+		}
+	}
+	return inline, cluster, nil
+}
+
+// loadXattrs reads all extended attributes of the inode.
+func loadXattrs(fs BlockDevice, inode PseudoInode, superBlock Superblock) (map[string][]byte, error) {
+	attrs := map[string][]byte{}
+	err := decodeXattrs(inode.Xattrs[:], attrs)
+	if err != nil {
+		return nil, err
+	}
+	if inode.XattrCluster == 0 {
+		return attrs, nil
+	}
+	cluster, err := readBlock(fs, ClusterAddress(superBlock, inode.XattrCluster), superBlock.ClusterSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not read attribute cluster: %v", err)
+	}
+	err = decodeXattrs(cluster, attrs)
+	if err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// saveXattrs replaces the extended attributes of the inode and saves the inode.
+// The attribute cluster is allocated or freed as needed. The caller must hold the lock of the inode.
+func saveXattrs(fs BlockDevice, inode *PseudoInode, attrs map[string][]byte, superBlock Superblock) error {
+	inline, cluster, err := layoutXattrs(attrs, superBlock.ClusterSize)
+	if err != nil {
+		return err
+	}
+
+	if len(cluster) > 0 && inode.XattrCluster == 0 {
+		inode.XattrCluster, err = allocateCluster(fs, superBlock)
+		if err != nil {
+			return err
+		}
+	} else if len(cluster) == 0 && inode.XattrCluster != 0 {
+		err = freeClusters(fs, []int32{inode.XattrCluster}, superBlock)
+		if err != nil {
+			return err
+		}
+		inode.XattrCluster = 0
+	}
+
+	if inode.XattrCluster != 0 {
+		//the rest of the cluster is zeroed, which ends the list of entries
+		block := make([]byte, superBlock.ClusterSize)
+		copy(block, cluster)
+		traceIO(fs, "saveXattrs", true, ClusterAddress(superBlock, inode.XattrCluster), len(block))
+		_, err = fs.WriteAt(block, ClusterAddress(superBlock, inode.XattrCluster))
+		if err != nil {
+			return fmt.Errorf("could not write attribute cluster: %v", err)
+		}
+	}
+	inode.Xattrs = [XattrInlineSize]byte{}
+	copy(inode.Xattrs[:], inline)
+	return saveInode(fs, superBlock.InodeStartAddress, *inode)
+}
+
+// allocateCluster takes one free data cluster and returns its number.
+func allocateCluster(fs BlockDevice, superBlock Superblock) (int32, error) {
+	defer lockAlloc(fs)()
+	dataBitmap, err := LoadBitmap(fs, superBlock.BitmapStartAddress, superBlock.BitmapSize)
+	if err != nil {
+		return 0, err
+	}
+	clusters, dataBitmap, err := GetAvailableDataBlocks(dataBitmap, superBlock, int64(superBlock.ClusterSize))
+	if err != nil {
+		return 0, err
+	}
+	err = saveBitmap(fs, superBlock.BitmapStartAddress, dataBitmap)
+	if err != nil {
+		return 0, err
+	}
+	return clusters[0], nil
+}
+
+// freeClusters marks the given data clusters as free, with secure delete they are overwritten with zeros.
+func freeClusters(fs BlockDevice, clusters []int32, superBlock Superblock) error {
+	defer lockAlloc(fs)()
+	dataBitmap, err := LoadBitmap(fs, superBlock.BitmapStartAddress, superBlock.BitmapSize)
+	if err != nil {
+		return err
+	}
+	dataBitmap = SetValuesInDataBitmap(dataBitmap, clusters, superBlock, false)
+	if SecureDeleteEnabled(superBlock) {
+		err = wipeClusters(fs, superBlock, clusters)
+		if err != nil {
+			return err
+		}
+	}
+	return saveBitmap(fs, superBlock.BitmapStartAddress, dataBitmap)
+}
+
+// GetXattr returns the value of the extended attribute of the inode with the given id.
+// It returns ErrXattrNotFound if the inode does not have the attribute.
+func GetXattr(fs BlockDevice, inodeId int32, name string, superBlock Superblock) ([]byte, error) {
+	defer rlockInode(fs, inodeId)()
+	inode, err := LoadInode(fs, inodeId, superBlock.InodeStartAddress)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := loadXattrs(fs, inode, superBlock)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := attrs[name]
+	if !ok {
+		return nil, ErrXattrNotFound
+	}
+	return value, nil
+}
+
+// ListXattrs returns the sorted names of the extended attributes of the inode with the given id.
+func ListXattrs(fs BlockDevice, inodeId int32, superBlock Superblock) ([]string, error) {
+	attrs, err := LoadXattrs(fs, inodeId, superBlock)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LoadXattrs returns all extended attributes of the inode with the given id.
+func LoadXattrs(fs BlockDevice, inodeId int32, superBlock Superblock) (map[string][]byte, error) {
+	defer rlockInode(fs, inodeId)()
+	inode, err := LoadInode(fs, inodeId, superBlock.InodeStartAddress)
+	if err != nil {
+		return nil, err
+	}
+	return loadXattrs(fs, inode, superBlock)
+}
+
+// SetXattr sets the extended attribute of the inode with the given id, an existing value is replaced.
+func SetXattr(fs BlockDevice, inodeId int32, name string, value []byte, superBlock Superblock) error {
+	if len(name) == 0 || len(name) > MaxXattrNameLen {
+		return fmt.Errorf("attribute name must have 1 to %d bytes", MaxXattrNameLen)
+	}
+	if xattrEntryHeaderSize+len(name)+len(value) > int(superBlock.ClusterSize) {
+		return fmt.Errorf("attribute does not fit into one cluster")
+	}
+	defer lockInode(fs, inodeId)()
+	inode, err := LoadInode(fs, inodeId, superBlock.InodeStartAddress)
+	if err != nil {
+		return err
+	}
+	attrs, err := loadXattrs(fs, inode, superBlock)
+	if err != nil {
+		return err
+	}
+	attrs[name] = value
+	return saveXattrs(fs, &inode, attrs, superBlock)
+}
+
+// RemoveXattr removes the extended attribute of the inode with the given id.
+// It returns ErrXattrNotFound if the inode does not have the attribute.
+func RemoveXattr(fs BlockDevice, inodeId int32, name string, superBlock Superblock) error {
+	defer lockInode(fs, inodeId)()
+	inode, err := LoadInode(fs, inodeId, superBlock.InodeStartAddress)
+	if err != nil {
+		return err
+	}
+	attrs, err := loadXattrs(fs, inode, superBlock)
+	if err != nil {
+		return err
+	}
+	if _, ok := attrs[name]; !ok {
+		return ErrXattrNotFound
+	}
+	delete(attrs, name)
+	return saveXattrs(fs, &inode, attrs, superBlock)
+}
+
+// CopyXattrs replaces the extended attributes of the inode destInodeId with the attributes of srcInodeId.
+func CopyXattrs(fs BlockDevice, srcInodeId int32, destInodeId int32, superBlock Superblock) error {
+	attrs, err := LoadXattrs(fs, srcInodeId, superBlock)
+	if err != nil {
+		return err
+	}
+	defer lockInode(fs, destInodeId)()
+	inode, err := LoadInode(fs, destInodeId, superBlock.InodeStartAddress)
+	if err != nil {
+		return err
+	}
+	if len(attrs) == 0 && inode.XattrCluster == 0 && inode.Xattrs == [XattrInlineSize]byte{} {
+		return nil
+	}
+	return saveXattrs(fs, &inode, attrs, superBlock)
+}